@@ -1,18 +1,52 @@
 package main
 
 import (
-	"context"
 	"io"
 	"log"
+	"os"
+	"time"
 
 	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/genproto/protobuf/field_mask"
 	"google.golang.org/grpc"
 )
 
 func main() {
 	log.Println("Blog Client started")
 
-	opts := []grpc.DialOption{grpc.WithInsecure()}
+	// GRPCMTLS (any value) presents our client certificate, for a server that requires one
+	transport := grpc.WithInsecure()
+	if _, varSet := os.LookupEnv("GRPCMTLS"); varSet {
+		creds, err := mtls.ClientCredentials(mtls.ClientCertFile, mtls.ClientKeyFile, mtls.CAFile)
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
+		}
+		transport = grpc.WithTransportCredentials(creds)
+	}
+	opts := []grpc.DialOption{transport}
+
+	// If the server authenticates authors, sign a token with the same key file (the private half, for RS256)
+	jwtKeyFile := os.Getenv("BLOGJWTKEY")
+	if jwtKeyFile != "" {
+		token, err := auth.NewToken(jwtKeyFile, "Milos", time.Hour, "author")
+		if err != nil {
+			log.Fatalf("Could not sign a JWT: %v", err)
+		}
+		opts = append(opts, grpc.WithPerRPCCredentials(auth.TokenCredentials(token)))
+	}
+
+	stopTracing, err := tracing.Setup("blog_client", os.Getenv("GRPCTRACING"))
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	ctx, endRun := tracing.StartRun("blog client run")
+	defer endRun()
+	opts = append(opts, tracing.DialOptions()...)
 
 	cc, err := grpc.Dial("localhost:50051", opts...)
 	defer cc.Close()
@@ -20,6 +54,7 @@ func main() {
 		log.Fatalf("Could not connect: %v", err)
 	}
 	c := blogpb.NewBlogServiceClient(cc)
+	cs := blogpb.NewCommentServiceClient(cc)
 
 	//
 	// CreateBlog
@@ -31,11 +66,13 @@ func main() {
 		Content:  "My content",
 	}
 	log.Println("Sending blog request...")
-	createBlogResponse, err := c.CreateBlog(context.Background(), &blogpb.CreateBlogRequest{Blog: blog})
+	createBlogResponse, err := c.CreateBlog(ctx, &blogpb.CreateBlogRequest{Blog: blog})
 	if err != nil {
 		log.Fatalf("Unexpected error: %v", err)
 	}
 	log.Printf("Blog has been created: %v", createBlogResponse)
+	// Who the server says we are. "Milos", unless it took the author from our client certificate
+	author := createBlogResponse.GetBlog().GetAuthorId()
 
 	//
 	// ReadBlog
@@ -43,19 +80,19 @@ func main() {
 	log.Println("Reading the blog")
 
 	// Invalid UUIDv4
-	_, readBlogErr1 := c.ReadBlog(context.Background(), &blogpb.ReadBlogRequest{BlogId: "FORCEANERROR"})
+	_, readBlogErr1 := c.ReadBlog(ctx, &blogpb.ReadBlogRequest{BlogId: "FORCEANERROR"})
 	if readBlogErr1 != nil {
 		log.Printf("Error happened while trying to read the blog: %v", readBlogErr1)
 	}
 
 	// Bogus UUID should throw an InvalidArgument error
-	_, readBlogErr2 := c.ReadBlog(context.Background(), &blogpb.ReadBlogRequest{BlogId: "6b276f60-56cc-41bb-b0d5-cc9a94bd678c"})
+	_, readBlogErr2 := c.ReadBlog(ctx, &blogpb.ReadBlogRequest{BlogId: "6b276f60-56cc-41bb-b0d5-cc9a94bd678c"})
 	if readBlogErr2 != nil {
 		log.Printf("Error happened while trying to read the blog: %v", readBlogErr2)
 	}
 
 	// Proper request
-	readBlogReq, readBlogErr3 := c.ReadBlog(context.Background(), &blogpb.ReadBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+	readBlogReq, readBlogErr3 := c.ReadBlog(ctx, &blogpb.ReadBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
 	if readBlogErr3 != nil {
 		log.Printf("Error happened while trying to read the blog: %v", readBlogErr3)
 	}
@@ -71,42 +108,352 @@ func main() {
 		Title:    "My first blog",
 		Content:  "My content. Additional content.",
 	}
-	updateResp, updateErr := c.UpdateBlog(context.Background(), &blogpb.UpdateBlogRequest{Blog: newBlog})
+	updateResp, updateErr := c.UpdateBlog(ctx, &blogpb.UpdateBlogRequest{Blog: newBlog})
 	if updateErr != nil {
 		log.Printf("Error happened while updating: %v", updateErr)
 	}
 	log.Printf("blog was updated: %v", updateResp)
 
+	// Partial update. Only the title is written, the content stays as it is
+	renameResp, renameErr := c.UpdateBlog(ctx, &blogpb.UpdateBlogRequest{
+		Blog: &blogpb.Blog{
+			Id:    createBlogResponse.GetBlog().GetId(),
+			Title: "My renamed blog",
+		},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"title"}},
+	})
+	if renameErr != nil {
+		log.Printf("Error happened while updating: %v", renameErr)
+	}
+	log.Printf("blog was renamed: %v", renameResp)
+
+	// Stale update. The blog was updated twice since it was created, so it's no longer at that version (ABORTED)
+	_, staleErr := c.UpdateBlog(ctx, &blogpb.UpdateBlogRequest{
+		Blog:            newBlog,
+		ExpectedVersion: createBlogResponse.GetBlog().GetVersion(),
+	})
+	if staleErr != nil {
+		log.Printf("Error happened while updating: %v", staleErr)
+	}
+
+	// Tags only. Nothing else about the blog changes
+	tagResp, tagErr := c.UpdateBlog(ctx, &blogpb.UpdateBlogRequest{
+		Blog:       &blogpb.Blog{Id: createBlogResponse.GetBlog().GetId()},
+		AddTags:    []string{"gRPC", "Go", "first"},
+		RemoveTags: []string{"draft"},
+	})
+	if tagErr != nil {
+		log.Printf("Error happened while tagging: %v", tagErr)
+	}
+	log.Printf("blog was tagged: %v", tagResp)
+
+	//
+	// CreateComment, UpdateComment, DeleteComment, ListComments
+	//
+	log.Println("Commenting on the blog")
+
+	var commentIDs []string
+	for _, content := range []string{"First!", "Nice post", "Spam"} {
+		commentResp, commentErr := cs.CreateComment(ctx, &blogpb.CreateCommentRequest{
+			Comment: &blogpb.Comment{
+				BlogId:   createBlogResponse.GetBlog().GetId(),
+				AuthorId: "Reader",
+				Content:  content,
+			},
+		})
+		if commentErr != nil {
+			log.Printf("Error happened while commenting: %v", commentErr)
+			continue
+		}
+		log.Printf("Comment has been created: %v", commentResp)
+		commentIDs = append(commentIDs, commentResp.GetComment().GetId())
+	}
+
+	// Comments on a blog that doesn't exist should throw a NotFound error
+	_, commentErr := cs.CreateComment(ctx, &blogpb.CreateCommentRequest{
+		Comment: &blogpb.Comment{BlogId: "8494585d-5638-4ce7-b545-5974f4cdd5b0", Content: "Hello?"},
+	})
+	if commentErr != nil {
+		log.Printf("Error happened while commenting: %v", commentErr)
+	}
+
+	if len(commentIDs) == 3 {
+		updateCommentResp, updateCommentErr := cs.UpdateComment(ctx, &blogpb.UpdateCommentRequest{
+			Comment: &blogpb.Comment{
+				Id:      commentIDs[1],
+				BlogId:  createBlogResponse.GetBlog().GetId(),
+				Content: "Nice post. Edit: typo",
+			},
+		})
+		if updateCommentErr != nil {
+			log.Printf("Error happened while updating the comment: %v", updateCommentErr)
+		}
+		log.Printf("Comment was updated: %v", updateCommentResp)
+
+		_, deleteCommentErr := cs.DeleteComment(ctx, &blogpb.DeleteCommentRequest{
+			BlogId:    createBlogResponse.GetBlog().GetId(),
+			CommentId: commentIDs[2],
+		})
+		if deleteCommentErr != nil {
+			log.Printf("Error happened while deleting the comment: %v", deleteCommentErr)
+		}
+	}
+
+	// One comment per page, to show off the paging
+	listComments := func() {
+		pageToken := ""
+		for {
+			listCommentsResp, listCommentsErr := cs.ListComments(ctx, &blogpb.ListCommentsRequest{
+				BlogId:    createBlogResponse.GetBlog().GetId(),
+				PageSize:  1,
+				PageToken: pageToken,
+			})
+			if listCommentsErr != nil {
+				log.Printf("Error happened while listing comments: %v", listCommentsErr)
+				return
+			}
+			for _, comment := range listCommentsResp.GetComments() {
+				log.Printf("Got comment: %v", comment)
+			}
+			if pageToken = listCommentsResp.GetNextPageToken(); pageToken == "" {
+				return
+			}
+		}
+	}
+	listComments()
+
+	//
+	// ListBlogRevisions
+	//
+	log.Println("Listing the blog revisions")
+
+	revisionsResp, revisionsErr := c.ListBlogRevisions(ctx, &blogpb.ListBlogRevisionsRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+	if revisionsErr != nil {
+		log.Printf("Error happened while listing revisions: %v", revisionsErr)
+	}
+	for _, revision := range revisionsResp.GetRevisions() {
+		log.Printf("Blog revision: %v", revision)
+	}
+
+	//
+	// RestoreBlogRevision
+	//
+	log.Println("Restoring the blog as it was created")
+
+	restoreResp, restoreErr := c.RestoreBlogRevision(ctx, &blogpb.RestoreBlogRevisionRequest{
+		BlogId:          createBlogResponse.GetBlog().GetId(),
+		Version:         createBlogResponse.GetBlog().GetVersion(),
+		ExpectedVersion: tagResp.GetBlog().GetVersion(),
+	})
+	if restoreErr != nil {
+		log.Printf("Error happened while restoring: %v", restoreErr)
+	}
+	log.Printf("blog was restored: %v", restoreResp)
+
 	//
 	// DeleteBlog
 	//
 	log.Println("Deleting the blog")
 
 	// Incorrect UUID
-	_, errDel := c.DeleteBlog(context.Background(), &blogpb.DeleteBlogRequest{BlogId: "BOGUS"})
+	_, errDel := c.DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: "BOGUS"})
 	if errDel != nil {
 		log.Printf("Yo, failed to delete blog: %v", errDel)
 	}
 
 	// non-existing blog
-	_, errDel2 := c.DeleteBlog(context.Background(), &blogpb.DeleteBlogRequest{BlogId: "8494585d-5638-4ce7-b545-5974f4cdd5b0"})
+	_, errDel2 := c.DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: "8494585d-5638-4ce7-b545-5974f4cdd5b0"})
 	if errDel2 != nil {
 		log.Printf("Yo, failed to delete blog: %v", errDel2)
 	}
 
+	// Somebody else's blog should throw a PermissionDenied error
+	if jwtKeyFile != "" {
+		token, err := auth.NewToken(jwtKeyFile, "NotMilos", time.Hour, "author")
+		if err != nil {
+			log.Fatalf("Could not sign a JWT: %v", err)
+		}
+		otherCC, err := grpc.Dial("localhost:50051", transport, grpc.WithPerRPCCredentials(auth.TokenCredentials(token)))
+		if err != nil {
+			log.Fatalf("Could not connect: %v", err)
+		}
+		_, errDelOther := blogpb.NewBlogServiceClient(otherCC).DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+		if errDelOther != nil {
+			log.Printf("Yo, failed to delete blog: %v", errDelOther)
+		}
+		otherCC.Close()
+	}
+
 	// Properly delete
-	respDel, errDel3 := c.DeleteBlog(context.Background(), &blogpb.DeleteBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+	respDel, errDel3 := c.DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
 	if errDel3 != nil {
 		log.Printf("Yo, failed to delete blog: %v", errDel3)
 	}
 	log.Printf("Successfully deleted blog: %v", respDel)
 
+	// Comments go along with the blog (NotFound)
+	listComments()
+
+	//
+	// UndeleteBlog
+	//
+	log.Println("Undeleting the blog")
+
+	// Deleted blogs are hidden, unless asked for
+	deletedResp, deletedErr := c.ReadBlog(ctx, &blogpb.ReadBlogRequest{
+		BlogId:      createBlogResponse.GetBlog().GetId(),
+		ShowDeleted: true,
+	})
+	if deletedErr != nil {
+		log.Printf("Error happened while trying to read the blog: %v", deletedErr)
+	}
+	log.Printf("Got a deleted blog from the server: %v", deletedResp)
+
+	respUndel, errUndel := c.UndeleteBlog(ctx, &blogpb.UndeleteBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+	if errUndel != nil {
+		log.Printf("Yo, failed to undelete blog: %v", errUndel)
+	}
+	log.Printf("Successfully undeleted blog: %v", respUndel)
+
+	// ...and come back with it
+	listComments()
+
+	// Delete it again, so it doesn't show up in the listings below
+	_, errDel4 := c.DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: createBlogResponse.GetBlog().GetId()})
+	if errDel4 != nil {
+		log.Printf("Yo, failed to delete blog: %v", errDel4)
+	}
+
+	//
+	// BatchCreateBlogs, BatchGetBlogs, BatchDeleteBlogs
+	//
+	log.Println("Batch creating blogs")
+
+	batchCreateResp, batchCreateErr := c.BatchCreateBlogs(ctx, &blogpb.BatchCreateBlogsRequest{
+		Blogs: []*blogpb.Blog{
+			{AuthorId: "Milos", Title: "Batch blog 1", Content: "Batch content 1"},
+			{AuthorId: "Milos", Title: "Batch blog 2", Content: "Batch content 2"},
+			{AuthorId: "Milos", Title: "Batch blog 3", Content: "Batch content 3"},
+		},
+	})
+	if batchCreateErr != nil {
+		log.Printf("Yo, failed to batch create blogs: %v", batchCreateErr)
+	}
+	var batchIDs []string
+	for _, result := range batchCreateResp.GetResults() {
+		log.Printf("Batch create result: %v", result)
+		batchIDs = append(batchIDs, result.GetBlog().GetId())
+	}
+
+	// Every item gets its own result. The bogus one fails on its own
+	batchGetResp, batchGetErr := c.BatchGetBlogs(ctx, &blogpb.BatchGetBlogsRequest{
+		BlogIds: append(batchIDs, "8494585d-5638-4ce7-b545-5974f4cdd5b0"),
+	})
+	if batchGetErr != nil {
+		log.Printf("Yo, failed to batch get blogs: %v", batchGetErr)
+	}
+	for _, result := range batchGetResp.GetResults() {
+		log.Printf("Batch get result: %v", result)
+	}
+
+	batchDeleteResp, batchDeleteErr := c.BatchDeleteBlogs(ctx, &blogpb.BatchDeleteBlogsRequest{BlogIds: batchIDs})
+	if batchDeleteErr != nil {
+		log.Printf("Yo, failed to batch delete blogs: %v", batchDeleteErr)
+	}
+	for _, result := range batchDeleteResp.GetResults() {
+		log.Printf("Batch delete result: %v", result)
+	}
+
+	//
+	// ImportBlogs
+	//
+	log.Println("Importing blogs")
+
+	importStream, err := c.ImportBlogs(ctx)
+	if err != nil {
+		log.Fatalf("Issue opening ImportBlogs gRPC: %v", err)
+	}
+	imports := []*blogpb.ImportBlogRequest{
+		{SourceId: "old-1", Blog: &blogpb.Blog{AuthorId: "Milos", Title: "Imported blog 1", Content: "Imported content 1", Tags: []string{"imported", "go"}}},
+		{SourceId: "old-2", Blog: &blogpb.Blog{AuthorId: "Milos", Title: "Imported blog 2", Content: "Imported content 2", Tags: []string{"imported"}}},
+		{SourceId: "old-2", Blog: &blogpb.Blog{AuthorId: "Milos", Title: "Imported blog 2", Content: "Imported content 2"}}, // Skipped, repeated
+		{SourceId: "old-3", Blog: &blogpb.Blog{AuthorId: "Milos"}},                                                          // Skipped, empty
+	}
+	for _, req := range imports {
+		log.Printf("Sending: %v", req)
+		importStream.Send(req)
+	}
+	importSummary, err := importStream.CloseAndRecv()
+	if err != nil {
+		log.Printf("Failed to Close/Recieve: %v", err)
+	}
+	log.Printf("Import summary: %v", importSummary)
+
+	//
+	// PublishBlog, ArchiveBlog
+	//
+	log.Println("Publishing the imported blogs")
+
+	// New blogs are drafts. ListBlog only shows published blogs, unless asked for other states
+	respDrafts, errDrafts := c.ListBlog(ctx, &blogpb.ListBlogRequest{
+		Tag:    "imported",
+		States: []blogpb.Blog_State{blogpb.Blog_DRAFT},
+	})
+	if errDrafts != nil {
+		log.Fatalf("Failed to recieve blogs: %v", errDrafts)
+	}
+	var draftIDs []string
+	for {
+		res, err := respDrafts.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Issue while getting messages via gRPC: %v", err)
+		}
+		draftIDs = append(draftIDs, res.GetBlog().GetId())
+	}
+	for _, draftID := range draftIDs {
+		publishResp, publishErr := c.PublishBlog(ctx, &blogpb.PublishBlogRequest{BlogId: draftID})
+		if publishErr != nil {
+			log.Printf("Error happened while publishing: %v", publishErr)
+			continue
+		}
+		log.Printf("Blog was published: %v", publishResp)
+	}
+
+	if len(draftIDs) > 0 {
+		// Archive one and bring it back. Archiving it twice should throw a FailedPrecondition error
+		for i := 0; i < 2; i++ {
+			archiveResp, archiveErr := c.ArchiveBlog(ctx, &blogpb.ArchiveBlogRequest{BlogId: draftIDs[0]})
+			if archiveErr != nil {
+				log.Printf("Error happened while archiving: %v", archiveErr)
+				continue
+			}
+			log.Printf("Blog was archived: %v", archiveResp)
+		}
+		if _, publishErr := c.PublishBlog(ctx, &blogpb.PublishBlogRequest{BlogId: draftIDs[0]}); publishErr != nil {
+			log.Printf("Error happened while publishing: %v", publishErr)
+		}
+	}
+
+	// Scheduled publishing. The server publishes it on its own, the first time it checks after publish_time.
+	// That is once a minute by default (BLOGPUBLISHINTERVAL), so it is most likely still a draft while we look
+	publishTime, _ := ptypes.TimestampProto(time.Now().Add(2 * time.Second))
+	scheduledResp, scheduledErr := c.CreateBlog(ctx, &blogpb.CreateBlogRequest{
+		Blog: &blogpb.Blog{AuthorId: "Milos", Title: "Scheduled blog", Content: "Scheduled content", PublishTime: publishTime},
+	})
+	if scheduledErr != nil {
+		log.Printf("Error happened while scheduling: %v", scheduledErr)
+	}
+	log.Printf("Blog was scheduled: %v", scheduledResp)
+
 	//
 	// ListBlog
 	//
 	log.Println("Listing the blog")
 
-	respList, errList := c.ListBlog(context.Background(), &blogpb.ListBlogRequest{})
+	respList, errList := c.ListBlog(ctx, &blogpb.ListBlogRequest{})
 	if errList != nil {
 		log.Fatalf("Failed to recieve blogs: %v", errList)
 	}
@@ -120,4 +467,201 @@ func main() {
 		}
 		log.Printf("Got blog: %v", res.GetBlog())
 	}
+
+	//
+	// ListBlog, one page at a time
+	//
+	log.Println("Listing the blog, two blogs per page")
+
+	pageToken := ""
+	for {
+		respPage, errPage := c.ListBlog(ctx, &blogpb.ListBlogRequest{PageSize: 2, PageToken: pageToken})
+		if errPage != nil {
+			log.Fatalf("Failed to recieve blogs: %v", errPage)
+		}
+		pageToken = ""
+		for {
+			res, err := respPage.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				log.Fatalf("Issue while getting messages via gRPC: %v", err)
+			}
+			log.Printf("Got blog: %v", res.GetBlog())
+			pageToken = res.GetNextPageToken() // Only the last blog of a page carries it
+		}
+		if pageToken == "" {
+			break
+		}
+		log.Printf("Fetching next page with token: %v", pageToken)
+	}
+
+	//
+	// ListBlog, filtered by author
+	//
+	log.Printf("Listing blogs by author: %v", author)
+
+	respAuthor, errAuthor := c.ListBlog(ctx, &blogpb.ListBlogRequest{AuthorId: author})
+	if errAuthor != nil {
+		log.Fatalf("Failed to recieve blogs: %v", errAuthor)
+	}
+	for {
+		res, err := respAuthor.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Issue while getting messages via gRPC: %v", err)
+		}
+		log.Printf("Got blog: %v", res.GetBlog())
+	}
+
+	//
+	// ListBlog, newest first
+	//
+	log.Println("Listing the blog, most recently updated first")
+
+	respNewest, errNewest := c.ListBlog(ctx, &blogpb.ListBlogRequest{
+		OrderBy:    blogpb.ListBlogRequest_UPDATE_TIME,
+		Descending: true,
+	})
+	if errNewest != nil {
+		log.Fatalf("Failed to recieve blogs: %v", errNewest)
+	}
+	for {
+		res, err := respNewest.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Issue while getting messages via gRPC: %v", err)
+		}
+		log.Printf("Got blog: %v", res.GetBlog())
+	}
+
+	//
+	// ListBlog, filtered by tag
+	//
+	log.Println("Listing blogs tagged: imported")
+
+	respTag, errTag := c.ListBlog(ctx, &blogpb.ListBlogRequest{Tag: "imported"})
+	if errTag != nil {
+		log.Fatalf("Failed to recieve blogs: %v", errTag)
+	}
+	for {
+		res, err := respTag.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Issue while getting messages via gRPC: %v", err)
+		}
+		log.Printf("Got blog: %v", res.GetBlog())
+	}
+
+	//
+	// ListTags
+	//
+	respTags, errTags := c.ListTags(ctx, &blogpb.ListTagsRequest{})
+	if errTags != nil {
+		log.Fatalf("Failed to list tags: %v", errTags)
+	}
+	for _, tag := range respTags.GetTags() {
+		log.Printf("Tag %q is on %v blogs", tag.GetTag(), tag.GetCount())
+	}
+
+	//
+	// SearchBlogs, two hits per page
+	//
+	log.Println("Searching blogs for: imported content")
+
+	searchToken := ""
+	for {
+		respSearch, errSearch := c.SearchBlogs(ctx, &blogpb.SearchBlogsRequest{
+			Query:     "imported content",
+			PageSize:  2,
+			PageToken: searchToken,
+		})
+		if errSearch != nil {
+			log.Fatalf("Failed to search blogs: %v", errSearch)
+		}
+		for _, hit := range respSearch.GetHits() {
+			log.Printf("Got hit (score %.3f): %v | %v", hit.GetScore(), hit.GetTitleHighlight(), hit.GetSnippet())
+		}
+		searchToken = respSearch.GetNextPageToken()
+		if searchToken == "" {
+			log.Printf("Found %v blogs in total", respSearch.GetTotalHits())
+			break
+		}
+	}
+
+	//
+	// WatchBlogs
+	//
+	log.Printf("Watching blogs by author: %v", author)
+
+	watchStream, err := c.WatchBlogs(ctx)
+	if err != nil {
+		log.Fatalf("Error starting BiDi gRPC: %v", err)
+	}
+	watchStream.Send(&blogpb.WatchBlogsRequest{AuthorId: author})
+	started, err := watchStream.Recv() // No event, just says the watch is in place
+	if err != nil {
+		log.Fatalf("Error while watching blogs: %v", err)
+	}
+	log.Printf("Watch started at: %v", started.GetStartToken())
+
+	// Create, publish, update and delete a blog. Watchers only see published blogs, so that's three events
+	waitc := make(chan struct{})
+	var firstToken string
+	go func() {
+		for i := 0; i < 3; i++ {
+			res, err := watchStream.Recv()
+			if err != nil {
+				log.Printf("Error while watching blogs: %v", err)
+				break
+			}
+			log.Printf("Got blog event: %v", res.GetEvent())
+			if i == 0 {
+				firstToken = res.GetEvent().GetSequenceToken()
+			}
+		}
+		close(waitc)
+	}()
+
+	watched, err := c.CreateBlog(ctx, &blogpb.CreateBlogRequest{Blog: &blogpb.Blog{AuthorId: "Milos", Title: "Watched blog", Content: "Watched content"}})
+	if err != nil {
+		log.Fatalf("Unexpected error: %v", err)
+	}
+	watchedID := watched.GetBlog().GetId()
+	c.PublishBlog(ctx, &blogpb.PublishBlogRequest{BlogId: watchedID})
+	c.UpdateBlog(ctx, &blogpb.UpdateBlogRequest{
+		Blog:       &blogpb.Blog{Id: watchedID, Title: "Watched blog, renamed"},
+		UpdateMask: &field_mask.FieldMask{Paths: []string{"title"}},
+	})
+	c.DeleteBlog(ctx, &blogpb.DeleteBlogRequest{BlogId: watchedID})
+	<-waitc
+	watchStream.CloseSend()
+
+	// Reconnect, picking up after the first event. The update and delete come again
+	log.Println("Resuming the watch after the first event")
+
+	resumeStream, err := c.WatchBlogs(ctx)
+	if err != nil {
+		log.Fatalf("Error starting BiDi gRPC: %v", err)
+	}
+	resumeStream.Send(&blogpb.WatchBlogsRequest{AuthorId: author, ResumeToken: firstToken})
+	for i := 0; i < 3; i++ { // Starts with the no event response
+
+		res, err := resumeStream.Recv()
+		if err != nil {
+			log.Printf("Error while watching blogs: %v", err)
+			break
+		}
+		if res.GetEvent() != nil {
+			log.Printf("Got blog event: %v", res.GetEvent())
+		}
+	}
+	resumeStream.CloseSend()
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/golang/protobuf/ptypes"
+	uuid "github.com/satori/go.uuid"
+)
+
+var defaultCommentPageSize = 20 // Comments ListComments returns when the client doesn't say
+
+var maxCommentPageSize = 100
+
+type commentServer struct {
+	blogs    BlogStore // Comments can only go on blogs that exist and aren't deleted
+	comments CommentStore
+
+	authenticate bool // Comments belong to whoever wrote them, see caller. Set along with config.JWTKeyFile
+}
+
+func (s *commentServer) CreateComment(ctx context.Context, req *blogpb.CreateCommentRequest) (*blogpb.CreateCommentResponse, error) {
+	log.Printf("Started 'CreateComment' func with the following input: %v", req)
+
+	comment := req.GetComment()
+	if comment == nil {
+		comment = &blogpb.Comment{}
+	}
+	if err := s.checkBlog(ctx, comment.GetBlogId()); err != nil {
+		return nil, err
+	}
+	if err := checkCommentContent(comment.GetContent()); err != nil {
+		return nil, err
+	}
+	author, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if author != "" {
+		comment.AuthorId = author
+	}
+	comment.Id = uuid.NewV4().String()
+	comment.CreateTime = ptypes.TimestampNow()
+	comment.UpdateTime = comment.GetCreateTime()
+	comment.DeleteTime = nil
+	comment.ExpireTime = nil
+
+	if err := s.comments.Create(ctx, comment); err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not store Comment: %v", err),
+		)
+	}
+
+	log.Printf("Finished 'CreateComment'. Returning (wrapped in a response struct): %v", comment)
+	return &blogpb.CreateCommentResponse{
+		Comment: comment,
+	}, nil
+}
+
+func (s *commentServer) ListComments(ctx context.Context, req *blogpb.ListCommentsRequest) (*blogpb.ListCommentsResponse, error) {
+	log.Printf("Started 'ListComments' func with the following input: %v", req)
+
+	if err := s.checkBlog(ctx, req.GetBlogId()); err != nil {
+		return nil, err
+	}
+
+	pageSize := int(req.GetPageSize())
+	if pageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Page size can't be negative: %v", req.GetPageSize()),
+		)
+	}
+	if pageSize == 0 {
+		pageSize = defaultCommentPageSize
+	}
+	if pageSize > maxCommentPageSize {
+		pageSize = maxCommentPageSize
+	}
+
+	comments, nextPageToken, err := s.comments.List(ctx, req.GetBlogId(), pageSize, req.GetPageToken())
+	if err == errInvalidPageToken {
+		return nil, status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Could not list Comments: %v", err),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not list Comments: %v", err),
+		)
+	}
+
+	log.Printf("Finished 'ListComments'. Returning %v comments", len(comments))
+	return &blogpb.ListCommentsResponse{
+		Comments:      comments,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (s *commentServer) UpdateComment(ctx context.Context, req *blogpb.UpdateCommentRequest) (*blogpb.UpdateCommentResponse, error) {
+	log.Printf("Started 'UpdateComment' func with the following input: %v", req)
+
+	comment := req.GetComment()
+	if err := s.checkBlog(ctx, comment.GetBlogId()); err != nil {
+		return nil, err
+	}
+	if err := checkCommentID(comment.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, comment.GetBlogId(), comment.GetId()); err != nil {
+		return nil, err
+	}
+	if err := checkCommentContent(comment.GetContent()); err != nil {
+		return nil, err
+	}
+	comment.UpdateTime = ptypes.TimestampNow() // Server managed. Whatever the client sent is ignored
+
+	comment, err := s.comments.Update(ctx, comment)
+	if err == errCommentNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Comment for key: %v", req.GetComment().GetId()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not update Comment: %v", err),
+		)
+	}
+
+	log.Printf("Finished 'UpdateComment'. Returning (wrapped in a response struct): %v", comment)
+	return &blogpb.UpdateCommentResponse{
+		Comment: comment,
+	}, nil
+}
+
+func (s *commentServer) DeleteComment(ctx context.Context, req *blogpb.DeleteCommentRequest) (*blogpb.DeleteCommentResponse, error) {
+	log.Printf("Started 'DeleteComment' func with the following input: %v", req)
+
+	if err := s.checkBlog(ctx, req.GetBlogId()); err != nil {
+		return nil, err
+	}
+	if err := checkCommentID(req.GetCommentId()); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, req.GetBlogId(), req.GetCommentId()); err != nil {
+		return nil, err
+	}
+
+	err := s.comments.Delete(ctx, req.GetBlogId(), req.GetCommentId())
+	if err == errCommentNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Comment for key: %v", req.GetCommentId()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not delete Comment: %v", err),
+		)
+	}
+
+	log.Printf("Finished 'DeleteComment'. Returning: %v", req.GetCommentId())
+	return &blogpb.DeleteCommentResponse{
+		CommentId: req.GetCommentId(),
+	}, nil
+}
+
+// checkBlog returns a NotFound gRPC error unless the blog exists and isn't deleted.
+// Comments on deleted blogs are hidden along with the blog, even if deleting them didn't go through.
+func (s *commentServer) checkBlog(ctx context.Context, blogID string) error {
+	if err := checkBlogID(blogID); err != nil {
+		return err
+	}
+	blog, err := s.blogs.Read(ctx, blogID)
+	if err == errBlogNotFound || (err == nil && isDeleted(blog)) {
+		return status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
+		)
+	}
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not read Blog: %v", err),
+		)
+	}
+	return nil
+}
+
+// caller returns the subject of the caller's bearer token, which CreateComment stamps on comments as their author_id.
+// Returns an Unauthenticated gRPC error if the server authenticates but there's no token. See server.caller
+// for servers that don't
+func (s *commentServer) caller(ctx context.Context) (string, error) {
+	if !s.authenticate {
+		return peerAuthor(ctx), nil
+	}
+	subject, ok := auth.Subject(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "Commenting requires a bearer token")
+	}
+	return subject, nil
+}
+
+// checkAuthor returns a PermissionDenied gRPC error unless the caller wrote the comment, see server.checkAuthor.
+// A comment that doesn't exist passes, so whatever comes next reports NotFound like it would without authentication
+func (s *commentServer) checkAuthor(ctx context.Context, blogID, commentID string) error {
+	author, err := s.caller(ctx)
+	if err != nil || author == "" {
+		return err
+	}
+	comment, err := s.comments.Read(ctx, blogID, commentID)
+	if err == errCommentNotFound {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not read Comment: %v", err),
+		)
+	}
+	if comment.GetAuthorId() != author {
+		return status.Errorf(
+			codes.PermissionDenied,
+			fmt.Sprintf("Comment %v belongs to %v, not %v", commentID, comment.GetAuthorId(), author),
+		)
+	}
+	return nil
+}
+
+// checkCommentID returns an InvalidArgument gRPC error if a comment ID isn't a UUID, see checkBlogID
+func checkCommentID(commentID string) error {
+	if _, uuidErr := uuid.FromString(commentID); uuidErr != nil {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Comment ID Provided does not match UUIDv4 format: %v", uuidErr),
+		)
+	}
+	return nil
+}
+
+// checkCommentContent returns an InvalidArgument gRPC error for a comment with nothing in it
+func checkCommentContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return status.Errorf(codes.InvalidArgument, "Comment has no content")
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/Kaurin/gRPC/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// as returns a context for a caller with a bearer token for subject
+func as(subject string) context.Context {
+	return auth.NewContext(context.Background(), &auth.Identity{Subject: subject})
+}
+
+func TestCommentsBelongToTheirAuthor(t *testing.T) {
+	blogs := newMemoryStore()
+	blog := testBlog(t, blogs, "commented")
+	s := &commentServer{blogs: blogs, comments: newMemoryCommentStore(), authenticate: true}
+
+	created, err := s.CreateComment(as("Ana"), &blogpb.CreateCommentRequest{
+		Comment: &blogpb.Comment{BlogId: blog.GetId(), AuthorId: "Milos", Content: "First!"},
+	})
+	if err != nil {
+		t.Fatalf("CreateComment: %v", err)
+	}
+	comment := created.GetComment()
+	if comment.GetAuthorId() != "Ana" {
+		t.Errorf("CreateComment author_id = %q, want the caller's %q", comment.GetAuthorId(), "Ana")
+	}
+	if _, err := s.CreateComment(context.Background(), &blogpb.CreateCommentRequest{
+		Comment: &blogpb.Comment{BlogId: blog.GetId(), Content: "Anonymous"},
+	}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("CreateComment without a token error = %v, want Unauthenticated", err)
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantCode codes.Code
+	}{
+		{name: "somebody else", ctx: as("Milos"), wantCode: codes.PermissionDenied},
+		{name: "no token", ctx: context.Background(), wantCode: codes.Unauthenticated},
+		{name: "the author", ctx: as("Ana"), wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			update := &blogpb.Comment{BlogId: blog.GetId(), Id: comment.GetId(), Content: "Edited by " + tt.name}
+			if _, err := s.UpdateComment(tt.ctx, &blogpb.UpdateCommentRequest{Comment: update}); status.Code(err) != tt.wantCode {
+				t.Errorf("UpdateComment error = %v, want %v", err, tt.wantCode)
+			}
+			if tt.wantCode == codes.OK {
+				return // Leave the comment for the next case
+			}
+			if _, err := s.DeleteComment(tt.ctx, &blogpb.DeleteCommentRequest{BlogId: blog.GetId(), CommentId: comment.GetId()}); status.Code(err) != tt.wantCode {
+				t.Errorf("DeleteComment error = %v, want %v", err, tt.wantCode)
+			}
+		})
+	}
+
+	if _, err := s.DeleteComment(as("Ana"), &blogpb.DeleteCommentRequest{BlogId: blog.GetId(), CommentId: comment.GetId()}); err != nil {
+		t.Errorf("DeleteComment by the author: %v", err)
+	}
+	// Gone now, for everyone
+	if _, err := s.DeleteComment(as("Milos"), &blogpb.DeleteCommentRequest{BlogId: blog.GetId(), CommentId: comment.GetId()}); status.Code(err) != codes.NotFound {
+		t.Errorf("DeleteComment of a deleted comment error = %v, want NotFound", err)
+	}
+}
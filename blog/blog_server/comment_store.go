@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// errCommentNotFound is returned by a CommentStore when the requested comment does not exist, or its blog is deleted
+var errCommentNotFound = errors.New("comment not found")
+
+// CommentStore is the storage backend behind the CommentService server.
+// Comments are kept per blog. Implementations must be safe for concurrent use by multiple gRPC handlers.
+type CommentStore interface {
+	// Create stores a new comment. The comment ID and timestamps are assigned by the caller.
+	Create(ctx context.Context, comment *blogpb.Comment) error
+
+	// Read returns the comment with the given blog ID and ID, or errCommentNotFound.
+	Read(ctx context.Context, blogID, commentID string) (*blogpb.Comment, error)
+
+	// Update writes the content and update_time (stamped by the caller) of comment to the stored comment
+	// with the same blog ID and ID. Returns the full updated comment, or errCommentNotFound.
+	Update(ctx context.Context, comment *blogpb.Comment) (*blogpb.Comment, error)
+
+	// Delete removes a comment for good, or returns errCommentNotFound.
+	Delete(ctx context.Context, blogID, commentID string) error
+
+	// List returns up to pageSize (0 for no limit) comments on a blog, oldest first, starting after pageToken.
+	// Also returns a token for the next page, or "" if there are no more comments.
+	List(ctx context.Context, blogID string, pageSize int, pageToken string) ([]*blogpb.Comment, string, error)
+
+	// DeleteForBlog soft deletes every comment on a deleted blog, copying over the blog's delete_time and expire_time,
+	// so they get purged along with it.
+	DeleteForBlog(ctx context.Context, blog *blogpb.Blog) error
+
+	// UndeleteForBlog brings back every comment DeleteForBlog deleted on an undeleted blog.
+	UndeleteForBlog(ctx context.Context, blogID string) error
+}
+
+// isCommentDeleted reports whether a comment was deleted along with its blog
+func isCommentDeleted(comment *blogpb.Comment) bool {
+	return comment.GetDeleteTime() != nil
+}
+
+// isCommentExpired reports whether a deleted comment is past its expire_time and can be purged, see isExpired
+func isCommentExpired(comment *blogpb.Comment, now time.Time) bool {
+	expireTime := comment.GetExpireTime()
+	if !isCommentDeleted(comment) || expireTime == nil {
+		return false
+	}
+	return expireTime.GetSeconds() <= now.Unix()
+}
+
+// markCommentDeleted stamps a comment with its deleted blog's delete_time and expire_time
+func markCommentDeleted(comment *blogpb.Comment, blog *blogpb.Blog) {
+	comment.DeleteTime = blog.GetDeleteTime()
+	comment.ExpireTime = blog.GetExpireTime()
+}
+
+// listComments implements CommentStore.List for backends that load all of a blog's comments into memory.
+// Deleted comments are dropped. The page token is the sort key of the last comment on the previous page.
+func listComments(comments []*blogpb.Comment, pageSize int, pageToken string) ([]*blogpb.Comment, string, error) {
+	key, err := decodePageToken(pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	filtered := comments[:0]
+	for _, comment := range comments {
+		if !isCommentDeleted(comment) {
+			filtered = append(filtered, comment)
+		}
+	}
+	comments = filtered
+
+	// Oldest first. The comment ID breaks ties, so the order is the same on every call
+	sortKey := func(comment *blogpb.Comment) string {
+		return timestampKey(comment.GetCreateTime()) + comment.GetId()
+	}
+	sort.Slice(comments, func(i, j int) bool { return sortKey(comments[i]) < sortKey(comments[j]) })
+
+	if after := key["after"]; after != "" {
+		start := sort.Search(len(comments), func(i int) bool { return sortKey(comments[i]) > after })
+		comments = comments[start:]
+	}
+
+	nextPageToken := ""
+	if pageSize > 0 && len(comments) > pageSize {
+		comments = comments[:pageSize]
+		nextPageToken = encodePageToken(map[string]string{"after": sortKey(comments[len(comments)-1])})
+	}
+	return comments, nextPageToken, nil
+}
+
+// cloneComment deep-copies a comment so callers can't mutate what's stored
+func cloneComment(comment *blogpb.Comment) *blogpb.Comment {
+	return proto.Clone(comment).(*blogpb.Comment)
+}
+
+// cascadingStore is a BlogStore that deletes and undeletes the comments on a blog along with it.
+// The comments follow after the blog change went through. If they can't, it's logged and the blog change stands:
+// comments on a deleted blog are never served anyway, they just don't get purged.
+type cascadingStore struct {
+	BlogStore
+	comments CommentStore
+}
+
+func (s *cascadingStore) Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error {
+	if err := s.BlogStore.Delete(ctx, blog, expectedVersion); err != nil {
+		return err
+	}
+	s.deleteComments(ctx, blog)
+	return nil
+}
+
+func (s *cascadingStore) Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	blog, err := s.BlogStore.Undelete(ctx, blogID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.comments.UndeleteForBlog(ctx, blogID); err != nil {
+		log.Printf("Could not undelete the comments on blog %v: %v", blogID, err)
+	}
+	return blog, nil
+}
+
+func (s *cascadingStore) BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := s.BlogStore.BatchDelete(ctx, blogs)
+	for i, blog := range blogs {
+		if errs[i] == nil {
+			s.deleteComments(ctx, blog)
+		}
+	}
+	return errs
+}
+
+func (s *cascadingStore) deleteComments(ctx context.Context, blog *blogpb.Blog) {
+	if err := s.comments.DeleteForBlog(ctx, blog); err != nil {
+		log.Printf("Could not delete the comments on blog %v: %v", blog.GetId(), err)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Name of the bolt bucket holding comments. It has a nested bucket per blog ID, keyed on comment ID
+var commentBucket = []byte("comments")
+
+// boltCommentStore is a CommentStore that keeps comments in the same bbolt file as boltStore
+type boltCommentStore struct {
+	db *bolt.DB
+}
+
+// newBoltCommentStore uses a bolt file opened by newBoltStore. Closing it is up to the boltStore
+func newBoltCommentStore(db *bolt.DB) (*boltCommentStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(commentBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create bolt bucket: %v", err)
+	}
+	return &boltCommentStore{db: db}, nil
+}
+
+func (s *boltCommentStore) Create(ctx context.Context, comment *blogpb.Comment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(commentBucket).CreateBucketIfNotExists([]byte(comment.GetBlogId()))
+		if err != nil {
+			return err
+		}
+		return putComment(b, comment)
+	})
+}
+
+func (s *boltCommentStore) Read(ctx context.Context, blogID, commentID string) (*blogpb.Comment, error) {
+	var stored *blogpb.Comment
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commentBucket).Bucket([]byte(blogID))
+		if b == nil {
+			return errCommentNotFound
+		}
+		var err error
+		stored, err = getComment(b, commentID)
+		if err != nil {
+			return err
+		}
+		if isCommentDeleted(stored) {
+			return errCommentNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltCommentStore) Update(ctx context.Context, comment *blogpb.Comment) (*blogpb.Comment, error) {
+	var stored *blogpb.Comment
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commentBucket).Bucket([]byte(comment.GetBlogId()))
+		if b == nil {
+			return errCommentNotFound
+		}
+		var err error
+		stored, err = getComment(b, comment.GetId())
+		if err != nil {
+			return err
+		}
+		if isCommentDeleted(stored) {
+			return errCommentNotFound
+		}
+		stored.Content = comment.GetContent()
+		stored.UpdateTime = comment.GetUpdateTime()
+		return putComment(b, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltCommentStore) Delete(ctx context.Context, blogID, commentID string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commentBucket).Bucket([]byte(blogID))
+		if b == nil {
+			return errCommentNotFound
+		}
+		stored, err := getComment(b, commentID)
+		if err != nil {
+			return err
+		}
+		if isCommentDeleted(stored) {
+			return errCommentNotFound
+		}
+		return b.Delete([]byte(commentID))
+	})
+}
+
+func (s *boltCommentStore) List(ctx context.Context, blogID string, pageSize int, pageToken string) ([]*blogpb.Comment, string, error) {
+	now := time.Now()
+	var comments []*blogpb.Comment
+	expired := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commentBucket).Bucket([]byte(blogID))
+		if b == nil { // Never commented on
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			comment := &blogpb.Comment{}
+			if err := proto.Unmarshal(v, comment); err != nil {
+				return fmt.Errorf("failed to unmarshal comment %s: %v", k, err)
+			}
+			if isCommentExpired(comment, now) {
+				expired = true
+				return nil
+			}
+			comments = append(comments, comment)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Comments expire along with their blog, all at once. boltStore.purge drops the blog, we drop the comments
+	if expired {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(commentBucket).DeleteBucket([]byte(blogID))
+		})
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return nil, "", fmt.Errorf("failed to purge expired comments: %v", err)
+		}
+		return nil, "", nil
+	}
+	return listComments(comments, pageSize, pageToken)
+}
+
+func (s *boltCommentStore) DeleteForBlog(ctx context.Context, blog *blogpb.Blog) error {
+	return s.updateAll(blog.GetId(), func(comment *blogpb.Comment) {
+		markCommentDeleted(comment, blog)
+	})
+}
+
+func (s *boltCommentStore) UndeleteForBlog(ctx context.Context, blogID string) error {
+	return s.updateAll(blogID, func(comment *blogpb.Comment) {
+		comment.DeleteTime = nil
+		comment.ExpireTime = nil
+	})
+}
+
+// updateAll applies fn to every comment on a blog, in one transaction
+func (s *boltCommentStore) updateAll(blogID string, fn func(*blogpb.Comment)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(commentBucket).Bucket([]byte(blogID))
+		if b == nil {
+			return nil
+		}
+		// Collect first. Bolt doesn't allow writing to a bucket in the middle of ForEach
+		var comments []*blogpb.Comment
+		err := b.ForEach(func(k, v []byte) error {
+			comment := &blogpb.Comment{}
+			if err := proto.Unmarshal(v, comment); err != nil {
+				return fmt.Errorf("failed to unmarshal comment %s: %v", k, err)
+			}
+			comments = append(comments, comment)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, comment := range comments {
+			fn(comment)
+			if err := putComment(b, comment); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// getComment decodes a single comment from a blog's comment bucket, or returns errCommentNotFound
+func getComment(b *bolt.Bucket, commentID string) (*blogpb.Comment, error) {
+	v := b.Get([]byte(commentID))
+	if v == nil {
+		return nil, errCommentNotFound
+	}
+	comment := &blogpb.Comment{}
+	if err := proto.Unmarshal(v, comment); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal comment %s: %v", commentID, err)
+	}
+	return comment, nil
+}
+
+// putComment encodes a comment and writes it to a blog's comment bucket under its ID
+func putComment(b *bolt.Bucket, comment *blogpb.Comment) error {
+	v, err := proto.Marshal(comment)
+	if err != nil {
+		return fmt.Errorf("failed to marshal comment: %v", err)
+	}
+	return b.Put([]byte(comment.GetId()), v)
+}
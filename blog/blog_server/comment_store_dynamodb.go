@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+)
+
+// dynamoCommentStore is a CommentStore backed by a DynamoDB table, keyed on "blog_id" and comment "id"
+type dynamoCommentStore struct {
+	client *dynamodb.Client
+	table  string
+}
+
+func newDynamoCommentStore(client *dynamodb.Client, table string) *dynamoCommentStore {
+	return &dynamoCommentStore{
+		client: client,
+		table:  table,
+	}
+}
+
+// createTable creates the comment table, keyed on "blog_id" with the comment "id" as sort key,
+// so all the comments on a blog can be queried at once.
+func (s *dynamoCommentStore) createTable(ctx context.Context) error {
+	ddbReq := s.client.CreateTableRequest(&dynamodb.CreateTableInput{
+		TableName: aws.String(s.table),
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			dynamodb.AttributeDefinition{
+				AttributeName: aws.String("blog_id"),
+				AttributeType: "S",
+			},
+			dynamodb.AttributeDefinition{
+				AttributeName: aws.String("id"),
+				AttributeType: "S",
+			},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String("blog_id"),
+				KeyType:       "HASH",
+			},
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String("id"),
+				KeyType:       "RANGE",
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+
+	_, err := ddbReq.Send(ctx)
+	return err
+}
+
+// checkTable reports whether the comment table is ready to use. For the health service
+func (s *dynamoCommentStore) checkTable(ctx context.Context) error {
+	return checkTable(ctx, s.client, s.table)
+}
+
+// enableTTL turns on DDB Time To Live, so comments get purged once their deleted blog expires
+func (s *dynamoCommentStore) enableTTL(ctx context.Context) error {
+	return enableTableTTL(ctx, s.client, s.table)
+}
+
+func (s *dynamoCommentStore) Create(ctx context.Context, comment *blogpb.Comment) error {
+	av, err := marshalComment(comment)
+	if err != nil {
+		return err
+	}
+
+	ddbReq := s.client.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	})
+	_, err = ddbReq.Send(ctx)
+	return err
+}
+
+func (s *dynamoCommentStore) Read(ctx context.Context, blogID, commentID string) (*blogpb.Comment, error) {
+	ddbReq := s.client.GetItemRequest(&dynamodb.GetItemInput{
+		Key:       s.key(blogID, commentID),
+		TableName: aws.String(s.table),
+	})
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	comment := &blogpb.Comment{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Item, comment); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	// GetItem returns an empty item if the key doesn't exist
+	if comment.GetId() == "" || isCommentDeleted(comment) {
+		return nil, errCommentNotFound
+	}
+	return comment, nil
+}
+
+func (s *dynamoCommentStore) Update(ctx context.Context, comment *blogpb.Comment) (*blogpb.Comment, error) {
+	updateTime, err := dynamodbattribute.Marshal(comment.GetUpdateTime())
+	if err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB marshal update time, %v", err)
+	}
+
+	ddbReq := s.client.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(delete_time)"), // Not on a deleted blog either
+		ExpressionAttributeNames: map[string]string{
+			"#content":     "content",
+			"#update_time": "update_time",
+		},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":content":     {S: aws.String(comment.GetContent())},
+			":update_time": *updateTime,
+		},
+		Key:              s.key(comment.GetBlogId(), comment.GetId()),
+		ReturnValues:     dynamodb.ReturnValueAllNew,
+		TableName:        aws.String(s.table),
+		UpdateExpression: aws.String("SET #content = :content, #update_time = :update_time"),
+	})
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, errCommentNotFound
+		}
+		return nil, err
+	}
+
+	updated := &blogpb.Comment{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Attributes, updated); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	return updated, nil
+}
+
+func (s *dynamoCommentStore) Delete(ctx context.Context, blogID, commentID string) error {
+	ddbReq := s.client.DeleteItemRequest(&dynamodb.DeleteItemInput{
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(delete_time)"),
+		Key:                 s.key(blogID, commentID),
+		TableName:           aws.String(s.table),
+	})
+	if _, err := ddbReq.Send(ctx); err != nil {
+		if isConditionalCheckFailed(err) {
+			return errCommentNotFound
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *dynamoCommentStore) List(ctx context.Context, blogID string, pageSize int, pageToken string) ([]*blogpb.Comment, string, error) {
+	// DDB only hands comments back in ID order. Load all of the blog's and sort them here instead
+	comments, err := s.query(ctx, blogID)
+	if err != nil {
+		return nil, "", err
+	}
+	return listComments(comments, pageSize, pageToken)
+}
+
+func (s *dynamoCommentStore) DeleteForBlog(ctx context.Context, blog *blogpb.Blog) error {
+	return s.updateAll(ctx, blog.GetId(), func(comment *blogpb.Comment) {
+		markCommentDeleted(comment, blog)
+	})
+}
+
+func (s *dynamoCommentStore) UndeleteForBlog(ctx context.Context, blogID string) error {
+	return s.updateAll(ctx, blogID, func(comment *blogpb.Comment) {
+		comment.DeleteTime = nil
+		comment.ExpireTime = nil
+	})
+}
+
+// updateAll applies fn to every comment on a blog and writes them back in batches.
+// The writes aren't conditional, so a comment updated in the meantime loses that update.
+// Nobody should be commenting on a blog that is being deleted or undeleted anyway.
+func (s *dynamoCommentStore) updateAll(ctx context.Context, blogID string, fn func(*blogpb.Comment)) error {
+	comments, err := s.query(ctx, blogID)
+	if err != nil {
+		return err
+	}
+
+	var requests []dynamodb.WriteRequest
+	for _, comment := range comments {
+		fn(comment)
+		av, err := marshalComment(comment)
+		if err != nil {
+			return err
+		}
+		requests = append(requests, dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: av}})
+	}
+
+	failed := batchWrite(ctx, s.client, s.table, requests)
+	for commentID, err := range failed {
+		return fmt.Errorf("%v of %v comments not written, e.g. %v: %v", len(failed), len(requests), commentID, err)
+	}
+	return nil
+}
+
+// query returns every comment on a blog, skipping the expired ones TTL hasn't gotten around to purging yet
+func (s *dynamoCommentStore) query(ctx context.Context, blogID string) ([]*blogpb.Comment, error) {
+	now := time.Now()
+	var comments []*blogpb.Comment
+	var startKey map[string]dynamodb.AttributeValue
+	for {
+		ddbReq := s.client.QueryRequest(&dynamodb.QueryInput{
+			ExclusiveStartKey:        startKey,
+			ExpressionAttributeNames: map[string]string{"#blog_id": "blog_id"},
+			ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+				":blog_id": {S: aws.String(blogID)},
+			},
+			KeyConditionExpression: aws.String("#blog_id = :blog_id"),
+			TableName:              aws.String(s.table),
+		})
+		ddbResp, err := ddbReq.Send(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query DynamoDB table %v: %v", s.table, err)
+		}
+
+		for _, item := range ddbResp.Items {
+			comment := &blogpb.Comment{}
+			if err := dynamodbattribute.UnmarshalMap(item, comment); err != nil {
+				return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+			}
+			if !isCommentExpired(comment, now) {
+				comments = append(comments, comment)
+			}
+		}
+
+		if len(ddbResp.LastEvaluatedKey) == 0 {
+			return comments, nil
+		}
+		startKey = ddbResp.LastEvaluatedKey
+	}
+}
+
+// key builds the DDB primary key for a comment
+func (s *dynamoCommentStore) key(blogID, commentID string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"blog_id": {S: aws.String(blogID)},
+		"id":      {S: aws.String(commentID)},
+	}
+}
+
+// marshalComment turns a comment into a DDB item. Comments on a deleted blog get the same TTL attribute as the blog
+func marshalComment(comment *blogpb.Comment) (map[string]dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB marshal Record, %v", err)
+	}
+	if comment.GetExpireTime() != nil {
+		av[ttlAttribute] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(comment.GetExpireTime().GetSeconds(), 10))}
+	}
+	return av, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+)
+
+// memoryCommentStore is a CommentStore that keeps comments in a map, next to memoryStore. Nothing survives a restart.
+type memoryCommentStore struct {
+	mu       sync.RWMutex
+	comments map[string]map[string]*blogpb.Comment // Blog ID to comment ID to comment
+}
+
+func newMemoryCommentStore() *memoryCommentStore {
+	return &memoryCommentStore{
+		comments: make(map[string]map[string]*blogpb.Comment),
+	}
+}
+
+func (s *memoryCommentStore) Create(ctx context.Context, comment *blogpb.Comment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.comments[comment.GetBlogId()] == nil {
+		s.comments[comment.GetBlogId()] = make(map[string]*blogpb.Comment)
+	}
+	s.comments[comment.GetBlogId()][comment.GetId()] = cloneComment(comment)
+	return nil
+}
+
+func (s *memoryCommentStore) Read(ctx context.Context, blogID, commentID string) (*blogpb.Comment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.comments[blogID][commentID]
+	if !ok || isCommentDeleted(stored) {
+		return nil, errCommentNotFound
+	}
+	return cloneComment(stored), nil
+}
+
+func (s *memoryCommentStore) Update(ctx context.Context, comment *blogpb.Comment) (*blogpb.Comment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[comment.GetBlogId()][comment.GetId()]
+	if !ok || isCommentDeleted(stored) {
+		return nil, errCommentNotFound
+	}
+	stored.Content = comment.GetContent()
+	stored.UpdateTime = comment.GetUpdateTime()
+	return cloneComment(stored), nil
+}
+
+func (s *memoryCommentStore) Delete(ctx context.Context, blogID, commentID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.comments[blogID][commentID]
+	if !ok || isCommentDeleted(stored) {
+		return errCommentNotFound
+	}
+	delete(s.comments[blogID], commentID)
+	return nil
+}
+
+func (s *memoryCommentStore) List(ctx context.Context, blogID string, pageSize int, pageToken string) ([]*blogpb.Comment, string, error) {
+	// Purge expired comments while we're at it, nothing else will
+	now := time.Now()
+	s.mu.Lock()
+	comments := make([]*blogpb.Comment, 0, len(s.comments[blogID]))
+	for id, comment := range s.comments[blogID] {
+		if isCommentExpired(comment, now) {
+			delete(s.comments[blogID], id)
+			continue
+		}
+		comments = append(comments, cloneComment(comment))
+	}
+	if len(s.comments[blogID]) == 0 {
+		delete(s.comments, blogID)
+	}
+	s.mu.Unlock()
+
+	return listComments(comments, pageSize, pageToken)
+}
+
+func (s *memoryCommentStore) DeleteForBlog(ctx context.Context, blog *blogpb.Blog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, comment := range s.comments[blog.GetId()] {
+		markCommentDeleted(comment, blog)
+	}
+	return nil
+}
+
+func (s *memoryCommentStore) UndeleteForBlog(ctx context.Context, blogID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, comment := range s.comments[blogID] {
+		comment.DeleteTime = nil
+		comment.ExpireTime = nil
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+	uuid "github.com/satori/go.uuid"
+)
+
+// testCommentStores are the CommentStores the comment store tests run against, each with the BlogStore it goes with
+var testCommentStores = []struct {
+	name string
+	open func(t *testing.T) (BlogStore, CommentStore) // Empty stores, gone after the test
+}{
+	{name: "memory", open: func(*testing.T) (BlogStore, CommentStore) { return newMemoryStore(), newMemoryCommentStore() }},
+	{name: "bolt", open: func(t *testing.T) (BlogStore, CommentStore) {
+		blogs, err := newBoltStore(filepath.Join(t.TempDir(), "blogs.db"))
+		if err != nil {
+			t.Fatalf("newBoltStore: %v", err)
+		}
+		t.Cleanup(func() { blogs.Close() })
+		comments, err := newBoltCommentStore(blogs.db)
+		if err != nil {
+			t.Fatalf("newBoltCommentStore: %v", err)
+		}
+		return blogs, comments
+	}},
+}
+
+// forEachCommentStore runs test against empty stores of each of testCommentStores
+func forEachCommentStore(t *testing.T, test func(t *testing.T, blogs BlogStore, comments CommentStore)) {
+	for _, store := range testCommentStores {
+		t.Run(store.name, func(t *testing.T) {
+			blogs, comments := store.open(t)
+			test(t, blogs, comments)
+		})
+	}
+}
+
+// testComment stores a new comment on a blog in s, created at createTime
+func testComment(t *testing.T, s CommentStore, blogID, content string, createTime time.Time) *blogpb.Comment {
+	t.Helper()
+	created, _ := ptypes.TimestampProto(createTime)
+	comment := &blogpb.Comment{Id: uuid.NewV4().String(), BlogId: blogID, AuthorId: "Ana", Content: content, CreateTime: created, UpdateTime: created}
+	if err := s.Create(context.Background(), comment); err != nil {
+		t.Fatalf("Create(%q): %v", content, err)
+	}
+	return comment
+}
+
+// listAllComments lists every page of comments on a blog, pageSize at a time, and returns their contents in order
+func listAllComments(t *testing.T, s CommentStore, blogID string, pageSize int) []string {
+	t.Helper()
+	var contents []string
+	pageToken := ""
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("List in pages of %v never ran out of pages", pageSize)
+		}
+		comments, next, err := s.List(context.Background(), blogID, pageSize, pageToken)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, comment := range comments {
+			contents = append(contents, comment.GetContent())
+		}
+		if next == "" {
+			return contents
+		}
+		pageToken = next
+	}
+}
+
+func TestCommentStore(t *testing.T) {
+	forEachCommentStore(t, func(t *testing.T, blogs BlogStore, comments CommentStore) {
+		ctx := context.Background()
+		blogID := testBlog(t, blogs, "commented").GetId()
+		comment := testComment(t, comments, blogID, "first", time.Now())
+
+		read, err := comments.Read(ctx, blogID, comment.GetId())
+		if err != nil || read.GetContent() != "first" {
+			t.Errorf("Read = %v, %v, want the comment", read, err)
+		}
+		if _, err := comments.Read(ctx, "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f", comment.GetId()); err != errCommentNotFound {
+			t.Errorf("Read on another blog error = %v, want %v", err, errCommentNotFound)
+		}
+
+		updated, err := comments.Update(ctx, &blogpb.Comment{BlogId: blogID, Id: comment.GetId(), AuthorId: "Milos", Content: "edited", UpdateTime: ptypes.TimestampNow()})
+		if err != nil || updated.GetContent() != "edited" || updated.GetAuthorId() != "Ana" {
+			t.Errorf("Update = %v, %v, want the new content, and nothing else changed", updated, err)
+		}
+
+		if err := comments.Delete(ctx, blogID, comment.GetId()); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := comments.Delete(ctx, blogID, comment.GetId()); err != errCommentNotFound {
+			t.Errorf("second Delete error = %v, want %v", err, errCommentNotFound)
+		}
+		if _, err := comments.Update(ctx, comment); err != errCommentNotFound {
+			t.Errorf("Update of a deleted comment error = %v, want %v", err, errCommentNotFound)
+		}
+	})
+}
+
+func TestCommentStoreListPaging(t *testing.T) {
+	forEachCommentStore(t, func(t *testing.T, blogs BlogStore, comments CommentStore) {
+		blogID := testBlog(t, blogs, "commented").GetId()
+		otherID := testBlog(t, blogs, "other").GetId()
+		start := time.Now()
+		var want []string
+		for i := 4; i >= 0; i-- { // Created newest first, listed oldest first
+			want = append([]string{fmt.Sprintf("comment %v", i)}, want...)
+			testComment(t, comments, blogID, want[0], start.Add(time.Duration(i)*time.Second))
+		}
+		testComment(t, comments, otherID, "elsewhere", start)
+
+		for _, pageSize := range []int{0, 1, 2, 5, 10} {
+			if got := listAllComments(t, comments, blogID, pageSize); !reflect.DeepEqual(got, want) {
+				t.Errorf("List in pages of %v = %q, want %q", pageSize, got, want)
+			}
+		}
+		if _, _, err := comments.List(context.Background(), blogID, 2, "nope!"); err != errInvalidPageToken {
+			t.Errorf("List with a bad page token error = %v, want %v", err, errInvalidPageToken)
+		}
+		if got := listAllComments(t, comments, "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f", 0); len(got) != 0 {
+			t.Errorf("List on a blog without comments = %q, want none", got)
+		}
+	})
+}
+
+func TestCommentsFollowTheirBlog(t *testing.T) {
+	forEachCommentStore(t, func(t *testing.T, blogs BlogStore, comments CommentStore) {
+		ctx := context.Background()
+		s := &cascadingStore{BlogStore: blogs, comments: comments}
+		blog := testBlog(t, s, "commented")
+		batched := testBlog(t, s, "batch deleted")
+		bystander := testBlog(t, s, "bystander")
+		first := testComment(t, comments, blog.GetId(), "first", time.Now())
+		testComment(t, comments, blog.GetId(), "second", time.Now().Add(time.Second))
+		testComment(t, comments, batched.GetId(), "batched", time.Now())
+		testComment(t, comments, bystander.GetId(), "untouched", time.Now())
+
+		later, _ := ptypes.TimestampProto(time.Now().Add(time.Hour))
+		if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow(), ExpireTime: later}, 0); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if errs := s.BatchDelete(ctx, []*blogpb.Blog{{Id: batched.GetId(), DeleteTime: ptypes.TimestampNow()}}); errs[0] != nil {
+			t.Fatalf("BatchDelete: %v", errs[0])
+		}
+
+		// Hidden, everywhere
+		for blogID, name := range map[string]string{blog.GetId(): "Delete", batched.GetId(): "BatchDelete"} {
+			if got := listAllComments(t, comments, blogID, 0); len(got) != 0 {
+				t.Errorf("List after %v = %q, want none", name, got)
+			}
+		}
+		if _, err := comments.Read(ctx, blog.GetId(), first.GetId()); err != errCommentNotFound {
+			t.Errorf("Read after Delete error = %v, want %v", err, errCommentNotFound)
+		}
+		if _, err := comments.Update(ctx, first); err != errCommentNotFound {
+			t.Errorf("Update after Delete error = %v, want %v", err, errCommentNotFound)
+		}
+		if err := comments.Delete(ctx, blog.GetId(), first.GetId()); err != errCommentNotFound {
+			t.Errorf("Delete after the blog's Delete error = %v, want %v", err, errCommentNotFound)
+		}
+		if got := listAllComments(t, comments, bystander.GetId(), 0); !reflect.DeepEqual(got, []string{"untouched"}) {
+			t.Errorf("List on another blog = %q, want [untouched]", got)
+		}
+
+		// And back, as they were
+		if _, err := s.Undelete(ctx, blog.GetId()); err != nil {
+			t.Fatalf("Undelete: %v", err)
+		}
+		if got := listAllComments(t, comments, blog.GetId(), 1); !reflect.DeepEqual(got, []string{"first", "second"}) {
+			t.Errorf("List after Undelete = %q, want [first second]", got)
+		}
+		read, err := comments.Read(ctx, blog.GetId(), first.GetId())
+		if err != nil || read.GetDeleteTime() != nil || read.GetExpireTime() != nil {
+			t.Errorf("Read after Undelete = %v, %v, want it without delete_time and expire_time", read, err)
+		}
+	})
+}
+
+func TestCommentStoreExpiredCommentsAreGone(t *testing.T) {
+	forEachCommentStore(t, func(t *testing.T, blogs BlogStore, comments CommentStore) {
+		ctx := context.Background()
+		blogID := testBlog(t, blogs, "expired").GetId()
+		testComment(t, comments, blogID, "doomed", time.Now())
+
+		past, _ := ptypes.TimestampProto(time.Now().Add(-time.Second))
+		if err := comments.DeleteForBlog(ctx, &blogpb.Blog{Id: blogID, DeleteTime: past, ExpireTime: past}); err != nil {
+			t.Fatalf("DeleteForBlog: %v", err)
+		}
+		if got := listAllComments(t, comments, blogID, 0); len(got) != 0 {
+			t.Errorf("List of expired comments = %q, want none", got)
+		}
+		// Listing purged them, so there's nothing to bring back
+		if err := comments.UndeleteForBlog(ctx, blogID); err != nil {
+			t.Fatalf("UndeleteForBlog: %v", err)
+		}
+		if got := listAllComments(t, comments, blogID, 0); len(got) != 0 {
+			t.Errorf("List after undeleting purged comments = %q, want none", got)
+		}
+	})
+}
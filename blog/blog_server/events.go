@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// errInvalidResumeToken is returned by eventBroker.subscribe when the resume token can't be decoded
+var errInvalidResumeToken = errors.New("invalid resume token")
+
+// errResumeTooOld is returned by eventBroker.subscribe when the events after the resume token are no longer kept,
+// or were kept by a previous run of the server
+var errResumeTooOld = errors.New("resume token is too old")
+
+var eventHistorySize = 1024 // Events kept around for watchers resuming after a reconnect
+
+var subscriberBuffer = 256 // Events a watcher can fall behind by before it gets cut off
+
+// eventBroker fans blog events out to WatchBlogs streams, and to the search index.
+// It numbers events and remembers the last eventHistorySize of them, so a watcher can resume where it left off.
+type eventBroker struct {
+	mu        sync.Mutex
+	epoch     int64  // Tells tokens from this run apart from those of a previous one
+	seq       uint64 // Sequence number of the last published event
+	history   []*blogpb.BlogEvent
+	subs      map[*subscription]bool
+	listeners []func(*blogpb.BlogEvent) // Called with every event, never cut off
+}
+
+// subscription receives published events until the broker closes its channel
+type subscription struct {
+	events chan *blogpb.BlogEvent
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		epoch:   time.Now().UnixNano(),
+		history: make([]*blogpb.BlogEvent, eventHistorySize),
+		subs:    make(map[*subscription]bool),
+	}
+}
+
+// publish numbers an event and hands it to every subscription.
+// Subscriptions too far behind to take it are closed rather than holding everyone else up.
+func (b *eventBroker) publish(eventType blogpb.BlogEvent_Type, blog *blogpb.Blog) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := &blogpb.BlogEvent{
+		Type:          eventType,
+		Blog:          blog,
+		SequenceToken: b.token(b.seq),
+		EventTime:     ptypes.TimestampNow(),
+	}
+	b.history[b.seq%uint64(len(b.history))] = event
+
+	for _, listener := range b.listeners {
+		listener(event)
+	}
+	for sub := range b.subs {
+		select {
+		case sub.events <- event:
+		default:
+			log.Printf("Watcher fell %v events behind, cutting it off", len(sub.events))
+			delete(b.subs, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// listen calls listener with every event published from now on, in order. Unlike subscriptions, listeners
+// are called while publishing, so they have to be quick and mustn't call back into the broker.
+func (b *eventBroker) listen(listener func(*blogpb.BlogEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.listeners = append(b.listeners, listener)
+}
+
+// subscribe starts a subscription. With a resume token, it also returns the events published since that one.
+// Without one, it returns the token of the last event published, so the subscriber can resume from here.
+func (b *eventBroker) subscribe(resumeToken string) (*subscription, []*blogpb.BlogEvent, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var backlog []*blogpb.BlogEvent
+	if resumeToken == "" {
+		resumeToken = b.token(b.seq)
+	} else {
+		epoch, seq, err := parseEventToken(resumeToken)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		if epoch != b.epoch || seq > b.seq {
+			return nil, nil, "", errResumeTooOld // Server restarted since, the events are gone
+		}
+		if b.seq-seq > uint64(len(b.history)) {
+			return nil, nil, "", errResumeTooOld
+		}
+		for next := seq + 1; next <= b.seq; next++ {
+			backlog = append(backlog, b.history[next%uint64(len(b.history))])
+		}
+	}
+
+	sub := &subscription{events: make(chan *blogpb.BlogEvent, subscriberBuffer)}
+	b.subs[sub] = true
+	return sub, backlog, resumeToken, nil
+}
+
+// unsubscribe stops a subscription, unless the broker already cut it off
+func (b *eventBroker) unsubscribe(sub *subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.subs[sub] {
+		delete(b.subs, sub)
+		close(sub.events)
+	}
+}
+
+// token encodes an event sequence number as an opaque resume token
+func (b *eventBroker) token(seq uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d/%d", b.epoch, seq)))
+}
+
+// parseEventToken is the reverse of eventBroker.token
+func parseEventToken(token string) (int64, uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, 0, errInvalidResumeToken
+	}
+	var epoch int64
+	var seq uint64
+	if _, err := fmt.Sscanf(string(raw), "%d/%d", &epoch, &seq); err != nil {
+		return 0, 0, errInvalidResumeToken
+	}
+	return epoch, seq, nil
+}
+
+// watcherEvent returns what WatchBlogs streams get to see of an event: published blogs only, like ListBlog and SearchBlogs.
+// A blog that isn't published (any more) shows up as DELETED, with only its ID, so watchers drop it if they had it.
+// A new one that isn't published yet doesn't show up at all (nil)
+func watcherEvent(event *blogpb.BlogEvent) *blogpb.BlogEvent {
+	blog := event.GetBlog()
+	if blog.GetState() == blogpb.Blog_PUBLISHED {
+		return event
+	}
+	if event.GetType() == blogpb.BlogEvent_CREATED {
+		return nil
+	}
+	return &blogpb.BlogEvent{
+		Type:          blogpb.BlogEvent_DELETED,
+		Blog:          &blogpb.Blog{Id: blog.GetId()},
+		SequenceToken: event.GetSequenceToken(),
+		EventTime:     event.GetEventTime(),
+	}
+}
+
+// watchedStore is a BlogStore that publishes an event for every successful change to the wrapped store.
+// This covers the changes made through this server. DynamoDB Streams (see streamPoller) covers the rest.
+type watchedStore struct {
+	BlogStore
+	broker *eventBroker
+}
+
+func (s *watchedStore) Create(ctx context.Context, blog *blogpb.Blog) error {
+	if err := s.BlogStore.Create(ctx, blog); err != nil {
+		return err
+	}
+	s.broker.publish(blogpb.BlogEvent_CREATED, cloneBlog(blog))
+	return nil
+}
+
+func (s *watchedStore) Update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, expectedVersion int64) (*blogpb.Blog, error) {
+	updated, err := s.BlogStore.Update(ctx, blog, paths, tags, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	s.broker.publish(blogpb.BlogEvent_UPDATED, cloneBlog(updated))
+	return updated, nil
+}
+
+func (s *watchedStore) SetState(ctx context.Context, blog *blogpb.Blog, from []blogpb.Blog_State, expectedVersion int64) (*blogpb.Blog, error) {
+	updated, err := s.BlogStore.SetState(ctx, blog, from, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	s.broker.publish(blogpb.BlogEvent_UPDATED, cloneBlog(updated))
+	return updated, nil
+}
+
+func (s *watchedStore) Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error {
+	if err := s.BlogStore.Delete(ctx, blog, expectedVersion); err != nil {
+		return err
+	}
+	s.publishDeleted(ctx, []*blogpb.Blog{blog})
+	return nil
+}
+
+func (s *watchedStore) Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	blog, err := s.BlogStore.Undelete(ctx, blogID)
+	if err != nil {
+		return nil, err
+	}
+	s.broker.publish(blogpb.BlogEvent_UNDELETED, cloneBlog(blog))
+	return blog, nil
+}
+
+func (s *watchedStore) BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := s.BlogStore.BatchCreate(ctx, blogs)
+	for i, blog := range blogs {
+		if errs[i] == nil {
+			s.broker.publish(blogpb.BlogEvent_CREATED, cloneBlog(blog))
+		}
+	}
+	return errs
+}
+
+func (s *watchedStore) BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := s.BlogStore.BatchDelete(ctx, blogs)
+	var deleted []*blogpb.Blog
+	for i, blog := range blogs {
+		if errs[i] == nil {
+			deleted = append(deleted, blog)
+		}
+	}
+	s.publishDeleted(ctx, deleted)
+	return errs
+}
+
+// publishDeleted publishes the deleted blogs as stored, so watchers get to see the rest of their fields (e.g. author_id).
+// Falls back to what the caller passed to Delete if they can't be read back.
+func (s *watchedStore) publishDeleted(ctx context.Context, blogs []*blogpb.Blog) {
+	if len(blogs) == 0 {
+		return
+	}
+	blogIDs := make([]string, len(blogs))
+	for i, blog := range blogs {
+		blogIDs[i] = blog.GetId()
+	}
+	stored, errs := s.BlogStore.BatchRead(ctx, blogIDs)
+	for i, blog := range blogs {
+		if errs[i] != nil {
+			log.Printf("Could not read back deleted blog %v for watchers: %v", blog.GetId(), errs[i])
+			s.broker.publish(blogpb.BlogEvent_DELETED, cloneBlog(blog))
+			continue
+		}
+		s.broker.publish(blogpb.BlogEvent_DELETED, stored[i])
+	}
+}
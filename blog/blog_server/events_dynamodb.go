@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodbstreams"
+)
+
+var streamPollInterval = 1 * time.Second // How often streamPoller asks DDB Streams for new records
+
+// streamPoller publishes blog events from the DynamoDB Stream of the blog table.
+// Unlike watchedStore, it sees changes made through every server sharing the table, not just this one.
+type streamPoller struct {
+	ddb     *dynamodb.Client
+	streams *dynamodbstreams.Client
+	table   string
+	broker  *eventBroker
+
+	iterators map[string]*string // Open shard ID to where we're at in it
+	finished  map[string]bool    // Shards that are closed and fully read, or were closed before we started
+}
+
+func newStreamPoller(ddbCfg aws.Config, table string, broker *eventBroker) *streamPoller {
+	return &streamPoller{
+		ddb:       dynamodb.New(ddbCfg),
+		streams:   dynamodbstreams.New(ddbCfg),
+		table:     table,
+		broker:    broker,
+		iterators: make(map[string]*string),
+		finished:  make(map[string]bool),
+	}
+}
+
+// run polls the stream until ctx is done. Only changes from here on are published.
+func (p *streamPoller) run(ctx context.Context) error {
+	streamArn, err := p.streamArn(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("Watching DynamoDB stream: %v", streamArn)
+
+	starting := true
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+	for {
+		// Shards come and go (DDB splits them). Pick up new ones every time around, it's one cheap call
+		if err := p.refreshShards(ctx, streamArn, starting); err != nil {
+			log.Printf("Could not list DynamoDB stream shards: %v", err)
+		} else {
+			starting = false
+		}
+
+		for shardID, iterator := range p.iterators {
+			p.poll(ctx, shardID, iterator)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// streamArn returns the ARN of the blog table's stream, turning the stream on if the table predates it
+func (p *streamPoller) streamArn(ctx context.Context) (string, error) {
+	describe := &dynamodb.DescribeTableInput{TableName: aws.String(p.table)}
+	if err := p.ddb.WaitUntilTableExists(ctx, describe); err != nil {
+		return "", err
+	}
+	ddbResp, err := p.ddb.DescribeTableRequest(describe).Send(ctx)
+	if err != nil {
+		return "", err
+	}
+	if spec := ddbResp.Table.StreamSpecification; spec != nil && aws.BoolValue(spec.StreamEnabled) {
+		return aws.StringValue(ddbResp.Table.LatestStreamArn), nil
+	}
+
+	log.Printf("Enabling DynamoDB stream on table: %v", p.table)
+	ddbReq := p.ddb.UpdateTableRequest(&dynamodb.UpdateTableInput{
+		TableName:           aws.String(p.table),
+		StreamSpecification: blogStreamSpecification(),
+	})
+	updateResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to enable DynamoDB stream: %v", err)
+	}
+	return aws.StringValue(updateResp.TableDescription.LatestStreamArn), nil
+}
+
+// refreshShards starts reading shards we haven't seen yet. On start, only open shards are read, from their end.
+// Shards showing up later are children of ones we were reading, so they are read from the start.
+func (p *streamPoller) refreshShards(ctx context.Context, streamArn string, starting bool) error {
+	var startShardID *string
+	for {
+		ddbReq := p.streams.DescribeStreamRequest(&dynamodbstreams.DescribeStreamInput{
+			ExclusiveStartShardId: startShardID,
+			StreamArn:             aws.String(streamArn),
+		})
+		ddbResp, err := ddbReq.Send(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, shard := range ddbResp.StreamDescription.Shards {
+			shardID := aws.StringValue(shard.ShardId)
+			if _, ok := p.iterators[shardID]; ok || p.finished[shardID] {
+				continue
+			}
+			closed := shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil
+			if starting && closed {
+				p.finished[shardID] = true // Old news
+				continue
+			}
+
+			iteratorType := dynamodbstreams.ShardIteratorTypeTrimHorizon
+			if starting {
+				iteratorType = dynamodbstreams.ShardIteratorTypeLatest
+			}
+			iterReq := p.streams.GetShardIteratorRequest(&dynamodbstreams.GetShardIteratorInput{
+				ShardId:           shard.ShardId,
+				ShardIteratorType: iteratorType,
+				StreamArn:         aws.String(streamArn),
+			})
+			iterResp, err := iterReq.Send(ctx)
+			if err != nil {
+				return err
+			}
+			p.iterators[shardID] = iterResp.ShardIterator
+		}
+
+		startShardID = ddbResp.StreamDescription.LastEvaluatedShardId
+		if startShardID == nil {
+			return nil
+		}
+	}
+}
+
+// poll publishes the records on one shard since the last poll
+func (p *streamPoller) poll(ctx context.Context, shardID string, iterator *string) {
+	ddbReq := p.streams.GetRecordsRequest(&dynamodbstreams.GetRecordsInput{ShardIterator: iterator})
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		// Most likely an expired iterator. Drop it, and refreshShards starts the shard over from the start.
+		// Nothing is missed, but watchers may see some events twice. The blog version tells them apart
+		log.Printf("Could not get records from DynamoDB stream shard %v: %v", shardID, err)
+		delete(p.iterators, shardID)
+		return
+	}
+
+	for _, record := range ddbResp.Records {
+		eventType, blog, ok := streamEvent(record)
+		if ok {
+			p.broker.publish(eventType, blog)
+		}
+	}
+
+	if ddbResp.NextShardIterator == nil { // Shard is closed and we read all of it
+		delete(p.iterators, shardID)
+		p.finished[shardID] = true
+		return
+	}
+	p.iterators[shardID] = ddbResp.NextShardIterator
+}
+
+// streamEvent turns a stream record into a blog event. Removals (TTL purging an expired blog) aren't events.
+func streamEvent(record dynamodbstreams.Record) (blogpb.BlogEvent_Type, *blogpb.Blog, bool) {
+	if record.Dynamodb == nil || record.EventName == dynamodbstreams.OperationTypeRemove {
+		return 0, nil, false
+	}
+
+	blog := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(record.Dynamodb.NewImage, blog); err != nil {
+		log.Printf("Could not unmarshal DynamoDB stream record %v: %v", aws.StringValue(record.EventID), err)
+		return 0, nil, false
+	}
+	if record.EventName == dynamodbstreams.OperationTypeInsert {
+		return blogpb.BlogEvent_CREATED, blog, true
+	}
+
+	// Deletes and undeletes are modifications as far as DDB is concerned
+	_, wasDeleted := record.Dynamodb.OldImage["delete_time"]
+	switch {
+	case !wasDeleted && isDeleted(blog):
+		return blogpb.BlogEvent_DELETED, blog, true
+	case wasDeleted && !isDeleted(blog):
+		return blogpb.BlogEvent_UNDELETED, blog, true
+	}
+	return blogpb.BlogEvent_UPDATED, blog, true
+}
+
+// blogStreamSpecification is the DDB Stream the blog table gets. streamEvent needs both images
+func blogStreamSpecification() *dynamodb.StreamSpecification {
+	return &dynamodb.StreamSpecification{
+		StreamEnabled:  aws.Bool(true),
+		StreamViewType: dynamodb.StreamViewTypeNewAndOldImages,
+	}
+}
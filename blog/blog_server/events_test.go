@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// newTestBroker returns a broker that keeps historySize events, with published events already published.
+// Also returns the token to resume after each of them
+func newTestBroker(t *testing.T, historySize, published int) (*eventBroker, []string) {
+	t.Helper()
+	saved := eventHistorySize
+	eventHistorySize = historySize
+	defer func() { eventHistorySize = saved }()
+
+	b := newEventBroker()
+	tokens := []string{b.token(0)} // tokens[n] resumes after the nth event
+	for i := 1; i <= published; i++ {
+		b.publish(blogpb.BlogEvent_CREATED, &blogpb.Blog{Id: fmt.Sprintf("blog-%v", i)})
+		tokens = append(tokens, b.token(uint64(i)))
+	}
+	return b, tokens
+}
+
+func TestEventBrokerResume(t *testing.T) {
+	b, tokens := newTestBroker(t, 4, 10)
+	otherRun := newEventBroker()
+
+	tests := []struct {
+		name        string
+		token       string
+		wantBlogIDs []string
+		wantErr     error
+	}{
+		{name: "up to date", token: tokens[10]},
+		{name: "one behind", token: tokens[9], wantBlogIDs: []string{"blog-10"}},
+		{name: "as far behind as is kept", token: tokens[6], wantBlogIDs: []string{"blog-7", "blog-8", "blog-9", "blog-10"}},
+		{name: "further behind than is kept", token: tokens[5], wantErr: errResumeTooOld},
+		{name: "from the start", token: tokens[0], wantErr: errResumeTooOld},
+		{name: "from a previous run", token: otherRun.token(10), wantErr: errResumeTooOld},
+		{name: "from the future", token: b.token(11), wantErr: errResumeTooOld},
+		{name: "not base64", token: "!!!", wantErr: errInvalidResumeToken},
+		{name: "not a token", token: "bm9wZQ", wantErr: errInvalidResumeToken}, // "nope"
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, backlog, _, err := b.subscribe(tt.token)
+			if err != tt.wantErr {
+				t.Fatalf("subscribe error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer b.unsubscribe(sub)
+
+			var blogIDs []string
+			for _, event := range backlog {
+				blogIDs = append(blogIDs, event.GetBlog().GetId())
+			}
+			if fmt.Sprint(blogIDs) != fmt.Sprint(tt.wantBlogIDs) {
+				t.Errorf("subscribe backlog = %v, want %v", blogIDs, tt.wantBlogIDs)
+			}
+		})
+	}
+}
+
+func TestEventBrokerSubscribeWithoutToken(t *testing.T) {
+	b, tokens := newTestBroker(t, 4, 3)
+	sub, backlog, token, err := b.subscribe("")
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	defer b.unsubscribe(sub)
+	if len(backlog) != 0 || token != tokens[3] {
+		t.Errorf("subscribe without a token = %v events and token %q, want none and %q", len(backlog), token, tokens[3])
+	}
+
+	b.publish(blogpb.BlogEvent_DELETED, &blogpb.Blog{Id: "blog-4"})
+	event := <-sub.events
+	if event.GetType() != blogpb.BlogEvent_DELETED || event.GetBlog().GetId() != "blog-4" {
+		t.Errorf("published event = %v, want blog-4 DELETED", event)
+	}
+}
+
+func TestEventBrokerCutsOffSlowSubscribers(t *testing.T) {
+	saved := subscriberBuffer
+	subscriberBuffer = 2
+	defer func() { subscriberBuffer = saved }()
+
+	b := newEventBroker()
+	slow, _, _, _ := b.subscribe("")
+	for i := 0; i < 3; i++ {
+		b.publish(blogpb.BlogEvent_CREATED, &blogpb.Blog{Id: fmt.Sprintf("blog-%v", i)})
+	}
+
+	received := 0
+	for range slow.events { // Closed after the buffered events, since the third one didn't fit
+		received++
+	}
+	if received != 2 {
+		t.Errorf("slow subscriber got %v events before being cut off, want 2", received)
+	}
+	b.unsubscribe(slow) // Already cut off, mustn't close the channel again
+}
+
+func TestWatchedStorePublishesChanges(t *testing.T) {
+	ctx := context.Background()
+	b := newEventBroker()
+	s := &watchedStore{BlogStore: newMemoryStore(), broker: b}
+	sub, _, _, _ := b.subscribe("")
+	defer b.unsubscribe(sub)
+
+	blog := testBlog(t, s, "watched")
+	if _, err := s.Update(ctx, &blogpb.Blog{Id: blog.GetId(), Title: "renamed"}, []string{"title"}, TagChanges{}, 0); err != nil {
+		t.Fatalf("Update: %v", err)
+	}
+	if _, err := s.Update(ctx, &blogpb.Blog{Id: "missing"}, []string{"title"}, TagChanges{}, 0); err != errBlogNotFound {
+		t.Fatalf("Update of a missing blog error = %v, want %v", err, errBlogNotFound)
+	}
+	if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}, 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Undelete(ctx, blog.GetId()); err != nil {
+		t.Fatalf("Undelete: %v", err)
+	}
+
+	want := []blogpb.BlogEvent_Type{blogpb.BlogEvent_CREATED, blogpb.BlogEvent_UPDATED, blogpb.BlogEvent_DELETED, blogpb.BlogEvent_UNDELETED}
+	for _, wantType := range want {
+		event := <-sub.events
+		if event.GetType() != wantType {
+			t.Errorf("event = %v, want %v", event.GetType(), wantType)
+		}
+		if event.GetBlog().GetAuthorId() != "Milos" { // Deletes are published as stored, not as passed to Delete
+			t.Errorf("%v event blog = %v, want the whole blog", event.GetType(), event.GetBlog())
+		}
+	}
+	if len(sub.events) != 0 {
+		t.Errorf("%v more events than changes", len(sub.events))
+	}
+}
+
+func TestWatcherEvent(t *testing.T) {
+	draft := &blogpb.Blog{Id: "a", AuthorId: "Milos", Title: "secret", State: blogpb.Blog_DRAFT}
+	published := &blogpb.Blog{Id: "a", AuthorId: "Milos", Title: "public", State: blogpb.Blog_PUBLISHED}
+	archived := &blogpb.Blog{Id: "a", AuthorId: "Milos", Title: "old news", State: blogpb.Blog_ARCHIVED}
+	deletedDraft := &blogpb.Blog{Id: "a", AuthorId: "Milos", Title: "secret", State: blogpb.Blog_DRAFT, DeleteTime: ptypes.TimestampNow()}
+
+	tests := []struct {
+		name      string
+		eventType blogpb.BlogEvent_Type
+		blog      *blogpb.Blog
+		want      string // Type and title watchers see, "" for nothing
+	}{
+		{name: "new draft", eventType: blogpb.BlogEvent_CREATED, blog: draft, want: ""},
+		{name: "draft edited", eventType: blogpb.BlogEvent_UPDATED, blog: draft, want: "DELETED "},
+		{name: "published", eventType: blogpb.BlogEvent_UPDATED, blog: published, want: "UPDATED public"},
+		{name: "archived", eventType: blogpb.BlogEvent_UPDATED, blog: archived, want: "DELETED "},
+		{name: "draft deleted", eventType: blogpb.BlogEvent_DELETED, blog: deletedDraft, want: "DELETED "},
+		{name: "draft undeleted", eventType: blogpb.BlogEvent_UNDELETED, blog: draft, want: "DELETED "},
+		{name: "created published", eventType: blogpb.BlogEvent_CREATED, blog: published, want: "CREATED public"},
+	}
+	for _, tt := range tests {
+		event := watcherEvent(&blogpb.BlogEvent{Type: tt.eventType, Blog: tt.blog, SequenceToken: "token"})
+		got := ""
+		if event != nil {
+			got = event.GetType().String() + " " + event.GetBlog().GetTitle()
+			if event.GetBlog().GetId() != "a" || event.GetSequenceToken() != "token" {
+				t.Errorf("%v: watcherEvent = %v, want the blog ID and sequence token kept", tt.name, event)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%v: watcherEvent = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
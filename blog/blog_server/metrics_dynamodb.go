@@ -0,0 +1,49 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DDB (and DDB Streams) calls, per API. Latency includes the SDK's retries, it's what the handler waited for
+var (
+	ddbRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_dynamodb_request_duration_seconds",
+		Help:    "Latency of DynamoDB API calls, retries included.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"service", "operation"})
+
+	ddbRequestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_dynamodb_request_errors_total",
+		Help: "DynamoDB API calls that failed, by error code.",
+	}, []string{"service", "operation", "code"})
+)
+
+// instrumentDynamoDB makes every client created from the returned config record its calls in
+// ddbRequestDuration and ddbRequestErrors
+func instrumentDynamoDB(ddbCfg aws.Config) aws.Config {
+	ddbCfg = ddbCfg.Copy() // Don't add to the handler lists of whoever else holds ddbCfg
+	ddbCfg.Handlers.Complete.PushBackNamed(aws.NamedHandler{
+		Name: "blog.metrics",
+		Fn:   recordDynamoDBRequest,
+	})
+	return ddbCfg
+}
+
+// recordDynamoDBRequest runs once a DDB call is done, whether it worked or not
+func recordDynamoDBRequest(r *aws.Request) {
+	service, operation := r.Metadata.ServiceName, r.Operation.Name
+	ddbRequestDuration.WithLabelValues(service, operation).Observe(time.Since(r.Time).Seconds())
+	if r.Error == nil {
+		return
+	}
+	code := "Unknown"
+	if aerr, ok := r.Error.(awserr.Error); ok {
+		code = aerr.Code()
+	}
+	ddbRequestErrors.WithLabelValues(service, operation, code).Inc()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+var publishInterval = time.Minute // How often the publish worker looks for scheduled drafts that are due. See BLOGPUBLISHINTERVAL
+
+// publishWorker publishes drafts once their publish_time comes around.
+// Several servers can share a store: SetState only lets one of them publish each draft.
+type publishWorker struct {
+	store BlogStore
+}
+
+func newPublishWorker(store BlogStore) *publishWorker {
+	return &publishWorker{store: store}
+}
+
+// run publishes due drafts every publishInterval until ctx is done
+func (w *publishWorker) run(ctx context.Context) error {
+	ticker := time.NewTicker(publishInterval)
+	defer ticker.Stop()
+	for {
+		if published, err := w.publishDue(ctx); err != nil {
+			log.Printf("Could not publish scheduled blogs: %v", err)
+		} else if published > 0 {
+			log.Printf("Published %v scheduled blogs", published)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishDue publishes every draft whose publish_time has passed, and returns how many it published
+func (w *publishWorker) publishDue(ctx context.Context) (int, error) {
+	var due []*blogpb.Blog
+	err := w.store.ListDue(ctx, time.Now(), func(blog *blogpb.Blog) error {
+		due = append(due, blog)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, blog := range due {
+		// The publish_time stays as it was scheduled. Pinning the version leaves drafts alone
+		// that got rescheduled since we listed them, or that another server already published
+		_, err := w.store.SetState(ctx, &blogpb.Blog{
+			Id:         blog.GetId(),
+			State:      blogpb.Blog_PUBLISHED,
+			UpdateTime: ptypes.TimestampNow(),
+		}, []blogpb.Blog_State{blogpb.Blog_DRAFT}, blog.GetVersion())
+		switch err {
+		case nil:
+			published++
+		case errVersionMismatch, errBlogNotFound, errInvalidStateChange: // Changed since we listed it, leave it be
+		default:
+			log.Printf("Could not publish scheduled blog %v: %v", blog.GetId(), err)
+		}
+	}
+	return published, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+func TestPublishDue(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		past, _ := ptypes.TimestampProto(time.Now().Add(-time.Minute))
+		future, _ := ptypes.TimestampProto(time.Now().Add(time.Hour))
+
+		// Title to what happens to the blog before the worker runs
+		setups := map[string]func(blog *blogpb.Blog) error{
+			"due": func(blog *blogpb.Blog) error {
+				_, err := s.SetState(ctx, &blogpb.Blog{Id: blog.GetId(), State: blogpb.Blog_DRAFT, PublishTime: past}, []blogpb.Blog_State{blogpb.Blog_DRAFT}, 0)
+				return err
+			},
+			"not yet due": func(blog *blogpb.Blog) error {
+				_, err := s.SetState(ctx, &blogpb.Blog{Id: blog.GetId(), State: blogpb.Blog_DRAFT, PublishTime: future}, []blogpb.Blog_State{blogpb.Blog_DRAFT}, 0)
+				return err
+			},
+			"unscheduled": func(blog *blogpb.Blog) error { return nil },
+			"deleted while due": func(blog *blogpb.Blog) error {
+				if _, err := s.SetState(ctx, &blogpb.Blog{Id: blog.GetId(), State: blogpb.Blog_DRAFT, PublishTime: past}, []blogpb.Blog_State{blogpb.Blog_DRAFT}, 0); err != nil {
+					return err
+				}
+				return s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}, 0)
+			},
+		}
+		for title, setup := range setups {
+			if err := setup(testBlog(t, s, title)); err != nil {
+				t.Fatalf("Setting up %q: %v", title, err)
+			}
+		}
+
+		var due []string
+		if err := s.ListDue(ctx, time.Now(), func(blog *blogpb.Blog) error {
+			due = append(due, blog.GetTitle())
+			return nil
+		}); err != nil || len(due) != 1 || due[0] != "due" {
+			t.Errorf("ListDue = %q, %v, want only the due draft", due, err)
+		}
+
+		w := newPublishWorker(s)
+		if published, err := w.publishDue(ctx); err != nil || published != 1 {
+			t.Errorf("publishDue = %v, %v, want 1 published", published, err)
+		}
+		if published, err := w.publishDue(ctx); err != nil || published != 0 {
+			t.Errorf("publishDue again = %v, %v, want nothing left to publish", published, err)
+		}
+
+		states := map[string]blogpb.Blog_State{}
+		if _, err := s.List(ctx, ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT, blogpb.Blog_PUBLISHED}}, func(blog *blogpb.Blog) error {
+			states[blog.GetTitle()] = blog.GetState()
+			return nil
+		}); err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		want := map[string]blogpb.Blog_State{"due": blogpb.Blog_PUBLISHED, "not yet due": blogpb.Blog_DRAFT, "unscheduled": blogpb.Blog_DRAFT}
+		for title := range want {
+			if states[title] != want[title] {
+				t.Errorf("%q is %v after publishDue, want %v", title, states[title], want[title])
+			}
+		}
+	})
+}
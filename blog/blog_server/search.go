@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+)
+
+// BM25 ranking parameters. The usual defaults
+var (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var titleBoost = 3 // A word in the title counts as much as this many in the content
+
+var snippetLength = 160 // Roughly how many bytes of content a search snippet shows
+
+// searchIndex is an in-process inverted index over blog titles and content, for SearchBlogs.
+// Only published blogs that aren't deleted are indexed. It follows the same events as WatchBlogs (see apply),
+// so with BLOGWATCH=streams it also sees the changes made by other servers.
+type searchIndex struct {
+	mu       sync.RWMutex
+	docs     map[string]*indexedBlog       // Blog ID to what we know about it
+	postings map[string]map[string]float64 // Term to blog ID to (boosted) term frequency
+	length   int                           // Sum of all document lengths, for the average
+	versions map[string]int64              // Blog ID to the newest version seen, indexed or not. See put
+}
+
+// indexedBlog is a blog as the index sees it
+type indexedBlog struct {
+	blog   *blogpb.Blog
+	terms  map[string]float64 // Term to (boosted) term frequency
+	length int                // Number of terms, boosted like the frequencies
+}
+
+// searchResult is one ranked hit
+type searchResult struct {
+	blog  *blogpb.Blog
+	score float64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:     make(map[string]*indexedBlog),
+		postings: make(map[string]map[string]float64),
+		versions: make(map[string]int64),
+	}
+}
+
+// apply keeps the index up to date with a blog event. See eventBroker.listen
+func (x *searchIndex) apply(event *blogpb.BlogEvent) {
+	if event.GetType() == blogpb.BlogEvent_DELETED {
+		x.delete(event.GetBlog())
+		return
+	}
+	x.put(event.GetBlog())
+}
+
+// put indexes a blog, replacing whatever was indexed for it before. Deleted and unpublished blogs are removed instead.
+// Versions older than the newest one seen are ignored, DynamoDB Streams may replay them. That goes for removed blogs
+// too, or a replayed published version would bring back an archived blog
+func (x *searchIndex) put(blog *blogpb.Blog) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if !x.seen(blog) {
+		return
+	}
+	x.remove(blog.GetId())
+	if isDeleted(blog) || blog.GetState() != blogpb.Blog_PUBLISHED {
+		return
+	}
+
+	doc := &indexedBlog{
+		blog:  cloneBlog(blog),
+		terms: map[string]float64{},
+	}
+	for _, t := range tokenize(blog.GetTitle()) {
+		doc.terms[t.term] += float64(titleBoost)
+		doc.length += titleBoost
+	}
+	for _, t := range tokenize(blog.GetContent()) {
+		doc.terms[t.term]++
+		doc.length++
+	}
+
+	for term, tf := range doc.terms {
+		if x.postings[term] == nil {
+			x.postings[term] = map[string]float64{}
+		}
+		x.postings[term][blog.GetId()] = tf
+	}
+	x.docs[blog.GetId()] = doc
+	x.length += doc.length
+}
+
+// delete drops a deleted blog from the index. Unlike put, it doesn't need the blog's version,
+// since the blog is gone either way. A known version still keeps older ones from coming back
+func (x *searchIndex) delete(blog *blogpb.Blog) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.seen(blog)
+	x.remove(blog.GetId())
+}
+
+// seen records a blog's version, and reports whether it's at least as new as any seen before. x.mu must be held
+func (x *searchIndex) seen(blog *blogpb.Blog) bool {
+	if newest, ok := x.versions[blog.GetId()]; ok && newest > blog.GetVersion() {
+		return false
+	}
+	x.versions[blog.GetId()] = blog.GetVersion()
+	return true
+}
+
+// remove drops a blog from the index. x.mu must be held
+func (x *searchIndex) remove(blogID string) {
+	doc, ok := x.docs[blogID]
+	if !ok {
+		return
+	}
+	for term := range doc.terms {
+		delete(x.postings[term], blogID)
+		if len(x.postings[term]) == 0 {
+			delete(x.postings, term)
+		}
+	}
+	delete(x.docs, blogID)
+	x.length -= doc.length
+}
+
+// search returns every blog matching at least one of the query terms, best match first
+func (x *searchIndex) search(query string) []searchResult {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+
+	if len(x.docs) == 0 {
+		return nil
+	}
+	n := float64(len(x.docs))
+	avgLength := float64(x.length) / n
+
+	scores := map[string]float64{}
+	for _, term := range queryTerms(query) {
+		postings := x.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for blogID, tf := range postings {
+			norm := 1 - bm25B + bm25B*float64(x.docs[blogID].length)/avgLength
+			scores[blogID] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	results := make([]searchResult, 0, len(scores))
+	for blogID, score := range scores {
+		results = append(results, searchResult{blog: cloneBlog(x.docs[blogID].blog), score: score})
+	}
+	// Ties go by ID, so pages don't shuffle between calls
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].blog.GetId() < results[j].blog.GetId()
+	})
+	return results
+}
+
+// rebuild indexes every blog in the store from scratch
+func (x *searchIndex) rebuild(ctx context.Context, store BlogStore) (int, error) {
+	fresh := newSearchIndex()
+	_, err := store.List(ctx, ListOptions{}, func(blog *blogpb.Blog) error {
+		fresh.put(blog)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.docs, x.postings, x.length, x.versions = fresh.docs, fresh.postings, fresh.length, fresh.versions
+	return len(x.docs), nil
+}
+
+// token is a term along with where it was found, as byte offsets into the text
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower case words. Anything that isn't a letter or a digit separates words
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// queryTerms returns the distinct terms of a query
+func queryTerms(query string) []string {
+	var terms []string
+	seen := map[string]bool{}
+	for _, t := range tokenize(query) {
+		if !seen[t.term] {
+			seen[t.term] = true
+			terms = append(terms, t.term)
+		}
+	}
+	return terms
+}
+
+// highlight wraps the query terms found in text in <em></em>. The rest of the text is HTML escaped
+func highlight(text string, terms []string) string {
+	return highlightRange(text, terms, 0, len(text))
+}
+
+// snippet returns an excerpt of text, about snippetLength bytes long, around the first query term found in it.
+// Query terms are highlighted. Starts at the beginning of text if none of them are in it.
+func snippet(text string, terms []string) string {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return ""
+	}
+
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+	first := 0
+	for i, t := range tokens {
+		if wanted[t.term] {
+			first = i
+			break
+		}
+	}
+
+	// Give the match a bit of lead in, then take whole words until the snippet is long enough
+	from := first
+	for from > 0 && tokens[first].start-tokens[from-1].start < snippetLength/4 {
+		from--
+	}
+	to := first
+	for to+1 < len(tokens) && tokens[to+1].end-tokens[from].start <= snippetLength {
+		to++
+	}
+
+	start, end := tokens[from].start, tokens[to].end
+	if from == 0 {
+		start = 0
+	}
+	if to == len(tokens)-1 {
+		end = len(text)
+	}
+	excerpt := highlightRange(text, terms, start, end)
+	if start > 0 {
+		excerpt = "…" + excerpt
+	}
+	if end < len(text) {
+		excerpt += "…"
+	}
+	return excerpt
+}
+
+// highlightRange highlights text[start:end], see highlight
+func highlightRange(text string, terms []string, start, end int) string {
+	wanted := map[string]bool{}
+	for _, term := range terms {
+		wanted[term] = true
+	}
+
+	var b strings.Builder
+	at := start
+	for _, t := range tokenize(text) {
+		if t.start < start || t.end > end || !wanted[t.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[at:t.start]))
+		b.WriteString("<em>")
+		b.WriteString(html.EscapeString(text[t.start:t.end]))
+		b.WriteString("</em>")
+		at = t.end
+	}
+	b.WriteString(html.EscapeString(text[at:end]))
+	return b.String()
+}
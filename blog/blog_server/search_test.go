@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// searchIDs returns the IDs of the blogs matching query, best match first
+func searchIDs(x *searchIndex, query string) []string {
+	var ids []string
+	for _, result := range x.search(query) {
+		ids = append(ids, result.blog.GetId())
+	}
+	return ids
+}
+
+func TestSearchRanking(t *testing.T) {
+	x := newSearchIndex()
+	for _, blog := range []*blogpb.Blog{
+		{Id: "title", Title: "Gophers", Content: "All about burrowing animals"},
+		{Id: "once", Title: "Animals", Content: "A gopher digs, and so do others"},
+		{Id: "twice", Title: "Animals", Content: "A gopher digs. Another gopher digs too"},
+		{Id: "long", Title: "Animals", Content: "A gopher, and a whole lot of words about every other animal there is, badgers and moles and voles"},
+		{Id: "none", Title: "Birds", Content: "Nothing that digs here"},
+	} {
+		x.put(blog)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{query: "gopher", want: []string{"twice", "once", "long"}},                  // More often beats less often, shorter beats longer
+		{query: "gophers", want: []string{"title"}},                                 // No stemming
+		{query: "GOPHERS!", want: []string{"title"}},                                // Case and punctuation don't matter
+		{query: "gophers gopher", want: []string{"title", "twice", "once", "long"}}, // Title matches count for more
+		{query: "digs birds", want: []string{"none", "twice", "once"}},              // Rare terms count for more than common ones
+		{query: "moles", want: []string{"long"}},
+		{query: "cats", want: nil},
+		{query: "", want: nil},
+	}
+	for _, tt := range tests {
+		if got := searchIDs(x, tt.query); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("search(%q) = %v, want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestSearchTiesGoByID(t *testing.T) {
+	x := newSearchIndex()
+	for _, id := range []string{"c", "a", "b"} {
+		x.put(&blogpb.Blog{Id: id, Title: "same"})
+	}
+	if got := searchIDs(x, "same"); fmt.Sprint(got) != "[a b c]" {
+		t.Errorf("search with equal scores = %v, want [a b c]", got)
+	}
+}
+
+func TestSearchIndexPut(t *testing.T) {
+	tests := []struct {
+		name   string
+		update *blogpb.Blog
+		want   []string // Results for "first", then "second"
+	}{
+		{name: "newer version", update: &blogpb.Blog{Id: "a", Title: "second", Version: 2}, want: []string{"", "a"}},
+		{name: "same version again", update: &blogpb.Blog{Id: "a", Title: "second", Version: 1}, want: []string{"", "a"}},
+		{name: "older version", update: &blogpb.Blog{Id: "a", Title: "second", Version: 0}, want: []string{"a", ""}},
+		{name: "unpublished", update: &blogpb.Blog{Id: "a", Title: "second", Version: 2, State: blogpb.Blog_DRAFT}, want: []string{"", ""}},
+		{name: "deleted", update: &blogpb.Blog{Id: "a", Title: "second", Version: 2, DeleteTime: ptypes.TimestampNow()}, want: []string{"", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := newSearchIndex()
+			x.put(&blogpb.Blog{Id: "a", Title: "first", Version: 1})
+			x.put(tt.update)
+			for i, query := range []string{"first", "second"} {
+				got := ""
+				if ids := searchIDs(x, query); len(ids) > 0 {
+					got = ids[0]
+				}
+				if got != tt.want[i] {
+					t.Errorf("search(%q) = %q, want %q", query, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSearchIndexFollowsEvents(t *testing.T) {
+	b := newEventBroker()
+	x := newSearchIndex()
+	b.listen(x.apply)
+
+	b.publish(blogpb.BlogEvent_CREATED, &blogpb.Blog{Id: "a", Title: "elsewhere", Version: 1})
+	if got := searchIDs(x, "elsewhere"); fmt.Sprint(got) != "[a]" {
+		t.Errorf("search after CREATED = %v, want [a]", got)
+	}
+	b.publish(blogpb.BlogEvent_DELETED, &blogpb.Blog{Id: "a"}) // What Delete was passed, if it couldn't be read back
+	if got := searchIDs(x, "elsewhere"); len(got) != 0 {
+		t.Errorf("search after DELETED = %v, want nothing", got)
+	}
+	b.publish(blogpb.BlogEvent_UNDELETED, &blogpb.Blog{Id: "a", Title: "elsewhere", Version: 3})
+	if got := searchIDs(x, "elsewhere"); fmt.Sprint(got) != "[a]" {
+		t.Errorf("search after UNDELETED = %v, want [a]", got)
+	}
+}
+
+func TestSearchIndexIgnoresReplays(t *testing.T) {
+	published := &blogpb.Blog{Id: "a", Title: "replayed", Version: 2, State: blogpb.Blog_PUBLISHED}
+	tests := []struct {
+		name    string
+		removed *blogpb.BlogEvent // Takes published out of the index, before it gets replayed
+	}{
+		{name: "archived", removed: &blogpb.BlogEvent{Type: blogpb.BlogEvent_UPDATED, Blog: &blogpb.Blog{Id: "a", Title: "replayed", Version: 3, State: blogpb.Blog_ARCHIVED}}},
+		{name: "deleted", removed: &blogpb.BlogEvent{Type: blogpb.BlogEvent_DELETED, Blog: &blogpb.Blog{Id: "a", Version: 3, DeleteTime: ptypes.TimestampNow()}}},
+	}
+	for _, tt := range tests {
+		x := newSearchIndex()
+		x.apply(&blogpb.BlogEvent{Type: blogpb.BlogEvent_UPDATED, Blog: published})
+		x.apply(tt.removed)
+		x.apply(&blogpb.BlogEvent{Type: blogpb.BlogEvent_UPDATED, Blog: published}) // DynamoDB Streams delivering it again
+		if got := searchIDs(x, "replayed"); len(got) != 0 {
+			t.Errorf("%v, then the published version replayed: search = %v, want nothing", tt.name, got)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	saved := snippetLength
+	snippetLength = 40
+	defer func() { snippetLength = saved }()
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{text: "Gophers <3 Go", want: "<em>Gophers</em> &lt;3 Go"},
+		{text: "one two three four five gopher six seven eight", want: "…five <em>gopher</em> six seven eight"},
+		{text: "no match at all in this text, which goes on for a while", want: "no match at all in this text, which goes…"},
+		{text: "...", want: ""},
+	}
+	for _, tt := range tests {
+		if got := snippet(tt.text, []string{"gopher", "gophers"}); got != tt.want {
+			t.Errorf("snippet(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
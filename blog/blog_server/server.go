@@ -3,59 +3,72 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
-	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/Kaurin/gRPC/internal/bootstrap"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/aws/awserr"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+	"github.com/golang/protobuf/ptypes"
 	uuid "github.com/satori/go.uuid"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
 )
 
-var ddbClient *dynamodb.Client
-
 var blogTable = "blogTable" // Name of the DDB table
 
-type server struct{}
+var blogRevisionTable = "blogRevisionTable" // Name of the DDB table holding previous versions of blogs
 
-func (*server) CreateBlog(ctx context.Context, req *blogpb.CreateBlogRequest) (*blogpb.CreateBlogResponse, error) {
-	log.Printf("Started 'CreateBlog' func with the following input: %v", req)
+var blogCommentTable = "blogCommentTable" // Name of the DDB table holding comments on blogs
 
-	blogID := uuid.NewV4()
-	blog := req.GetBlog()
-	blog.Id = blogID.String()
+var maxBatchSize = 100 // Most items a batch RPC takes. Keeps a single call from tying up the store for too long
 
-	av, err := dynamodbattribute.MarshalMap(blog) // From DDB docos. You can marshal arbitrary structs as long as the ID format matches!
-	if err != nil {
-		panic(fmt.Sprintf("failed to DynamoDB marshal Record, %v", err))
-	}
+var importBatchSize = 25 // Blogs ImportBlogs buffers before writing them. One DDB BatchWriteItem worth
 
-	ddbInput := &dynamodb.PutItemInput{
-		TableName: &blogTable,
-		Item:      av,
-	}
+var maxImportIssues = 100 // Most skipped (and failed) blogs ImportBlogs lists reasons for. The counts include all of them
+
+var defaultSearchPageSize = 10 // Hits SearchBlogs returns when the client doesn't say
 
-	ddbReq := ddbClient.PutItemRequest(ddbInput)
+var maxSearchPageSize = 100
 
-	_, ddbErr := ddbReq.Send(context.Background()) // DDB Response is empty on success (or just gives API request ID). Discarding.
-	if ddbErr != nil {
+var defaultRetention = 30 * 24 * time.Hour // How long deleted blogs can be undeleted, unless BLOGRETENTION says otherwise
+
+type server struct {
+	store     BlogStore
+	retention time.Duration // How long a deleted blog is kept around for UndeleteBlog. 0 keeps it forever
+	events    *eventBroker  // Where WatchBlogs gets blog changes from
+	index     *searchIndex  // What SearchBlogs searches
+
+	authenticate bool // Stamp author_id with the caller's JWT subject, and only let authors change their own blogs
+}
+
+func (s *server) CreateBlog(ctx context.Context, req *blogpb.CreateBlogRequest) (*blogpb.CreateBlogResponse, error) {
+	log.Printf("Started 'CreateBlog' func with the following input: %v", req)
+
+	author, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+	blog := newBlog(req.GetBlog(), author)
+
+	if err := s.store.Create(ctx, blog); err != nil {
 		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
 			codes.Internal,
-			fmt.Sprintf("Could not send to DynamoDB: %v", ddbErr),
+			fmt.Sprintf("Could not store Blog: %v", err),
 		)
 	}
-	log.Printf("Successfully written to DDB!")
 
 	log.Printf("Finished 'CreateBlog'. Returning (wrapped in a response struct): %v", blog)
 	return &blogpb.CreateBlogResponse{
@@ -63,217 +76,988 @@ func (*server) CreateBlog(ctx context.Context, req *blogpb.CreateBlogRequest) (*
 	}, nil
 }
 
-func (*server) ReadBlog(ctx context.Context, req *blogpb.ReadBlogRequest) (*blogpb.ReadBlogResponse, error) {
+func (s *server) ReadBlog(ctx context.Context, req *blogpb.ReadBlogRequest) (*blogpb.ReadBlogResponse, error) {
 	log.Printf("Started 'ReadBlog' func with the following input: %v", req)
 
 	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
 
-	// Check UUID for errors
-	_, uuidErr := uuid.FromString(blogID)
-	if uuidErr != nil {
+	blog, err := s.store.Read(ctx, blogID)
+	if err == errBlogNotFound || (err == nil && isDeleted(blog) && !req.GetShowDeleted()) {
 		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-			codes.InvalidArgument,
-			fmt.Sprintf("Blog ID Provided does not match UUIDv4 format: %v", uuidErr),
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
 		)
 	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not get Blog: %v", err),
+		)
+	}
+	log.Printf("Finished 'ReadBlog'. Returning (wrapped in a response struct): %v", blog)
 
-	// Craft DDB request input
-	ddbInput := &dynamodb.GetItemInput{
-		Key: map[string]dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(blogID),
-			},
-		},
-		TableName: aws.String(blogTable),
+	return &blogpb.ReadBlogResponse{
+		Blog: blog,
+	}, nil
+
+}
+
+func (s *server) UpdateBlog(ctx context.Context, req *blogpb.UpdateBlogRequest) (*blogpb.UpdateBlogResponse, error) {
+	log.Printf("Started 'UpdateBlog' func with the following input: %v", req)
+
+	blog := req.GetBlog()
+	if err := checkBlogID(blog.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blog.GetId()); err != nil {
+		return nil, err
 	}
+	if author, _ := s.caller(ctx); author != "" {
+		blog.AuthorId = author // Authors can't hand their blogs over to somebody else
+	}
+
+	blog.UpdateTime = ptypes.TimestampNow() // Server managed. Whatever the client sent is ignored
 
-	// Perform DDB Request
-	ddbReq := ddbClient.GetItemRequest(ddbInput)
-	ddbResp, ddbErr := ddbReq.Send(context.Background())
-	if ddbErr != nil {
+	tags := TagChanges{
+		Add:    normalizeTags(req.GetAddTags()),
+		Remove: normalizeTags(req.GetRemoveTags()),
+	}
+	removing := map[string]bool{}
+	for _, tag := range tags.Remove {
+		removing[tag] = true
+	}
+	for _, tag := range tags.Add {
+		if removing[tag] {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Tag can't be both added and removed: %q", tag),
+			)
+		}
+	}
+
+	// No mask means a full update, like before FieldMask support. Unless it's only about tags
+	paths := updatableFields
+	if !tags.empty() {
+		paths = nil
+	}
+	if mask := req.GetUpdateMask().GetPaths(); len(mask) > 0 {
+		paths = nil
+		seen := map[string]bool{}
+		for _, path := range mask {
+			if !isUpdatableField(path) {
+				return nil, status.Errorf(
+					codes.InvalidArgument,
+					fmt.Sprintf("Field can't be updated: %q. Updatable fields are: %v", path, updatableFields),
+				)
+			}
+			if !seen[path] { // DDB rejects an update expression that names the same attribute twice
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+
+	blog, err := s.store.Update(ctx, blog, paths, tags, req.GetExpectedVersion())
+	if err == errBlogNotFound {
 		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
+			codes.FailedPrecondition,
+			fmt.Sprintf("Could not update Blog. Blog does not exist: %v", req.GetBlog().GetId()),
+		)
+	}
+	if err == errVersionMismatch {
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Could not update Blog. Blog is no longer at version %v. Read it again and retry", req.GetExpectedVersion()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
 			codes.Internal,
-			fmt.Sprintf("Could not get Blog from DynamoDB: %v", ddbErr),
+			fmt.Sprintf("Could not update Blog: %v", err),
 		)
 	}
 
-	blog := &blogpb.Blog{}
-	dynamodbattribute.UnmarshalMap(ddbResp.Item, blog)
+	log.Printf("Finished 'UpdateBlog'. Returning (wrapped in a response struct): %v", blog)
+	return &blogpb.UpdateBlogResponse{
+		Blog: blog,
+	}, nil
+}
+
+func (s *server) DeleteBlog(ctx context.Context, req *blogpb.DeleteBlogRequest) (*blogpb.DeleteBlogResponse, error) {
+	log.Printf("Started 'DeleteBlog' func with the following input: %v", req)
 
-	// NOT FOUND error
-	if blog.GetId() == "" {
+	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blogID); err != nil {
+		return nil, err
+	}
+
+	err := s.store.Delete(ctx, s.deletedBlog(blogID), req.GetExpectedVersion())
+	if err == errBlogNotFound {
 		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
 			codes.NotFound,
-			fmt.Sprintf("Could not find Blog from DynamoDB for key: %v", blogID),
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
 		)
 	}
-	log.Printf("Finished 'ReadBlog'. Returning (wrapped in a response struct): %v", blog)
+	if err == errVersionMismatch {
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Could not delete Blog. Blog is no longer at version %v. Read it again and retry", req.GetExpectedVersion()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not delete Blog: %v", err),
+		)
+	}
+	log.Printf("Finished 'DeleteBlog' for key: %v", blogID)
 
-	return &blogpb.ReadBlogResponse{
+	return &blogpb.DeleteBlogResponse{
+		BlogId: blogID,
+	}, nil
+}
+
+func (s *server) UndeleteBlog(ctx context.Context, req *blogpb.UndeleteBlogRequest) (*blogpb.UndeleteBlogResponse, error) {
+	log.Printf("Started 'UndeleteBlog' func with the following input: %v", req)
+
+	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blogID); err != nil {
+		return nil, err
+	}
+
+	blog, err := s.store.Undelete(ctx, blogID)
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key (it may have expired): %v", blogID),
+		)
+	}
+	if err == errBlogNotDeleted {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Could not undelete Blog. Blog is not deleted: %v", blogID),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not undelete Blog: %v", err),
+		)
+	}
+	log.Printf("Finished 'UndeleteBlog'. Returning (wrapped in a response struct): %v", blog)
+
+	return &blogpb.UndeleteBlogResponse{
 		Blog: blog,
 	}, nil
+}
+
+func (s *server) ListBlogRevisions(ctx context.Context, req *blogpb.ListBlogRevisionsRequest) (*blogpb.ListBlogRevisionsResponse, error) {
+	log.Printf("Started 'ListBlogRevisions' func with the following input: %v", req)
+
+	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+
+	revisions, err := s.store.ListRevisions(ctx, blogID)
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not list Blog revisions: %v", err),
+		)
+	}
+	log.Printf("Finished 'ListBlogRevisions'. Returning %v revisions for key: %v", len(revisions), blogID)
 
+	return &blogpb.ListBlogRevisionsResponse{
+		Revisions: revisions,
+	}, nil
 }
 
-// TODO: Fails when updating with empty strings. Read through the DDB docos to see how to handle that.
-// Maybe just use `PutItem` with the attribute condition? Not sure if possible
-func (*server) UpdateBlog(ctx context.Context, req *blogpb.UpdateBlogRequest) (*blogpb.UpdateBlogResponse, error) {
-	log.Printf("Started 'UpdateBlog' func with the following input: %v", req)
+func (s *server) RestoreBlogRevision(ctx context.Context, req *blogpb.RestoreBlogRevisionRequest) (*blogpb.RestoreBlogRevisionResponse, error) {
+	log.Printf("Started 'RestoreBlogRevision' func with the following input: %v", req)
 
-	ddbCondition := "attribute_exists(id)" // Only update if ID existed in DDB table.
+	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blogID); err != nil {
+		return nil, err
+	}
 
-	blog := req.GetBlog()
-	blogID := blog.GetId()
-	blogAuthor := blog.GetAuthorId()
-	blogContent := blog.GetContent()
-	blogTitle := blog.GetTitle()
-
-	// Check UUID for errors
-	_, uuidErr := uuid.FromString(blogID)
-	if uuidErr != nil {
-		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-			codes.InvalidArgument,
-			fmt.Sprintf("Blog ID Provided does not match UUIDv4 format: %v", uuidErr),
+	revision, err := s.store.ReadRevision(ctx, blogID, req.GetVersion())
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog, or it is deleted: %v", blogID),
+		)
+	}
+	if err == errRevisionNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find revision %v of Blog: %v", req.GetVersion(), blogID),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not get Blog revision: %v", err),
 		)
 	}
 
-	// Craft DDB request input
-	// Unfortunately, can't use dynamodb. marshal/unmarshal here :(
-	input := &dynamodb.UpdateItemInput{
-		ConditionExpression: aws.String(ddbCondition), // Only update if ID existed in DDB table.
-		ExpressionAttributeNames: map[string]string{
-			"#A": "author_id",
-			"#C": "content",
-			"#T": "title",
-		},
-		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
-			":a": {
-				S: aws.String(blogAuthor),
-			},
-			":c": {
-				S: aws.String(blogContent),
-			},
-			":t": {
-				S: aws.String(blogTitle),
-			},
-		},
-		Key: map[string]dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(blog.GetId()),
-			},
-		},
-		ReturnValues:     dynamodb.ReturnValueUpdatedOld,
-		TableName:        aws.String(blogTable),
-		UpdateExpression: aws.String("SET #A = :a, #C = :c, #T = :t"),
-	}
-
-	// Perform DDB Request
-	ddbReq := ddbClient.UpdateItemRequest(input)
-	ddbResp, ddbErr := ddbReq.Send(context.Background())
-	if ddbErr != nil {
-		if aerr, ok := ddbErr.(awserr.Error); ok {
-			switch aerr.Code() {
-			case dynamodb.ErrCodeConditionalCheckFailedException:
-				return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-					codes.FailedPrecondition,
-					fmt.Sprintf("Could not update Blog in DynamoDB. Failed DynamoDB PutItem Conditional: %v", ddbCondition),
-				)
-			default:
-				return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-					codes.Internal,
-					fmt.Sprintf("Could not update Blog in DynamoDB: %v", ddbErr),
-				)
-			}
-		} else {
-			return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-				codes.Internal,
-				fmt.Sprintf("Could not update Blog in DynamoDB: %v", ddbErr),
+	// Restoring is just another update, so the current content becomes a revision too and nothing is lost
+	revision.UpdateTime = ptypes.TimestampNow()
+	if author, _ := s.caller(ctx); author != "" {
+		revision.AuthorId = author // Revisions from before authentication may have anyone's
+	}
+	blog, err := s.store.Update(ctx, revision, updatableFields, TagChanges{}, req.GetExpectedVersion())
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Could not restore Blog revision. Blog does not exist or is deleted: %v", blogID),
+		)
+	}
+	if err == errVersionMismatch {
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Could not restore Blog revision. Blog is no longer at version %v. Read it again and retry", req.GetExpectedVersion()),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not restore Blog revision: %v", err),
+		)
+	}
+	log.Printf("Finished 'RestoreBlogRevision'. Returning (wrapped in a response struct): %v", blog)
+
+	return &blogpb.RestoreBlogRevisionResponse{
+		Blog: blog,
+	}, nil
+}
+
+func (s *server) PublishBlog(ctx context.Context, req *blogpb.PublishBlogRequest) (*blogpb.PublishBlogResponse, error) {
+	log.Printf("Started 'PublishBlog' func with the following input: %v", req)
+
+	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blogID); err != nil {
+		return nil, err
+	}
+
+	// Publish now, unless asked to do it later. Then it stays a draft until the publish worker gets to it
+	blog := &blogpb.Blog{
+		Id:         blogID,
+		State:      blogpb.Blog_PUBLISHED,
+		UpdateTime: ptypes.TimestampNow(),
+	}
+	blog.PublishTime = blog.GetUpdateTime()
+	from := []blogpb.Blog_State{blogpb.Blog_DRAFT, blogpb.Blog_ARCHIVED}
+	if req.GetPublishTime() != nil {
+		publishTime, err := ptypes.Timestamp(req.GetPublishTime())
+		if err != nil {
+			return nil, status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Invalid publish time: %v", err),
 			)
 		}
+		if publishTime.After(time.Now()) {
+			blog.State = blogpb.Blog_DRAFT
+			blog.PublishTime = req.GetPublishTime()
+			from = []blogpb.Blog_State{blogpb.Blog_DRAFT}
+		}
 	}
 
-	log.Printf("Old values: %s", strings.ReplaceAll(ddbResp.String(), "\n", ""))
+	blog, err := s.store.SetState(ctx, blog, from, req.GetExpectedVersion())
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
+		)
+	}
+	if err == errVersionMismatch {
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Could not publish Blog. Blog is no longer at version %v. Read it again and retry", req.GetExpectedVersion()),
+		)
+	}
+	if err == errInvalidStateChange {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Could not publish Blog. Only drafts can be scheduled, and only drafts and archived blogs published: %v", blogID),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not publish Blog: %v", err),
+		)
+	}
+	log.Printf("Finished 'PublishBlog'. Returning (wrapped in a response struct): %v", blog)
 
-	log.Printf("Finished 'UpdateBlog'. Returning (wrapped in a response struct): %v", blog)
-	return &blogpb.UpdateBlogResponse{
+	return &blogpb.PublishBlogResponse{
 		Blog: blog,
 	}, nil
 }
 
-func (*server) DeleteBlog(ctx context.Context, req *blogpb.DeleteBlogRequest) (*blogpb.DeleteBlogResponse, error) {
-	log.Printf("Started 'DeleteBlog' func with the following input: %v", req)
+func (s *server) ArchiveBlog(ctx context.Context, req *blogpb.ArchiveBlogRequest) (*blogpb.ArchiveBlogResponse, error) {
+	log.Printf("Started 'ArchiveBlog' func with the following input: %v", req)
 
 	blogID := req.GetBlogId()
+	if err := checkBlogID(blogID); err != nil {
+		return nil, err
+	}
+	if err := s.checkAuthor(ctx, blogID); err != nil {
+		return nil, err
+	}
 
-	// Check UUID for errors
-	_, uuidErr := uuid.FromString(blogID)
-	if uuidErr != nil {
-		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
+	blog := &blogpb.Blog{
+		Id:         blogID,
+		State:      blogpb.Blog_ARCHIVED,
+		UpdateTime: ptypes.TimestampNow(),
+	}
+	blog, err := s.store.SetState(ctx, blog, []blogpb.Blog_State{blogpb.Blog_PUBLISHED}, req.GetExpectedVersion())
+	if err == errBlogNotFound {
+		return nil, status.Errorf(
+			codes.NotFound,
+			fmt.Sprintf("Could not find Blog for key: %v", blogID),
+		)
+	}
+	if err == errVersionMismatch {
+		return nil, status.Errorf(
+			codes.Aborted,
+			fmt.Sprintf("Could not archive Blog. Blog is no longer at version %v. Read it again and retry", req.GetExpectedVersion()),
+		)
+	}
+	if err == errInvalidStateChange {
+		return nil, status.Errorf(
+			codes.FailedPrecondition,
+			fmt.Sprintf("Could not archive Blog. Only published blogs can be archived: %v", blogID),
+		)
+	}
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not archive Blog: %v", err),
+		)
+	}
+	log.Printf("Finished 'ArchiveBlog'. Returning (wrapped in a response struct): %v", blog)
+
+	return &blogpb.ArchiveBlogResponse{
+		Blog: blog,
+	}, nil
+}
+
+func (s *server) BatchCreateBlogs(ctx context.Context, req *blogpb.BatchCreateBlogsRequest) (*blogpb.BatchCreateBlogsResponse, error) {
+	log.Printf("Started 'BatchCreateBlogs' func with %v blogs", len(req.GetBlogs()))
+
+	if err := checkBatchSize(len(req.GetBlogs())); err != nil {
+		return nil, err
+	}
+	author, err := s.caller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blogs := make([]*blogpb.Blog, len(req.GetBlogs()))
+	for i, blog := range req.GetBlogs() {
+		if blog == nil {
+			blog = &blogpb.Blog{}
+		}
+		blogs[i] = newBlog(blog, author)
+	}
+
+	errs := s.store.BatchCreate(ctx, blogs)
+
+	results := make([]*blogpb.BatchCreateBlogsResponse_Result, len(blogs))
+	for i, blog := range blogs {
+		if errs[i] != nil {
+			results[i] = &blogpb.BatchCreateBlogsResponse_Result{
+				Status: batchStatus(batchError(errs[i], blog.GetId())),
+			}
+			continue
+		}
+		results[i] = &blogpb.BatchCreateBlogsResponse_Result{Blog: blog}
+	}
+
+	log.Printf("Finished 'BatchCreateBlogs'. Returning %v results", len(results))
+	return &blogpb.BatchCreateBlogsResponse{
+		Results: results,
+	}, nil
+}
+
+func (s *server) BatchGetBlogs(ctx context.Context, req *blogpb.BatchGetBlogsRequest) (*blogpb.BatchGetBlogsResponse, error) {
+	log.Printf("Started 'BatchGetBlogs' func with the following input: %v", req)
+
+	blogIDs := req.GetBlogIds()
+	if err := checkBatchSize(len(blogIDs)); err != nil {
+		return nil, err
+	}
+
+	results := make([]*blogpb.BatchGetBlogsResponse_Result, len(blogIDs))
+	var valid []string // Only bother the store with IDs that can exist
+	var positions []int
+	for i, blogID := range blogIDs {
+		results[i] = &blogpb.BatchGetBlogsResponse_Result{BlogId: blogID}
+		if err := checkBlogID(blogID); err != nil {
+			results[i].Status = batchStatus(err)
+			continue
+		}
+		valid = append(valid, blogID)
+		positions = append(positions, i)
+	}
+
+	blogs, errs := s.store.BatchRead(ctx, valid)
+	for j, i := range positions {
+		err := errs[j]
+		if err == nil && isDeleted(blogs[j]) && !req.GetShowDeleted() {
+			err = errBlogNotFound
+		}
+		if err != nil {
+			results[i].Status = batchStatus(batchError(err, valid[j]))
+			continue
+		}
+		results[i].Blog = blogs[j]
+	}
+
+	log.Printf("Finished 'BatchGetBlogs'. Returning %v results", len(results))
+	return &blogpb.BatchGetBlogsResponse{
+		Results: results,
+	}, nil
+}
+
+func (s *server) BatchDeleteBlogs(ctx context.Context, req *blogpb.BatchDeleteBlogsRequest) (*blogpb.BatchDeleteBlogsResponse, error) {
+	log.Printf("Started 'BatchDeleteBlogs' func with the following input: %v", req)
+
+	blogIDs := req.GetBlogIds()
+	if err := checkBatchSize(len(blogIDs)); err != nil {
+		return nil, err
+	}
+	if _, err := s.caller(ctx); err != nil {
+		return nil, err
+	}
+
+	results := make([]*blogpb.BatchDeleteBlogsResponse_Result, len(blogIDs))
+	var deleted []*blogpb.Blog
+	var positions []int
+	seen := map[string]bool{}
+	for i, blogID := range blogIDs {
+		results[i] = &blogpb.BatchDeleteBlogsResponse_Result{BlogId: blogID}
+		if err := checkBlogID(blogID); err != nil {
+			results[i].Status = batchStatus(err)
+			continue
+		}
+		if seen[blogID] { // Deleting twice would fail anyway, and the stores want unique IDs
+			results[i].Status = batchStatus(status.Errorf(
+				codes.InvalidArgument,
+				fmt.Sprintf("Blog ID listed more than once: %v", blogID),
+			))
+			continue
+		}
+		seen[blogID] = true
+		if err := s.checkAuthor(ctx, blogID); err != nil {
+			results[i].Status = batchStatus(err)
+			continue
+		}
+		deleted = append(deleted, s.deletedBlog(blogID))
+		positions = append(positions, i)
+	}
+
+	errs := s.store.BatchDelete(ctx, deleted)
+	for j, i := range positions {
+		if errs[j] != nil {
+			results[i].Status = batchStatus(batchError(errs[j], deleted[j].GetId()))
+		}
+	}
+
+	log.Printf("Finished 'BatchDeleteBlogs'. Returning %v results", len(results))
+	return &blogpb.BatchDeleteBlogsResponse{
+		Results: results,
+	}, nil
+}
+
+func (s *server) ImportBlogs(stream blogpb.BlogService_ImportBlogsServer) error {
+	log.Printf("Started 'ImportBlogs' client streaming func")
+
+	author, err := s.caller(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	summary := &blogpb.ImportBlogSummary{}
+	skip := func(index int64, sourceID, reason string) {
+		summary.Skipped++
+		if len(summary.Skips) < maxImportIssues {
+			summary.Skips = append(summary.Skips, &blogpb.ImportBlogIssue{Index: index, SourceId: sourceID, Reason: reason})
+		}
+	}
+	fail := func(index int64, sourceID, reason string) {
+		summary.Failed++
+		if len(summary.Failures) < maxImportIssues {
+			summary.Failures = append(summary.Failures, &blogpb.ImportBlogIssue{Index: index, SourceId: sourceID, Reason: reason})
+		}
+	}
+
+	// Blogs waiting to be written, and where they came from in the stream
+	var blogs []*blogpb.Blog
+	var indexes []int64
+	var sourceIDs []string
+	flush := func() {
+		if len(blogs) == 0 {
+			return
+		}
+		for i, err := range s.store.BatchCreate(stream.Context(), blogs) {
+			if err != nil {
+				fail(indexes[i], sourceIDs[i], err.Error())
+				continue
+			}
+			summary.Created++
+		}
+		blogs, indexes, sourceIDs = nil, nil, nil
+	}
+
+	seen := map[string]bool{} // Source IDs imported so far
+	for index := int64(0); ; index++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			flush()
+			log.Printf("Finished 'ImportBlogs'. Created: %v, skipped: %v, failed: %v", summary.GetCreated(), summary.GetSkipped(), summary.GetFailed())
+			return stream.SendAndClose(summary)
+		}
+		if err != nil {
+			// Whatever was flushed so far stays imported
+			log.Printf("'ImportBlogs' stopped after %v blogs. Created: %v", index, summary.GetCreated())
+			return fmt.Errorf("Failed to recieve message from stream: %v", err)
+		}
+
+		blog, sourceID := req.GetBlog(), req.GetSourceId()
+		if blog.GetTitle() == "" && blog.GetContent() == "" {
+			skip(index, sourceID, "Blog has no title and no content")
+			continue
+		}
+		if sourceID != "" {
+			if seen[sourceID] {
+				skip(index, sourceID, "Source ID was already imported earlier in the stream")
+				continue
+			}
+			seen[sourceID] = true
+		}
+
+		blogs = append(blogs, newBlog(blog, author))
+		indexes = append(indexes, index)
+		sourceIDs = append(sourceIDs, sourceID)
+		if len(blogs) == importBatchSize {
+			flush()
+		}
+	}
+}
+
+func (s *server) WatchBlogs(stream blogpb.BlogService_WatchBlogsServer) error {
+	log.Printf("Started 'WatchBlogs' BiDi streaming func")
+
+	// The first request says where to start from
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("'WatchBlogs' got the following input: %v", req)
+
+	sub, backlog, startToken, err := s.events.subscribe(req.GetResumeToken())
+	if err == errInvalidResumeToken {
+		return status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Could not watch Blogs: %v", err),
+		)
+	}
+	if err == errResumeTooOld {
+		return status.Errorf(codes.OutOfRange,
+			fmt.Sprintf("Could not watch Blogs: %v. List the Blogs again and watch from now on", err),
+		)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal,
+			fmt.Sprintf("Could not watch Blogs: %v", err),
+		)
+	}
+	defer s.events.unsubscribe(sub)
+
+	// Let the client know the watch is in place
+	if err := stream.Send(&blogpb.WatchBlogsResponse{StartToken: startToken}); err != nil {
+		return err
+	}
+
+	// Later requests only change the filter. Recv blocks, so it gets a goroutine of its own
+	authorIDs := make(chan string)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case authorIDs <- req.GetAuthorId():
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	authorID := req.GetAuthorId()
+	send := func(event *blogpb.BlogEvent) error {
+		if authorID != "" && event.GetBlog().GetAuthorId() != authorID {
+			return nil
+		}
+		if event = watcherEvent(event); event == nil {
+			return nil
+		}
+		return stream.Send(&blogpb.WatchBlogsResponse{Event: event})
+	}
+
+	for _, event := range backlog {
+		if err := send(event); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case event, ok := <-sub.events:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted,
+					"Fell too far behind on Blog events. Watch again with the last sequence token to catch up",
+				)
+			}
+			if err := send(event); err != nil {
+				return err
+			}
+		case authorID = <-authorIDs:
+			log.Printf("'WatchBlogs' now filtering on author: %q", authorID)
+		case err := <-recvErr:
+			if err == io.EOF { // Client is done watching
+				log.Printf("Finished 'WatchBlogs'")
+				return nil
+			}
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *server) SearchBlogs(ctx context.Context, req *blogpb.SearchBlogsRequest) (*blogpb.SearchBlogsResponse, error) {
+	log.Printf("Started 'SearchBlogs' func with the following input: %v", req)
+
+	terms := queryTerms(req.GetQuery())
+	if len(terms) == 0 {
+		return nil, status.Errorf(
 			codes.InvalidArgument,
-			fmt.Sprintf("Blog ID Provided does not match UUIDv4 format: %v", uuidErr),
+			fmt.Sprintf("Search query has no words to look for: %q", req.GetQuery()),
 		)
 	}
 
-	// Craft DDB request input
-	ddbInput := &dynamodb.DeleteItemInput{
-		ReturnValues: "ALL_OLD",
-		Key: map[string]dynamodb.AttributeValue{
-			"id": {
-				S: aws.String(blogID),
-			},
-		},
-		TableName: aws.String(blogTable),
+	pageSize := int(req.GetPageSize())
+	if pageSize < 0 {
+		return nil, status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Page size can't be negative: %v", req.GetPageSize()),
+		)
+	}
+	if pageSize == 0 {
+		pageSize = defaultSearchPageSize
+	}
+	if pageSize > maxSearchPageSize {
+		pageSize = maxSearchPageSize
 	}
 
-	// Perform DDB Request
-	ddbReq := ddbClient.DeleteItemRequest(ddbInput)
-	ddbResp, ddbErr := ddbReq.Send(context.Background())
-	if ddbErr != nil {
-		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-			codes.Internal,
-			fmt.Sprintf("Could not get delete from DynamoDB: %v", ddbErr),
+	// The page token is just an offset into the hits. The index can change in between pages, so it's best effort
+	offset := 0
+	key, err := decodePageToken(req.GetPageToken())
+	if err == nil && key != nil {
+		offset, err = strconv.Atoi(key["offset"])
+		if err == nil && (key["query"] != req.GetQuery() || offset < 0) {
+			err = errInvalidPageToken
+		}
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Could not search Blogs: %v", errInvalidPageToken),
 		)
 	}
 
-	// NOT FOUND error
-	if len(ddbResp.Attributes) == 0 {
-		return nil, status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
-			codes.NotFound,
-			fmt.Sprintf("Could not find Blog from DynamoDB for key: %v", blogID),
+	results := s.index.search(req.GetQuery())
+	resp := &blogpb.SearchBlogsResponse{
+		TotalHits: int32(len(results)),
+	}
+	if offset > len(results) {
+		offset = len(results)
+	}
+	end := offset + pageSize
+	if end < len(results) {
+		resp.NextPageToken = encodePageToken(map[string]string{
+			"query":  req.GetQuery(),
+			"offset": strconv.Itoa(end),
+		})
+	} else {
+		end = len(results)
+	}
+
+	for _, result := range results[offset:end] {
+		resp.Hits = append(resp.Hits, &blogpb.SearchHit{
+			Blog:           result.blog,
+			Score:          result.score,
+			TitleHighlight: highlight(result.blog.GetTitle(), terms),
+			Snippet:        snippet(result.blog.GetContent(), terms),
+		})
+	}
+
+	log.Printf("Finished 'SearchBlogs'. Returning %v of %v hits", len(resp.GetHits()), resp.GetTotalHits())
+	return resp, nil
+}
+
+func (s *server) ListTags(ctx context.Context, req *blogpb.ListTagsRequest) (*blogpb.ListTagsResponse, error) {
+	log.Printf("Started 'ListTags' func with the following input: %v", req)
+
+	// Counted on the fly. Fine for a blog, but it does go through every blog each time
+	counts := map[string]int64{}
+	_, err := s.store.List(ctx, ListOptions{AuthorID: req.GetAuthorId()}, func(blog *blogpb.Blog) error {
+		for _, tag := range blog.GetTags() {
+			counts[tag]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not count tags: %v", err),
 		)
 	}
-	log.Printf("Deleted blog from DDB: %s", strings.ReplaceAll(ddbResp.String(), "\n", ""))
 
-	return &blogpb.DeleteBlogResponse{
-		BlogId: blogID,
+	tags := make([]*blogpb.TagCount, 0, len(counts))
+	for tag, count := range counts {
+		tags = append(tags, &blogpb.TagCount{Tag: tag, Count: count})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].GetCount() != tags[j].GetCount() {
+			return tags[i].GetCount() > tags[j].GetCount()
+		}
+		return tags[i].GetTag() < tags[j].GetTag()
+	})
+
+	log.Printf("Finished 'ListTags'. Returning %v tags", len(tags))
+	return &blogpb.ListTagsResponse{
+		Tags: tags,
 	}, nil
 }
 
-func (*server) ListBlog(req *blogpb.ListBlogRequest, stream blogpb.BlogService_ListBlogServer) error {
-	input := &dynamodb.ScanInput{
-		TableName: aws.String(blogTable),
+func (s *server) ListBlog(req *blogpb.ListBlogRequest, stream blogpb.BlogService_ListBlogServer) error {
+	log.Printf("Started 'ListBlog' func with the following input: %v", req)
+
+	if req.GetPageSize() < 0 {
+		return status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Page size can't be negative: %v", req.GetPageSize()),
+		)
 	}
+	opts := ListOptions{
+		PageSize:  int(req.GetPageSize()),
+		PageToken: req.GetPageToken(),
+		AuthorID:  req.GetAuthorId(),
+		Tag:       strings.ToLower(strings.TrimSpace(req.GetTag())),
+		States:    req.GetStates(),
 
-	// Example iterating over pages.
-	ddbReq := ddbClient.ScanRequest(input)
-	p := dynamodb.NewScanPaginator(ddbReq)
+		OrderBy:    req.GetOrderBy(),
+		Descending: req.GetDescending(),
 
-	for p.Next(context.Background()) {
-		page := p.CurrentPage()
-		log.Printf("%v", page)
-		for _, item := range page.Items {
-			blog := &blogpb.Blog{}
-			dynamodbattribute.UnmarshalMap(item, blog)
-			stream.Send(&blogpb.ListBlogResponse{
-				Blog: blog,
-			})
-		}
+		ShowDeleted: req.GetShowDeleted(),
 	}
 
-	if scanErr := p.Err(); scanErr != nil {
-		log.Fatalf("Failed to paginate DynamoDB scan: %v", scanErr)
+	// The next page token is only known once the store is done, but it has to ride along
+	// with the last blog of the page. So always hold one blog back before sending it.
+	var pending *blogpb.Blog
+	nextPageToken, err := s.store.List(stream.Context(), opts, func(blog *blogpb.Blog) error {
+		if err := stream.Context().Err(); err != nil { // Client went away, or the server is shutting down
+			return err
+		}
+		if pending != nil {
+			if err := stream.Send(&blogpb.ListBlogResponse{Blog: pending}); err != nil {
+				return err
+			}
+		}
+		pending = blog
+		return nil
+	})
+	if err == errInvalidPageToken {
+		return status.Errorf(codes.InvalidArgument,
+			fmt.Sprintf("Could not list Blogs: %v", err),
+		)
+	}
+	if err != nil && stream.Context().Err() != nil {
+		return status.Errorf(codes.Unavailable,
+			fmt.Sprintf("Stopped listing Blogs: %v", stream.Context().Err()),
+		)
+	}
+	if err != nil {
 		return status.Errorf(codes.Internal,
-			fmt.Sprintf("Failed to paginate DynamoDB scan: %v", scanErr),
+			fmt.Sprintf("Failed to list Blogs: %v", err),
+		)
+	}
+
+	if pending != nil {
+		return stream.Send(&blogpb.ListBlogResponse{
+			Blog:          pending,
+			NextPageToken: nextPageToken,
+		})
+	}
+	return nil
+}
+
+// newBlog stamps the server managed fields on a blog that's about to be created, and normalizes its tags.
+// Whatever the client sent for the server managed fields is ignored. New blogs are drafts,
+// which the publish worker publishes at publish_time if the client set one.
+// A non-empty author replaces the client's author_id, see server.caller
+func newBlog(blog *blogpb.Blog, author string) *blogpb.Blog {
+	if author != "" {
+		blog.AuthorId = author
+	}
+	blog.Tags = normalizeTags(blog.GetTags())
+	blog.Id = uuid.NewV4().String()
+	blog.Version = 1
+	blog.State = blogpb.Blog_DRAFT
+	blog.CreateTime = ptypes.TimestampNow()
+	blog.UpdateTime = blog.GetCreateTime()
+	blog.DeleteTime = nil
+	blog.ExpireTime = nil
+	return blog
+}
+
+// deletedBlog returns what BlogStore.Delete needs to soft delete a blog.
+// The blog sticks around (hidden) until it expires, in case someone wants it back
+func (s *server) deletedBlog(blogID string) *blogpb.Blog {
+	deleted := &blogpb.Blog{
+		Id:         blogID,
+		DeleteTime: ptypes.TimestampNow(),
+	}
+	if s.retention > 0 {
+		expireTime, _ := ptypes.TimestampProto(time.Now().Add(s.retention)) // Only fails for dates past year 9999
+		deleted.ExpireTime = expireTime
+	}
+	return deleted
+}
+
+// caller returns the subject of the caller's bearer token, which is who gets to be author_id.
+// With authentication, anonymous calls get an Unauthenticated gRPC error. Without it, an mTLS server
+// goes by the subject of the caller's client certificate instead (see peerAuthor), and a plaintext one
+// returns "" so clients say who the author is themselves, like before
+func (s *server) caller(ctx context.Context) (string, error) {
+	if !s.authenticate {
+		return peerAuthor(ctx), nil
+	}
+	subject, ok := auth.Subject(ctx)
+	if !ok {
+		return "", status.Errorf(codes.Unauthenticated, "Changing blogs requires a bearer token")
+	}
+	return subject, nil
+}
+
+// peerAuthor returns the subject of the caller's verified client certificate, e.g. "CN=client", or "" without one
+func peerAuthor(ctx context.Context) string {
+	subject, _ := mtls.PeerSubject(ctx)
+	return subject
+}
+
+// checkAuthor returns a PermissionDenied gRPC error unless the caller wrote the blog, see caller.
+// A blog that doesn't exist passes, so whatever comes next reports NotFound like it would without authentication
+func (s *server) checkAuthor(ctx context.Context, blogID string) error {
+	author, err := s.caller(ctx)
+	if err != nil || author == "" {
+		return err
+	}
+	blog, err := s.store.Read(ctx, blogID)
+	if err == errBlogNotFound {
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(
+			codes.Internal,
+			fmt.Sprintf("Could not read Blog: %v", err),
+		)
+	}
+	if blog.GetAuthorId() != author {
+		return status.Errorf(
+			codes.PermissionDenied,
+			fmt.Sprintf("Blog %v belongs to %v, not %v", blogID, blog.GetAuthorId(), author),
+		)
+	}
+	return nil
+}
+
+// checkBatchSize returns an InvalidArgument gRPC error if a batch RPC got too many items
+func checkBatchSize(size int) error {
+	if size > maxBatchSize {
+		return status.Errorf(
+			codes.InvalidArgument,
+			fmt.Sprintf("Batch has %v items. At most %v are allowed", size, maxBatchSize),
+		)
+	}
+	return nil
+}
+
+// batchError turns the error a BlogStore batch method returned for one item into a gRPC error
+func batchError(err error, blogID string) error {
+	switch err {
+	case errBlogNotFound:
+		return status.Errorf(codes.NotFound, fmt.Sprintf("Could not find Blog for key: %v", blogID))
+	case errBatchIncomplete:
+		return status.Errorf(codes.Unavailable, fmt.Sprintf("Could not process Blog %v: %v", blogID, err))
+	}
+	return status.Errorf(codes.Internal, fmt.Sprintf("Could not process Blog %v: %v", blogID, err))
+}
+
+// batchStatus converts a gRPC error into the per item status of a batch RPC. nil stays nil
+func batchStatus(err error) *blogpb.BatchStatus {
+	if err == nil {
+		return nil
+	}
+	st := status.Convert(err)
+	return &blogpb.BatchStatus{
+		Code:    int32(st.Code()),
+		Message: st.Message(),
+	}
+}
+
+// isUpdatableField reports whether a FieldMask path names one of the updatableFields
+func isUpdatableField(path string) bool {
+	for _, field := range updatableFields {
+		if path == field {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBlogID returns an InvalidArgument gRPC error if the ID isn't a UUID
+func checkBlogID(blogID string) error {
+	if _, uuidErr := uuid.FromString(blogID); uuidErr != nil {
+		return status.Errorf( // PROPERLY RETURNING gRPC ERRORS!
+			codes.InvalidArgument,
+			fmt.Sprintf("Blog ID Provided does not match UUIDv4 format: %v", uuidErr),
 		)
 	}
 	return nil
@@ -298,71 +1082,202 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("Blog program started...")
 
-	lis, err := net.Listen("tcp", "0.0.0.0:50051")
+	config, err := bootstrap.Load(bootstrap.Defaults("0.0.0.0:50051", "0.0.0.0:9051"))
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	stopTracing, err := tracing.Setup("blog_server", config.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing() // Flushes the last spans
+
+	lis, err := net.Listen("tcp", config.Address)
 	if err != nil {
 		log.Fatalf("Failed to listen %v", err)
 	}
 	defer lis.Close()
 
-	// AWS Dynamodb
-	log.Println("Initializing DynamoDB Client")
-	ddbCfg, ddbErr := external.LoadDefaultAWSConfig()
-	if ddbErr != nil {
-		panic("unable to load SDK config, " + ddbErr.Error())
+	// Storage backend. Defaults to DynamoDB
+	var store BlogStore
+	var comments CommentStore
+	var ddbConfig *aws.Config                   // Only set for DynamoDB
+	storeChecks := map[string]bootstrap.Check{} // What the store needs to work, for the health service. Nothing for memory
+	switch backend := os.Getenv("BLOGSTORE"); backend {
+	case "memory":
+		log.Println("Using in-memory blog store. Blogs will not survive a restart")
+		store = newMemoryStore()
+		comments = newMemoryCommentStore()
+	case "bolt":
+		path := os.Getenv("BLOGSTOREPATH")
+		if path == "" {
+			path = "blog.db"
+		}
+		log.Printf("Using bolt blog store at: %v", path)
+		boltStore, err := newBoltStore(path)
+		if err != nil {
+			log.Fatalf("Failed to open bolt blog store: %v", err)
+		}
+		defer boltStore.Close()
+		store = boltStore
+		storeChecks["bolt file"] = boltStore.check
+		comments, err = newBoltCommentStore(boltStore.db)
+		if err != nil {
+			log.Fatalf("Failed to open bolt comment store: %v", err)
+		}
+	case "", "dynamodb":
+		// AWS Dynamodb
+		log.Println("Initializing DynamoDB Client")
+		ddbCfg, ddbErr := external.LoadDefaultAWSConfig()
+		if ddbErr != nil {
+			panic("unable to load SDK config, " + ddbErr.Error())
+		}
+
+		if _, varSet := os.LookupEnv("LOCALDDB"); varSet { // If LOCALDDB is set (even if empty)
+			ddbCfg = localDynamoDB(ddbCfg)
+		}
+		ddbCfg = traceDynamoDB(instrumentDynamoDB(ddbCfg)) // For every client below, the stream poller's too
+		ddbConfig = &ddbCfg
+
+		// Tables that are already there are fine. If creating them fails otherwise,
+		// the health service says NOT_SERVING until somebody sorts it out
+		ddbStore := newDynamoStore(dynamodb.New(ddbCfg), blogTable, blogRevisionTable)
+		if err := ddbStore.createTable(context.Background()); isResourceInUse(err) {
+			// Tables from older versions may miss indexes. Building them can take a while, List copes meanwhile
+			go func() {
+				if err := ddbStore.addMissingIndexes(context.Background()); err != nil {
+					log.Printf("Could not add the missing DynamoDB indexes, listing by author and publishing scheduled blogs will scan: %v", err)
+				}
+			}()
+		} else if err != nil {
+			log.Printf("Could not create DynamoDB table %v: %v", blogTable, err)
+		}
+		if err := ddbStore.createRevisionTable(context.Background()); err != nil && !isResourceInUse(err) {
+			log.Printf("Could not create DynamoDB table %v: %v", blogRevisionTable, err)
+		}
+		// Can take a while for a new table. No need to hold up serving for it
+		go func() {
+			if err := ddbStore.enableTTL(context.Background()); err != nil {
+				log.Printf("Could not enable DynamoDB TTL, expired blogs won't be purged: %v", err)
+			}
+		}()
+		store = ddbStore
+		storeChecks["DynamoDB blog tables"] = ddbStore.checkTables
+
+		ddbCommentStore := newDynamoCommentStore(dynamodb.New(ddbCfg), blogCommentTable)
+		if err := ddbCommentStore.createTable(context.Background()); err != nil && !isResourceInUse(err) {
+			log.Printf("Could not create DynamoDB table %v: %v", blogCommentTable, err)
+		}
+		storeChecks["DynamoDB comment table"] = ddbCommentStore.checkTable
+		go func() {
+			if err := ddbCommentStore.enableTTL(context.Background()); err != nil {
+				log.Printf("Could not enable DynamoDB TTL, comments on expired blogs won't be purged: %v", err)
+			}
+		}()
+		comments = ddbCommentStore
+	default:
+		log.Fatalf("Unknown BLOGSTORE backend: %q", backend)
 	}
 
-	if _, varSet := os.LookupEnv("LOCALDDB"); varSet { // If LOCALDDB is set (even if empty)
-		ddbCfg = localDynamoDB(ddbCfg)
+	// Deleting (and undeleting) a blog does the same to its comments
+	store = &cascadingStore{BlogStore: store, comments: comments}
+
+	// Blog events for WatchBlogs and the search index. By default they come from this server's own changes to the store.
+	// With BLOGWATCH=streams they come from the DynamoDB Stream instead, which catches changes made by other servers too
+	events := newEventBroker()
+
+	// Search index for SearchBlogs. Built from scratch on every start, then kept up to date by the blog events
+	index := newSearchIndex()
+	events.listen(index.apply)
+	indexed, err := index.rebuild(context.Background(), store)
+	if err != nil {
+		log.Fatalf("Failed to build search index: %v", err)
 	}
+	log.Printf("Indexed %v blogs for search", indexed)
 
-	ddbClient = dynamodb.New(ddbCfg)
+	var poller *streamPoller
+	switch watch := os.Getenv("BLOGWATCH"); watch {
+	case "", "local":
+		store = &watchedStore{BlogStore: store, broker: events}
+	case "streams":
+		if ddbConfig == nil {
+			log.Fatalf("BLOGWATCH=streams needs the dynamodb BLOGSTORE")
+		}
+		log.Println("Watching blogs through DynamoDB Streams")
+		poller = newStreamPoller(*ddbConfig, blogTable, events) // Started along with the gRPC server, which stops it
+	default:
+		log.Fatalf("Unknown BLOGWATCH source: %q", watch)
+	}
 
-	ddbreq := ddbClient.CreateTableRequest(&dynamodb.CreateTableInput{
-		TableName: aws.String(blogTable),
-		AttributeDefinitions: []dynamodb.AttributeDefinition{
-			dynamodb.AttributeDefinition{
-				AttributeName: aws.String("id"),
-				AttributeType: "S",
-			},
-		},
-		KeySchema: []dynamodb.KeySchemaElement{
-			dynamodb.KeySchemaElement{
-				AttributeName: aws.String("id"),
-				KeyType:       "HASH",
-			},
-		},
-		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(1),
-			WriteCapacityUnits: aws.Int64(1),
-		},
-	})
+	// How often scheduled drafts are published. Go duration format, e.g. "10s". They go out up to this late
+	if value, varSet := os.LookupEnv("BLOGPUBLISHINTERVAL"); varSet {
+		publishInterval, err = time.ParseDuration(value)
+		if err != nil || publishInterval <= 0 {
+			log.Fatalf("Invalid BLOGPUBLISHINTERVAL %q: %v", value, err)
+		}
+	}
 
-	ddbreq.Send(context.Background()) // I don't care if table creation works or not
+	// How long deleted blogs stick around. Go duration format, e.g. "72h". "0" keeps them forever
+	retention := defaultRetention
+	if value, varSet := os.LookupEnv("BLOGRETENTION"); varSet {
+		retention, err = time.ParseDuration(value)
+		if err != nil || retention < 0 {
+			log.Fatalf("Invalid BLOGRETENTION %q: %v", value, err)
+		}
+	}
+	log.Printf("Deleted blogs can be undeleted for: %v", retention)
 
-	// gRPC server
+	// gRPC server. Authenticating blog authors (config.JWTKeyFile) is up to the handlers too, see server.caller
 	log.Printf("Registering gRPC server")
-	opts := []grpc.ServerOption{}
-	s := grpc.NewServer(opts...)
-	defer s.Stop()
+	s, err := bootstrap.NewServer(config)
+	if err != nil {
+		log.Fatalf("Failed to set up the gRPC server: %v", err)
+	}
 
-	// Register the reflection service on our gRPC server
-	reflection.Register(s)
+	// Background workers. They stop when the server shuts down, which waits for them
+	if poller != nil {
+		s.Go(func(ctx context.Context) {
+			if err := poller.run(ctx); err != nil && ctx.Err() == nil {
+				log.Printf("Stopped watching DynamoDB stream, WatchBlogs and SearchBlogs won't see any changes: %v", err)
+			}
+		})
+	}
+	// Publishes scheduled drafts once their publish_time comes around. Goes through the wrapped store, so watchers
+	// and the search index see them get published
+	s.Go(func(ctx context.Context) {
+		if err := newPublishWorker(store).run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Stopped publishing scheduled blogs: %v", err)
+		}
+	})
+
+	// Both services are only as healthy as the store (and the comment store) behind them
+	for name, check := range storeChecks {
+		s.AddCheck("blog.BlogService", name, check)
+		s.AddCheck("blog.CommentService", name, check)
+	}
 
 	// Register BlogServiceServer
-	blogpb.RegisterBlogServiceServer(s, &server{})
+	blogpb.RegisterBlogServiceServer(s.Server, &server{
+		store:     store,
+		retention: retention,
+		events:    events,
+		index:     index,
 
-	go func() {
-		log.Println("Started Blog gRPC server in a separate GoRoutine")
-		if err := s.Serve(lis); err != nil {
-			log.Fatalf("Failed to serve: %v", err)
-		}
-	}()
+		authenticate: config.JWTKeyFile != "",
+	})
 
-	// Wait for Ctrl+c to exit
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
+	// Register CommentServiceServer
+	blogpb.RegisterCommentServiceServer(s.Server, &commentServer{
+		blogs:    store,
+		comments: comments,
 
-	// block until a signal is recieved
-	<-ch
+		authenticate: config.JWTKeyFile != "",
+	})
+
+	// Serves until Ctrl+c (or SIGTERM), then drains
+	log.Println("Started Blog gRPC server")
+	if err := s.Run(lis); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
 	fmt.Println("End of program!")
 }
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/golang/protobuf/ptypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestBatchGetBlogsIsARead(t *testing.T) {
+	store := newMemoryStore()
+	s := &server{store: store, authenticate: true}
+	blog := testBlog(t, store, "public")
+
+	// No bearer token, like ReadBlog
+	resp, err := s.BatchGetBlogs(context.Background(), &blogpb.BatchGetBlogsRequest{BlogIds: []string{blog.GetId(), "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f"}})
+	if err != nil {
+		t.Fatalf("BatchGetBlogs without a token: %v", err)
+	}
+	results := resp.GetResults()
+	if len(results) != 2 || results[0].GetBlog().GetTitle() != "public" || codes.Code(results[1].GetStatus().GetCode()) != codes.NotFound {
+		t.Errorf("BatchGetBlogs = %v, want the blog, then NotFound", results)
+	}
+}
+
+func TestCreateBlogAuthor(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	mtlsCtx := peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}}})
+
+	tests := []struct {
+		name         string
+		authenticate bool
+		ctx          context.Context
+		want         string
+	}{
+		{name: "plaintext", ctx: context.Background(), want: "Milos"},
+		{name: "client certificate", ctx: mtlsCtx, want: "CN=client"},
+		{name: "token", authenticate: true, ctx: auth.NewContext(context.Background(), &auth.Identity{Subject: "Ana"}), want: "Ana"},
+		{name: "token and client certificate", authenticate: true, ctx: auth.NewContext(mtlsCtx, &auth.Identity{Subject: "Ana"}), want: "Ana"},
+	}
+	for _, tt := range tests {
+		s := &server{store: newMemoryStore(), authenticate: tt.authenticate}
+		resp, err := s.CreateBlog(tt.ctx, &blogpb.CreateBlogRequest{Blog: &blogpb.Blog{AuthorId: "Milos", Title: tt.name}})
+		if err != nil {
+			t.Errorf("%v: CreateBlog: %v", tt.name, err)
+			continue
+		}
+		if got := resp.GetBlog().GetAuthorId(); got != tt.want {
+			t.Errorf("%v: CreateBlog author_id = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCreateBlogIgnoresDeleteTimes(t *testing.T) {
+	blog := func() *blogpb.Blog {
+		return &blogpb.Blog{Title: "not deleted", DeleteTime: ptypes.TimestampNow(), ExpireTime: ptypes.TimestampNow()}
+	}
+	s := &server{store: newMemoryStore()}
+
+	created, err := s.CreateBlog(context.Background(), &blogpb.CreateBlogRequest{Blog: blog()})
+	if err != nil {
+		t.Fatalf("CreateBlog: %v", err)
+	}
+	batch, err := s.BatchCreateBlogs(context.Background(), &blogpb.BatchCreateBlogsRequest{Blogs: []*blogpb.Blog{blog()}})
+	if err != nil {
+		t.Fatalf("BatchCreateBlogs: %v", err)
+	}
+
+	for _, blog := range []*blogpb.Blog{created.GetBlog(), batch.GetResults()[0].GetBlog()} {
+		if blog.GetDeleteTime() != nil || blog.GetExpireTime() != nil {
+			t.Errorf("created blog = %v, want no delete_time or expire_time", blog)
+		}
+		if _, err := s.ReadBlog(context.Background(), &blogpb.ReadBlogRequest{BlogId: blog.GetId()}); err != nil {
+			t.Errorf("ReadBlog(%v) after creating it: %v", blog.GetId(), err)
+		}
+	}
+}
+
+func TestBatchSizeLimits(t *testing.T) {
+	saved := maxBatchSize
+	maxBatchSize = 3
+	defer func() { maxBatchSize = saved }()
+
+	s := &server{store: newMemoryStore()}
+	ctx := context.Background()
+	calls := map[string]func(size int) error{
+		"BatchCreateBlogs": func(size int) error {
+			_, err := s.BatchCreateBlogs(ctx, &blogpb.BatchCreateBlogsRequest{Blogs: make([]*blogpb.Blog, size)})
+			return err
+		},
+		"BatchGetBlogs": func(size int) error {
+			_, err := s.BatchGetBlogs(ctx, &blogpb.BatchGetBlogsRequest{BlogIds: make([]string, size)})
+			return err
+		},
+		"BatchDeleteBlogs": func(size int) error {
+			_, err := s.BatchDeleteBlogs(ctx, &blogpb.BatchDeleteBlogsRequest{BlogIds: make([]string, size)})
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(maxBatchSize); err != nil {
+			t.Errorf("%v with %v items: %v", name, maxBatchSize, err)
+		}
+		if err := call(maxBatchSize + 1); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%v with %v items error = %v, want %v", name, maxBatchSize+1, err, codes.InvalidArgument)
+		}
+	}
+}
+
+// batchFailingStore fails BatchCreate for the blogs titled in errs, and stores the rest
+type batchFailingStore struct {
+	BlogStore
+	errs map[string]error
+}
+
+func (s *batchFailingStore) BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	for i, blog := range blogs {
+		if err, ok := s.errs[blog.GetTitle()]; ok {
+			errs[i] = err
+			continue
+		}
+		errs[i] = s.BlogStore.Create(ctx, blog)
+	}
+	return errs
+}
+
+func TestBatchCreateBlogsPartialFailure(t *testing.T) {
+	store := &batchFailingStore{BlogStore: newMemoryStore(), errs: map[string]error{
+		"throttled": errBatchIncomplete,
+		"broken":    errors.New("disk on fire"),
+	}}
+	s := &server{store: store}
+
+	resp, err := s.BatchCreateBlogs(context.Background(), &blogpb.BatchCreateBlogsRequest{Blogs: []*blogpb.Blog{
+		{Title: "stored"}, {Title: "throttled"}, nil, {Title: "broken"},
+	}})
+	if err != nil {
+		t.Fatalf("BatchCreateBlogs: %v", err)
+	}
+	wantCodes := []codes.Code{codes.OK, codes.Unavailable, codes.OK, codes.Internal}
+	results := resp.GetResults()
+	if len(results) != len(wantCodes) {
+		t.Fatalf("BatchCreateBlogs returned %v results, want %v", len(results), len(wantCodes))
+	}
+	for i, result := range results {
+		if code := codes.Code(result.GetStatus().GetCode()); code != wantCodes[i] || (code == codes.OK) != (result.GetBlog() != nil) {
+			t.Errorf("result %v = %v, want %v, with a blog only if it was stored", i, result, wantCodes[i])
+		}
+	}
+
+	drafts := []blogpb.Blog_State{blogpb.Blog_DRAFT}
+	got := listPages(t, store, ListOptions{States: drafts})
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"", "stored"}) {
+		t.Errorf("stored blogs = %q, want only the ones without errors", got)
+	}
+}
+
+func TestBatchDeleteBlogsPartialFailure(t *testing.T) {
+	store := newMemoryStore()
+	s := &server{store: store, authenticate: true}
+	ctx := auth.NewContext(context.Background(), &auth.Identity{Subject: "Milos"})
+
+	own := testBlog(t, store, "own")
+	deleted := testBlog(t, store, "deleted")
+	if err := store.Delete(ctx, &blogpb.Blog{Id: deleted.GetId(), DeleteTime: ptypes.TimestampNow()}, 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	others := newBlog(&blogpb.Blog{Title: "others"}, "Ana")
+	if err := store.Create(ctx, others); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	blogIDs := []string{own.GetId(), "not-a-uuid", own.GetId(), "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f", deleted.GetId(), others.GetId()}
+	wantCodes := []codes.Code{codes.OK, codes.InvalidArgument, codes.InvalidArgument, codes.NotFound, codes.NotFound, codes.PermissionDenied}
+	resp, err := s.BatchDeleteBlogs(ctx, &blogpb.BatchDeleteBlogsRequest{BlogIds: blogIDs})
+	if err != nil {
+		t.Fatalf("BatchDeleteBlogs: %v", err)
+	}
+	for i, result := range resp.GetResults() {
+		if code := codes.Code(result.GetStatus().GetCode()); code != wantCodes[i] || result.GetBlogId() != blogIDs[i] {
+			t.Errorf("result %v = %v, want %v for %v", i, result, wantCodes[i], blogIDs[i])
+		}
+	}
+
+	for blog, wantDeleted := range map[*blogpb.Blog]bool{own: true, others: false} {
+		if read, err := store.Read(ctx, blog.GetId()); err != nil || isDeleted(read) != wantDeleted {
+			t.Errorf("%q after BatchDeleteBlogs = %v, %v, want deleted %v", blog.GetTitle(), read, err, wantDeleted)
+		}
+	}
+}
+
+// importStream plays back reqs to ImportBlogs, then fails with err, or ends the stream if err is nil
+type importStream struct {
+	grpc.ServerStream
+	reqs    []*blogpb.ImportBlogRequest
+	err     error
+	summary *blogpb.ImportBlogSummary
+}
+
+func (s *importStream) Context() context.Context {
+	return context.Background()
+}
+
+func (s *importStream) Recv() (*blogpb.ImportBlogRequest, error) {
+	if len(s.reqs) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		return nil, io.EOF
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *importStream) SendAndClose(summary *blogpb.ImportBlogSummary) error {
+	s.summary = summary
+	return nil
+}
+
+func TestImportBlogs(t *testing.T) {
+	saved := importBatchSize
+	importBatchSize = 2 // So the blogs go in a few batches
+	defer func() { importBatchSize = saved }()
+
+	store := &batchFailingStore{BlogStore: newMemoryStore(), errs: map[string]error{"broken": errors.New("disk on fire")}}
+	s := &server{store: store}
+	stream := &importStream{reqs: []*blogpb.ImportBlogRequest{
+		{SourceId: "a", Blog: &blogpb.Blog{Title: "a"}},
+		{SourceId: "empty", Blog: &blogpb.Blog{}},
+		{SourceId: "a", Blog: &blogpb.Blog{Title: "a again"}},
+		{Blog: &blogpb.Blog{Title: "broken"}},
+		{Blog: &blogpb.Blog{Content: "no title"}},
+		{SourceId: "b", Blog: &blogpb.Blog{Title: "b", State: blogpb.Blog_PUBLISHED, DeleteTime: ptypes.TimestampNow()}},
+	}}
+	if err := s.ImportBlogs(stream); err != nil {
+		t.Fatalf("ImportBlogs: %v", err)
+	}
+
+	summary := stream.summary
+	if summary.GetCreated() != 3 || summary.GetSkipped() != 2 || summary.GetFailed() != 1 {
+		t.Errorf("ImportBlogs created %v, skipped %v, failed %v, want 3, 2 and 1", summary.GetCreated(), summary.GetSkipped(), summary.GetFailed())
+	}
+	issues := func(issues []*blogpb.ImportBlogIssue) string {
+		var s []string
+		for _, issue := range issues {
+			s = append(s, fmt.Sprintf("%v/%v: %v", issue.GetIndex(), issue.GetSourceId(), issue.GetReason()))
+		}
+		return strings.Join(s, ", ")
+	}
+	if got, want := issues(summary.GetSkips()), "1/empty: Blog has no title and no content, 2/a: Source ID was already imported earlier in the stream"; got != want {
+		t.Errorf("ImportBlogs skips = %q, want %q", got, want)
+	}
+	if got, want := issues(summary.GetFailures()), "3/: disk on fire"; got != want {
+		t.Errorf("ImportBlogs failures = %q, want %q", got, want)
+	}
+
+	// Imported blogs are new drafts, whatever the stream said
+	var titles []string
+	if _, err := store.List(context.Background(), ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT, blogpb.Blog_PUBLISHED}}, func(blog *blogpb.Blog) error {
+		if blog.GetState() != blogpb.Blog_DRAFT || isDeleted(blog) {
+			t.Errorf("imported %q is %v, deleted %v, want a draft", blog.GetTitle(), blog.GetState(), isDeleted(blog))
+		}
+		titles = append(titles, blog.GetTitle())
+		return nil
+	}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	sort.Strings(titles)
+	if !reflect.DeepEqual(titles, []string{"", "a", "b"}) {
+		t.Errorf("imported blogs = %q, want [\"\" a b]", titles)
+	}
+}
+
+func TestImportBlogsKeepsWhatWasWritten(t *testing.T) {
+	saved := importBatchSize
+	importBatchSize = 2
+	defer func() { importBatchSize = saved }()
+
+	store := newMemoryStore()
+	s := &server{store: store}
+	stream := &importStream{
+		reqs: []*blogpb.ImportBlogRequest{{Blog: &blogpb.Blog{Title: "a"}}, {Blog: &blogpb.Blog{Title: "b"}}, {Blog: &blogpb.Blog{Title: "c"}}},
+		err:  errors.New("connection reset"),
+	}
+	if err := s.ImportBlogs(stream); err == nil {
+		t.Fatalf("ImportBlogs with a broken stream succeeded")
+	}
+	got := listPages(t, store, ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT}})
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("blogs after the stream broke = %q, want the first batch, [a b]", got)
+	}
+}
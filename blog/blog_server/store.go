@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+// errBlogNotFound is returned by a BlogStore when the requested blog ID does not exist.
+// The gRPC handlers translate it to the status code each RPC promises in blog.proto
+var errBlogNotFound = errors.New("blog not found")
+
+// errVersionMismatch is returned by a BlogStore when the caller's expected version doesn't match the stored blog
+var errVersionMismatch = errors.New("blog version mismatch")
+
+// errBlogNotDeleted is returned by BlogStore.Undelete when the blog isn't deleted
+var errBlogNotDeleted = errors.New("blog is not deleted")
+
+// errRevisionNotFound is returned by BlogStore.ReadRevision when the blog never was at the requested version
+var errRevisionNotFound = errors.New("blog revision not found")
+
+// errBatchIncomplete is returned per item by the BlogStore batch methods when the backend gave up on an item,
+// e.g. DDB kept leaving it unprocessed because of throttling. The item can be retried
+var errBatchIncomplete = errors.New("batch item was not processed, try again later")
+
+// errInvalidPageToken is returned by BlogStore.List when the page token can't be decoded
+var errInvalidPageToken = errors.New("invalid page token")
+
+// errInvalidStateChange is returned by BlogStore.SetState when the blog isn't in a state it can be moved from
+var errInvalidStateChange = errors.New("blog can't be moved to that state")
+
+// updatableFields are the Blog fields UpdateBlog can write, by proto field name (as used in a FieldMask)
+var updatableFields = []string{"author_id", "title", "content"}
+
+// blogField returns the value of one of the updatableFields
+func blogField(blog *blogpb.Blog, path string) string {
+	switch path {
+	case "author_id":
+		return blog.GetAuthorId()
+	case "title":
+		return blog.GetTitle()
+	case "content":
+		return blog.GetContent()
+	}
+	return ""
+}
+
+// applyFieldMask copies the updatableFields listed in paths from src to dst
+func applyFieldMask(dst, src *blogpb.Blog, paths []string) {
+	for _, path := range paths {
+		switch path {
+		case "author_id":
+			dst.AuthorId = src.GetAuthorId()
+		case "title":
+			dst.Title = src.GetTitle()
+		case "content":
+			dst.Content = src.GetContent()
+		}
+	}
+}
+
+// TagChanges are the tags an update adds to and removes from a blog. Tags must be normalized (see normalizeTags)
+type TagChanges struct {
+	Add    []string
+	Remove []string
+}
+
+// empty reports whether there are no tag changes at all
+func (c TagChanges) empty() bool {
+	return len(c.Add) == 0 && len(c.Remove) == 0
+}
+
+// applyTagChanges returns tags with c.Add added and c.Remove removed, sorted
+func applyTagChanges(tags []string, c TagChanges) []string {
+	set := map[string]bool{}
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	for _, tag := range c.Add {
+		set[tag] = true
+	}
+	for _, tag := range c.Remove {
+		delete(set, tag)
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	result := make([]string, 0, len(set))
+	for tag := range set {
+		result = append(result, tag)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// normalizeTags lower cases and trims tags, and drops empty and duplicate ones. The result is sorted
+func normalizeTags(tags []string) []string {
+	normalized := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" {
+			normalized = append(normalized, tag)
+		}
+	}
+	return applyTagChanges(normalized, TagChanges{})
+}
+
+// hasTag reports whether a blog is tagged with tag
+func hasTag(blog *blogpb.Blog, tag string) bool {
+	for _, t := range blog.GetTags() {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// hasState reports whether a blog is in one of states
+func hasState(blog *blogpb.Blog, states []blogpb.Blog_State) bool {
+	for _, state := range states {
+		if blog.GetState() == state {
+			return true
+		}
+	}
+	return false
+}
+
+// applyState copies the state, and publish_time if set, from src to dst, see BlogStore.SetState
+func applyState(dst, src *blogpb.Blog) {
+	dst.State = src.GetState()
+	if src.GetPublishTime() != nil {
+		dst.PublishTime = src.GetPublishTime()
+	}
+}
+
+// isScheduled reports whether a blog is a draft with a publish_time, see PublishBlog
+func isScheduled(blog *blogpb.Blog) bool {
+	return blog.GetState() == blogpb.Blog_DRAFT && blog.GetPublishTime() != nil
+}
+
+// isDue reports whether a blog is a scheduled draft, due to be published by now.
+// Deleted blogs are never due, though they stay scheduled if they get undeleted
+func isDue(blog *blogpb.Blog, now time.Time) bool {
+	if !isScheduled(blog) || isDeleted(blog) {
+		return false
+	}
+	publishTime, err := ptypes.Timestamp(blog.GetPublishTime())
+	return err == nil && !publishTime.After(now)
+}
+
+// checkVersion returns errVersionMismatch if expectedVersion is set and doesn't match the blog
+func checkVersion(blog *blogpb.Blog, expectedVersion int64) error {
+	if expectedVersion != 0 && blog.GetVersion() != expectedVersion {
+		return errVersionMismatch
+	}
+	return nil
+}
+
+// isDeleted reports whether a blog has been soft deleted
+func isDeleted(blog *blogpb.Blog) bool {
+	return blog.GetDeleteTime() != nil
+}
+
+// isExpired reports whether a deleted blog is past its expire_time and should be treated as gone.
+// The backends purge expired blogs lazily (DDB TTL can take days), so everything that reads has to check.
+func isExpired(blog *blogpb.Blog, now time.Time) bool {
+	expireTime := blog.GetExpireTime()
+	if !isDeleted(blog) || expireTime == nil {
+		return false
+	}
+	return expireTime.GetSeconds() <= now.Unix()
+}
+
+// ListOptions narrows down what BlogStore.List returns
+type ListOptions struct {
+	PageSize  int                 // Max blogs to return. 0 means no limit
+	PageToken string              // Resume after the position encoded by a previous List call
+	AuthorID  string              // Only list blogs by this author
+	Tag       string              // Only list blogs with this tag
+	States    []blogpb.Blog_State // Only list blogs in these states. Empty means published blogs only
+
+	OrderBy    blogpb.ListBlogRequest_OrderBy
+	Descending bool
+
+	ShowDeleted bool // Also list deleted blogs. Expired blogs are never listed
+}
+
+// ordered reports whether the caller asked for anything other than the backend's natural (ID) order
+func (opts ListOptions) ordered() bool {
+	return opts.OrderBy != blogpb.ListBlogRequest_ID || opts.Descending
+}
+
+// states returns the states to list, filling in the default
+func (opts ListOptions) states() []blogpb.Blog_State {
+	if len(opts.States) == 0 {
+		return []blogpb.Blog_State{blogpb.Blog_PUBLISHED}
+	}
+	return opts.States
+}
+
+// sortKey returns a string that sorts blogs the way opts asks for. The blog ID is appended as a tie breaker,
+// which also makes it a unique position to resume a listing from.
+func (opts ListOptions) sortKey(blog *blogpb.Blog) string {
+	switch opts.OrderBy {
+	case blogpb.ListBlogRequest_CREATE_TIME:
+		return timestampKey(blog.GetCreateTime()) + blog.GetId()
+	case blogpb.ListBlogRequest_UPDATE_TIME:
+		return timestampKey(blog.GetUpdateTime()) + blog.GetId()
+	}
+	return blog.GetId()
+}
+
+// timestampKey formats a timestamp so that string order matches time order
+func timestampKey(ts *timestamp.Timestamp) string {
+	return fmt.Sprintf("%020d.%09d/", ts.GetSeconds(), ts.GetNanos())
+}
+
+// matches reports whether a blog passes the filters in opts
+func (opts ListOptions) matches(blog *blogpb.Blog) bool {
+	if isExpired(blog, time.Now()) {
+		return false
+	}
+	if !opts.ShowDeleted && isDeleted(blog) {
+		return false
+	}
+	if opts.AuthorID != "" && blog.GetAuthorId() != opts.AuthorID {
+		return false
+	}
+	if opts.Tag != "" && !hasTag(blog, opts.Tag) {
+		return false
+	}
+	if !hasState(blog, opts.states()) {
+		return false
+	}
+	return true
+}
+
+// BlogStore is the storage backend behind the BlogService server.
+// Implementations must be safe for concurrent use by multiple gRPC handlers.
+type BlogStore interface {
+	// Create stores a new blog. The blog ID, version and timestamps are assigned by the caller.
+	Create(ctx context.Context, blog *blogpb.Blog) error
+
+	// Read returns the blog with the given ID, deleted or not, or errBlogNotFound. Expired blogs are never returned.
+	Read(ctx context.Context, blogID string) (*blogpb.Blog, error)
+
+	// Update writes the fields listed in paths (see updatableFields) from blog to the stored blog with the same ID,
+	// along with blog's update_time (stamped by the caller), applies the tag changes, and bumps its version.
+	// The blog as it was before the update is kept as a revision.
+	// Returns the full updated blog, or errBlogNotFound if it doesn't exist or is deleted.
+	// A non-zero expectedVersion must match the stored version, or errVersionMismatch is returned.
+	Update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, expectedVersion int64) (*blogpb.Blog, error)
+
+	// Delete soft deletes the blog with the same ID as blog by copying over its delete_time and expire_time
+	// (stamped by the caller), and bumps its version. Returns errBlogNotFound if it doesn't exist or is already deleted.
+	// A non-zero expectedVersion must match the stored version, or errVersionMismatch is returned.
+	Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error
+
+	// SetState writes blog's state, update_time (stamped by the caller) and publish_time, if set, to the stored blog
+	// with the same ID, and bumps its version. The stored blog must be in one of the from states, or errInvalidStateChange is returned.
+	// Returns the full updated blog, or errBlogNotFound if it doesn't exist or is deleted.
+	// A non-zero expectedVersion must match the stored version, or errVersionMismatch is returned.
+	SetState(ctx context.Context, blog *blogpb.Blog, from []blogpb.Blog_State, expectedVersion int64) (*blogpb.Blog, error)
+
+	// Undelete clears delete_time and expire_time on a deleted blog, and bumps its version.
+	// Returns the restored blog, errBlogNotFound if it doesn't exist (or expired), or errBlogNotDeleted.
+	Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error)
+
+	// ListRevisions returns the blog as it was before each update, oldest first, or errBlogNotFound.
+	ListRevisions(ctx context.Context, blogID string) ([]*blogpb.Blog, error)
+
+	// ReadRevision returns the blog as it was at the given version, before it got updated, or errRevisionNotFound.
+	// Returns errBlogNotFound if the blog itself is missing, deleted or expired.
+	ReadRevision(ctx context.Context, blogID string, version int64) (*blogpb.Blog, error)
+
+	// BatchCreate stores new blogs, like Create. Returns one error per blog, nil for the ones that were stored.
+	BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error
+
+	// BatchRead returns the blogs with the given IDs, like Read. Both slices line up with blogIDs.
+	// A blog is nil where its error isn't.
+	BatchRead(ctx context.Context, blogIDs []string) ([]*blogpb.Blog, []error)
+
+	// BatchDelete soft deletes blogs, like Delete without a version check. blogs must have unique IDs.
+	// Returns one error per blog, nil for the ones that were deleted.
+	BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error
+
+	// List calls fn for every blog on the page selected by opts. Iteration stops at the first error returned by fn.
+	// Returns a token for the next page, or "" if there are no more blogs.
+	List(ctx context.Context, opts ListOptions, fn func(*blogpb.Blog) error) (string, error)
+
+	// ListDue calls fn for every scheduled draft that is due to be published by now (see isDue), in no particular order.
+	// Iteration stops at the first error returned by fn. Runs every publishInterval, so it has to be cheap.
+	ListDue(ctx context.Context, now time.Time, fn func(*blogpb.Blog) error) error
+}
+
+// encodePageToken turns a backend specific position (e.g. a DDB LastEvaluatedKey) into an opaque page token
+func encodePageToken(key map[string]string) string {
+	if len(key) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(key) // A map of strings always marshals
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodePageToken is the reverse of encodePageToken. An empty token decodes to a nil key
+func decodePageToken(token string) (map[string]string, error) {
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+	key := map[string]string{}
+	if err := json.Unmarshal(b, &key); err != nil {
+		return nil, errInvalidPageToken
+	}
+	return key, nil
+}
+
+// listDueLoaded implements BlogStore.ListDue for backends that load every blog into memory anyway
+func listDueLoaded(ctx context.Context, store BlogStore, now time.Time, fn func(*blogpb.Blog) error) error {
+	_, err := store.List(ctx, ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT}}, func(blog *blogpb.Blog) error {
+		if !isDue(blog, now) {
+			return nil
+		}
+		return fn(blog)
+	})
+	return err
+}
+
+// listLoaded implements BlogStore.List for backends that load every blog into memory.
+// Blogs are filtered and sorted as opts asks. The page token is the sort key of the last blog on the previous page.
+func listLoaded(ctx context.Context, blogs []*blogpb.Blog, opts ListOptions, fn func(*blogpb.Blog) error) (string, error) {
+	key, err := decodePageToken(opts.PageToken)
+	if err != nil {
+		return "", err
+	}
+
+	filtered := blogs[:0]
+	for _, blog := range blogs {
+		if opts.matches(blog) {
+			filtered = append(filtered, blog)
+		}
+	}
+	blogs = filtered
+
+	// Keys are unique, so the order is total and the same on every call
+	keys := make(map[*blogpb.Blog]string, len(blogs))
+	for _, blog := range blogs {
+		keys[blog] = opts.sortKey(blog)
+	}
+	before := func(a, b string) bool {
+		if opts.Descending {
+			return a > b
+		}
+		return a < b
+	}
+	sort.Slice(blogs, func(i, j int) bool { return before(keys[blogs[i]], keys[blogs[j]]) })
+
+	if after := key["after"]; after != "" {
+		start := sort.Search(len(blogs), func(i int) bool { return before(after, keys[blogs[i]]) })
+		blogs = blogs[start:]
+	}
+
+	nextPageToken := ""
+	if opts.PageSize > 0 && len(blogs) > opts.PageSize {
+		blogs = blogs[:opts.PageSize]
+		nextPageToken = encodePageToken(map[string]string{"after": keys[blogs[len(blogs)-1]]})
+	}
+
+	for _, blog := range blogs {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		if err := fn(blog); err != nil {
+			return "", err
+		}
+	}
+	return nextPageToken, nil
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/proto"
+	bolt "go.etcd.io/bbolt"
+)
+
+var blogBucket = []byte("blogs") // Name of the bolt bucket holding blogs, keyed on blog ID
+
+// Name of the bolt bucket holding blog revisions. It has a nested bucket per blog ID, keyed on version
+var revisionBucket = []byte("revisions")
+
+// boltStore is a BlogStore that persists blogs to a local bbolt file.
+// Meant for single-node deployments and local development without dynamodb-local.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// newBoltStore opens (or creates) the bolt file at path
+func newBoltStore(path string) (*boltStore, error) {
+	// Timeout so a second server on the same file fails instead of hanging on the file lock
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt file %v: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{blogBucket, revisionBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create bolt bucket: %v", err)
+	}
+
+	return &boltStore{db: db}, nil
+}
+
+// check reports whether the bolt file can still be read. For the health service
+func (s *boltStore) check(ctx context.Context) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(blogBucket) == nil {
+			return fmt.Errorf("bolt bucket %s is missing", blogBucket)
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *boltStore) Create(ctx context.Context, blog *blogpb.Blog) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putBlog(tx.Bucket(blogBucket), blog)
+	})
+}
+
+func (s *boltStore) Read(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	var blog *blogpb.Blog
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		blog, err = getBlog(tx.Bucket(blogBucket), blogID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blog, nil
+}
+
+func (s *boltStore) BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error {
+	// One transaction for the lot, so the file only gets synced once
+	errs := make([]error, len(blogs))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		for i, blog := range blogs {
+			errs[i] = putBlog(b, blog)
+		}
+		return nil
+	})
+	if err != nil { // Commit failed, nothing got stored
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (s *boltStore) BatchRead(ctx context.Context, blogIDs []string) ([]*blogpb.Blog, []error) {
+	blogs := make([]*blogpb.Blog, len(blogIDs))
+	errs := make([]error, len(blogIDs))
+	s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		for i, blogID := range blogIDs {
+			blogs[i], errs[i] = getBlog(b, blogID)
+		}
+		return nil
+	})
+	return blogs, errs
+}
+
+func (s *boltStore) Update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, expectedVersion int64) (*blogpb.Blog, error) {
+	var stored *blogpb.Blog
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		var err error
+		stored, err = getBlog(b, blog.GetId())
+		if err != nil {
+			return err
+		}
+		if isDeleted(stored) {
+			return errBlogNotFound
+		}
+		if err := checkVersion(stored, expectedVersion); err != nil {
+			return err
+		}
+		if err := putRevision(tx, stored); err != nil {
+			return err
+		}
+		applyFieldMask(stored, blog, paths)
+		stored.Tags = applyTagChanges(stored.GetTags(), tags)
+		stored.UpdateTime = blog.GetUpdateTime()
+		stored.Version++
+		return putBlog(b, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltStore) SetState(ctx context.Context, blog *blogpb.Blog, from []blogpb.Blog_State, expectedVersion int64) (*blogpb.Blog, error) {
+	var stored *blogpb.Blog
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		var err error
+		stored, err = getBlog(b, blog.GetId())
+		if err != nil {
+			return err
+		}
+		if isDeleted(stored) {
+			return errBlogNotFound
+		}
+		if err := checkVersion(stored, expectedVersion); err != nil {
+			return err
+		}
+		if !hasState(stored, from) {
+			return errInvalidStateChange
+		}
+		applyState(stored, blog)
+		stored.UpdateTime = blog.GetUpdateTime()
+		stored.Version++
+		return putBlog(b, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltStore) Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		stored, err := getBlog(b, blog.GetId())
+		if err != nil {
+			return err
+		}
+		if isDeleted(stored) {
+			return errBlogNotFound
+		}
+		if err := checkVersion(stored, expectedVersion); err != nil {
+			return err
+		}
+		stored.DeleteTime = blog.GetDeleteTime()
+		stored.ExpireTime = blog.GetExpireTime()
+		stored.Version++
+		return putBlog(b, stored)
+	})
+}
+
+func (s *boltStore) BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		for i, blog := range blogs {
+			stored, err := getBlog(b, blog.GetId())
+			if err == nil && isDeleted(stored) {
+				err = errBlogNotFound
+			}
+			if err != nil {
+				errs[i] = err
+				continue
+			}
+			stored.DeleteTime = blog.GetDeleteTime()
+			stored.ExpireTime = blog.GetExpireTime()
+			stored.Version++
+			errs[i] = putBlog(b, stored)
+		}
+		return nil
+	})
+	if err != nil { // Commit failed, nothing got deleted
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func (s *boltStore) Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	var stored *blogpb.Blog
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		var err error
+		stored, err = getBlog(b, blogID)
+		if err != nil {
+			return err
+		}
+		if !isDeleted(stored) {
+			return errBlogNotDeleted
+		}
+		stored.DeleteTime = nil
+		stored.ExpireTime = nil
+		stored.Version++
+		return putBlog(b, stored)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func (s *boltStore) List(ctx context.Context, opts ListOptions, fn func(*blogpb.Blog) error) (string, error) {
+	// Decode everything up front so a slow stream doesn't keep the read transaction open
+	now := time.Now()
+	var blogs []*blogpb.Blog
+	var expired [][]byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(blogBucket).ForEach(func(k, v []byte) error {
+			blog := &blogpb.Blog{}
+			if err := proto.Unmarshal(v, blog); err != nil {
+				return fmt.Errorf("failed to unmarshal blog %s: %v", k, err)
+			}
+			if isExpired(blog, now) {
+				expired = append(expired, append([]byte(nil), k...)) // k is only valid during the transaction
+				return nil
+			}
+			blogs = append(blogs, blog)
+			return nil
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(expired) > 0 {
+		s.purge(expired)
+	}
+	return listLoaded(ctx, blogs, opts, fn)
+}
+
+// purge removes expired blogs from the file. Nothing else does, so List calls this whenever it comes across them.
+// Failing to purge isn't fatal. Expired blogs are hidden either way.
+func (s *boltStore) purge(blogIDs [][]byte) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(blogBucket)
+		for _, blogID := range blogIDs {
+			if _, err := getBlog(b, string(blogID)); err != errBlogNotFound {
+				continue // Undeleted since we looked
+			}
+			if err := b.Delete(blogID); err != nil {
+				return err
+			}
+			if err := tx.Bucket(revisionBucket).DeleteBucket(blogID); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if comments := tx.Bucket(commentBucket); comments != nil { // Only there if a boltCommentStore shares the file
+				if err := comments.DeleteBucket(blogID); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to purge expired blogs: %v", err)
+		return
+	}
+	log.Printf("Purged %v expired blogs", len(blogIDs))
+}
+
+func (s *boltStore) ListDue(ctx context.Context, now time.Time, fn func(*blogpb.Blog) error) error {
+	return listDueLoaded(ctx, s, now, fn)
+}
+
+func (s *boltStore) ListRevisions(ctx context.Context, blogID string) ([]*blogpb.Blog, error) {
+	var revisions []*blogpb.Blog
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if _, err := getBlog(tx.Bucket(blogBucket), blogID); err != nil {
+			return err
+		}
+		b := tx.Bucket(revisionBucket).Bucket([]byte(blogID))
+		if b == nil { // Never updated
+			return nil
+		}
+		// Keys are big endian versions, so ForEach goes oldest first
+		return b.ForEach(func(k, v []byte) error {
+			revision := &blogpb.Blog{}
+			if err := proto.Unmarshal(v, revision); err != nil {
+				return fmt.Errorf("failed to unmarshal revision %v of blog %s: %v", binary.BigEndian.Uint64(k), blogID, err)
+			}
+			revisions = append(revisions, revision)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (s *boltStore) ReadRevision(ctx context.Context, blogID string, version int64) (*blogpb.Blog, error) {
+	revision := &blogpb.Blog{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		blog, err := getBlog(tx.Bucket(blogBucket), blogID)
+		if err != nil {
+			return err
+		}
+		if isDeleted(blog) {
+			return errBlogNotFound
+		}
+		b := tx.Bucket(revisionBucket).Bucket([]byte(blogID))
+		if b == nil {
+			return errRevisionNotFound
+		}
+		v := b.Get(versionKey(version))
+		if v == nil {
+			return errRevisionNotFound
+		}
+		return proto.Unmarshal(v, revision)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revision, nil
+}
+
+// putRevision keeps a copy of blog, as it is now, under its blog ID and version
+func putRevision(tx *bolt.Tx, blog *blogpb.Blog) error {
+	b, err := tx.Bucket(revisionBucket).CreateBucketIfNotExists([]byte(blog.GetId()))
+	if err != nil {
+		return err
+	}
+	v, err := proto.Marshal(blog)
+	if err != nil {
+		return fmt.Errorf("failed to marshal revision: %v", err)
+	}
+	return b.Put(versionKey(blog.GetVersion()), v)
+}
+
+// versionKey encodes a version so that bolt's byte-wise key order is version order
+func versionKey(version int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(version))
+	return k
+}
+
+// getBlog decodes a single blog from the bucket, or returns errBlogNotFound if it's missing or expired
+func getBlog(b *bolt.Bucket, blogID string) (*blogpb.Blog, error) {
+	v := b.Get([]byte(blogID))
+	if v == nil {
+		return nil, errBlogNotFound
+	}
+	blog := &blogpb.Blog{}
+	if err := proto.Unmarshal(v, blog); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal blog %s: %v", blogID, err)
+	}
+	if isExpired(blog, time.Now()) {
+		return nil, errBlogNotFound
+	}
+	return blog, nil
+}
+
+// putBlog encodes a blog and writes it to the bucket under its ID
+func putBlog(b *bolt.Bucket, blog *blogpb.Blog) error {
+	v, err := proto.Marshal(blog)
+	if err != nil {
+		return fmt.Errorf("failed to marshal blog: %v", err)
+	}
+	return b.Put([]byte(blog.GetId()), v)
+}
@@ -0,0 +1,1068 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+)
+
+var authorIndex = "author_id-index" // Name of the DDB global secondary index on "author_id"
+
+var publishIndex = "publish_at-index" // Name of the sparse DDB global secondary index on publishAttribute
+
+var publishAttribute = "publish_at" // Epoch seconds copy of a scheduled draft's publish_time. Only set while it's scheduled
+
+var indexPollInterval = 10 * time.Second // How often addMissingIndexes checks whether DDB is done building an index
+
+var ttlAttribute = "expire_at" // DDB TTL attribute. Epoch seconds copy of a deleted blog's expire_time
+
+var tagUpdateAttempts = 3 // How many times Update tries adding and removing tags before giving up on a busy blog
+
+// dynamoStore is a BlogStore backed by DynamoDB tables (real or dynamodb-local)
+type dynamoStore struct {
+	client        *dynamodb.Client
+	table         string
+	revisionTable string // Previous versions of blogs, keyed on blog "id" and "version"
+}
+
+func newDynamoStore(client *dynamodb.Client, table, revisionTable string) *dynamoStore {
+	return &dynamoStore{
+		client:        client,
+		table:         table,
+		revisionTable: revisionTable,
+	}
+}
+
+// blogIndex is a global secondary index on the blog table, hashed on a single attribute
+type blogIndex struct {
+	name          string
+	attribute     string
+	attributeType dynamodb.ScalarAttributeType
+}
+
+// blogIndexes are the global secondary indexes the blog table needs. createTable provisions them,
+// addMissingIndexes adds them to tables from before they were needed
+var blogIndexes = []blogIndex{
+	{name: authorIndex, attribute: "author_id", attributeType: dynamodb.ScalarAttributeTypeS},       // One author's blogs
+	{name: publishIndex, attribute: publishAttribute, attributeType: dynamodb.ScalarAttributeTypeN}, // Scheduled drafts only
+}
+
+func (i blogIndex) attributeDefinition() dynamodb.AttributeDefinition {
+	return dynamodb.AttributeDefinition{
+		AttributeName: aws.String(i.attribute),
+		AttributeType: i.attributeType,
+	}
+}
+
+func (i blogIndex) globalSecondaryIndex() dynamodb.GlobalSecondaryIndex {
+	return dynamodb.GlobalSecondaryIndex{
+		IndexName: aws.String(i.name),
+		KeySchema: []dynamodb.KeySchemaElement{
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String(i.attribute),
+				KeyType:       "HASH",
+			},
+		},
+		Projection: &dynamodb.Projection{
+			ProjectionType: dynamodb.ProjectionTypeAll,
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	}
+}
+
+// createTable creates the blog table, keyed on the blog "id".
+// Also provisions the blogIndexes (e.g. on "author_id" so one author's blogs can be queried), and a stream.
+func (s *dynamoStore) createTable(ctx context.Context) error {
+	attributes := []dynamodb.AttributeDefinition{
+		dynamodb.AttributeDefinition{
+			AttributeName: aws.String("id"),
+			AttributeType: "S",
+		},
+	}
+	var indexes []dynamodb.GlobalSecondaryIndex
+	for _, index := range blogIndexes {
+		attributes = append(attributes, index.attributeDefinition())
+		indexes = append(indexes, index.globalSecondaryIndex())
+	}
+
+	ddbReq := s.client.CreateTableRequest(&dynamodb.CreateTableInput{
+		TableName:            aws.String(s.table),
+		AttributeDefinitions: attributes,
+		KeySchema: []dynamodb.KeySchemaElement{
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String("id"),
+				KeyType:       "HASH",
+			},
+		},
+		GlobalSecondaryIndexes: indexes,
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+		StreamSpecification: blogStreamSpecification(), // For WatchBlogs, when BLOGWATCH=streams
+	})
+
+	_, err := ddbReq.Send(ctx)
+	return err
+}
+
+// addMissingIndexes adds the blogIndexes an existing blog table doesn't have yet, one at a time since DDB
+// only builds one at a time. Waits for each to be built, which can take a while on a big table.
+// Until then, List scans instead of querying them
+func (s *dynamoStore) addMissingIndexes(ctx context.Context) error {
+	for _, index := range blogIndexes {
+		indexStatus, err := s.indexStatus(ctx, index.name)
+		if err != nil {
+			return err
+		}
+		if indexStatus == "" {
+			log.Printf("DynamoDB table %v has no index %v, adding it", s.table, index.name)
+			gsi := index.globalSecondaryIndex()
+			ddbReq := s.client.UpdateTableRequest(&dynamodb.UpdateTableInput{
+				TableName:            aws.String(s.table),
+				AttributeDefinitions: []dynamodb.AttributeDefinition{index.attributeDefinition()},
+				GlobalSecondaryIndexUpdates: []dynamodb.GlobalSecondaryIndexUpdate{
+					dynamodb.GlobalSecondaryIndexUpdate{
+						Create: &dynamodb.CreateGlobalSecondaryIndexAction{
+							IndexName:             gsi.IndexName,
+							KeySchema:             gsi.KeySchema,
+							Projection:            gsi.Projection,
+							ProvisionedThroughput: gsi.ProvisionedThroughput,
+						},
+					},
+				},
+			})
+			if _, err := ddbReq.Send(ctx); err != nil {
+				return fmt.Errorf("failed to add index %v to DynamoDB table %v: %v", index.name, s.table, err)
+			}
+		}
+
+		for indexStatus != dynamodb.IndexStatusActive {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(indexPollInterval):
+			}
+			if indexStatus, err = s.indexStatus(ctx, index.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexStatus returns the status of a global secondary index on the blog table, or "" if there's no such index
+func (s *dynamoStore) indexStatus(ctx context.Context, name string) (dynamodb.IndexStatus, error) {
+	ddbResp, err := s.client.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(s.table)}).Send(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to describe DynamoDB table %v: %v", s.table, err)
+	}
+	for _, index := range ddbResp.Table.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == name {
+			return index.IndexStatus, nil
+		}
+	}
+	return "", nil
+}
+
+// createRevisionTable creates the blog revision table, keyed on the blog "id" with the "version" as sort key,
+// so a blog's revisions can be queried in order.
+func (s *dynamoStore) createRevisionTable(ctx context.Context) error {
+	ddbReq := s.client.CreateTableRequest(&dynamodb.CreateTableInput{
+		TableName: aws.String(s.revisionTable),
+		AttributeDefinitions: []dynamodb.AttributeDefinition{
+			dynamodb.AttributeDefinition{
+				AttributeName: aws.String("id"),
+				AttributeType: "S",
+			},
+			dynamodb.AttributeDefinition{
+				AttributeName: aws.String("version"),
+				AttributeType: "N",
+			},
+		},
+		KeySchema: []dynamodb.KeySchemaElement{
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String("id"),
+				KeyType:       "HASH",
+			},
+			dynamodb.KeySchemaElement{
+				AttributeName: aws.String("version"),
+				KeyType:       "RANGE",
+			},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+
+	_, err := ddbReq.Send(ctx)
+	return err
+}
+
+// enableTTL turns on DDB Time To Live, so deleted blogs get purged once they expire
+func (s *dynamoStore) enableTTL(ctx context.Context) error {
+	return enableTableTTL(ctx, s.client, s.table)
+}
+
+// checkTables reports whether the blog and revision tables are ready to use. For the health service
+func (s *dynamoStore) checkTables(ctx context.Context) error {
+	if err := checkTable(ctx, s.client, s.table); err != nil {
+		return err
+	}
+	return checkTable(ctx, s.client, s.revisionTable)
+}
+
+// checkTable returns an error unless a table exists and is ACTIVE
+func checkTable(ctx context.Context, client *dynamodb.Client, table string) error {
+	ddbResp, err := client.DescribeTableRequest(&dynamodb.DescribeTableInput{TableName: aws.String(table)}).Send(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to describe DynamoDB table %v: %v", table, err)
+	}
+	if status := ddbResp.Table.TableStatus; status != dynamodb.TableStatusActive {
+		return fmt.Errorf("DynamoDB table %v is %v", table, status)
+	}
+	return nil
+}
+
+// isIndexUnavailable reports whether a DDB error means a Query hit an index that doesn't exist or is still being built
+func isIndexUnavailable(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "ValidationException" && strings.Contains(aerr.Message(), "index")
+}
+
+// isResourceInUse reports whether a DDB error means the table is already there, e.g. on creating it again
+func isResourceInUse(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeResourceInUseException
+}
+
+// enableTableTTL turns on DDB Time To Live on ttlAttribute for a table.
+// Waits for the table to exist first, since a freshly created table can't be changed yet.
+func enableTableTTL(ctx context.Context, client *dynamodb.Client, table string) error {
+	if err := client.WaitUntilTableExists(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table)}); err != nil {
+		return err
+	}
+
+	ddbReq := client.UpdateTimeToLiveRequest(&dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(table),
+		TimeToLiveSpecification: &dynamodb.TimeToLiveSpecification{
+			AttributeName: aws.String(ttlAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	_, err := ddbReq.Send(ctx)
+	return err
+}
+
+func (s *dynamoStore) Create(ctx context.Context, blog *blogpb.Blog) error {
+	av, err := marshalBlog(blog)
+	if err != nil {
+		return err
+	}
+
+	ddbInput := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      av,
+	}
+
+	ddbReq := s.client.PutItemRequest(ddbInput)
+	if _, err := ddbReq.Send(ctx); err != nil { // DDB Response is empty on success (or just gives API request ID). Discarding.
+		return err
+	}
+	log.Printf("Successfully written to DDB!")
+	return nil
+}
+
+func (s *dynamoStore) Read(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	// Craft DDB request input
+	ddbInput := &dynamodb.GetItemInput{
+		Key:       s.key(blogID),
+		TableName: aws.String(s.table),
+	}
+
+	// Perform DDB Request
+	ddbReq := s.client.GetItemRequest(ddbInput)
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blog := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Item, blog); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+
+	// GetItem returns an empty item if the key doesn't exist. TTL can take a while to purge expired items
+	if blog.GetId() == "" || isExpired(blog, time.Now()) {
+		return nil, errBlogNotFound
+	}
+	return blog, nil
+}
+
+func (s *dynamoStore) Update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, expectedVersion int64) (*blogpb.Blog, error) {
+	if len(tags.Add) == 0 || len(tags.Remove) == 0 {
+		return s.update(ctx, blog, paths, tags, nil, expectedVersion)
+	}
+
+	// DDB can't ADD to and DELETE from the same set in one update. Work out the new set here instead,
+	// and only write it if nobody updated the blog in the meantime. Retry if somebody did, unless the caller pinned a version
+	for attempt := 1; ; attempt++ {
+		stored, err := s.Read(ctx, blog.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if isDeleted(stored) {
+			return nil, errBlogNotFound
+		}
+		if err := checkVersion(stored, expectedVersion); err != nil {
+			return nil, err
+		}
+
+		newTags := applyTagChanges(stored.GetTags(), tags)
+		updated, err := s.update(ctx, blog, paths, TagChanges{}, &newTags, stored.GetVersion())
+		if err == errVersionMismatch && expectedVersion == 0 && attempt < tagUpdateAttempts {
+			continue
+		}
+		return updated, err
+	}
+}
+
+// update is Update, with either tag changes to ADD/DELETE, or a whole new set of tags to SET (newTags)
+func (s *dynamoStore) update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, newTags *[]string, expectedVersion int64) (*blogpb.Blog, error) {
+	ddbCondition := "attribute_exists(id) AND attribute_not_exists(delete_time)" // Only update if ID existed in DDB table, and isn't deleted.
+
+	// DDB won't store empty strings, so SET the fields that have a value and REMOVE the ones that don't.
+	// Attribute names are aliased (#author_id etc.) in case one of them is a DDB reserved word.
+	updateTime, err := dynamodbattribute.Marshal(blog.GetUpdateTime())
+	if err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB marshal update time, %v", err)
+	}
+	names := map[string]string{
+		"#version":     "version",
+		"#update_time": "update_time",
+	}
+	values := map[string]dynamodb.AttributeValue{
+		":zero":        {N: aws.String("0")},
+		":one":         {N: aws.String("1")},
+		":update_time": *updateTime,
+	}
+	// Blogs written before versioning have no version attribute. Treat those as version 0
+	sets := []string{
+		"#version = if_not_exists(#version, :zero) + :one",
+		"#update_time = :update_time",
+	}
+	var removes []string
+	for _, path := range paths {
+		names["#"+path] = path
+		if value := blogField(blog, path); value != "" {
+			values[":"+path] = dynamodb.AttributeValue{S: aws.String(value)}
+			sets = append(sets, fmt.Sprintf("#%s = :%s", path, path))
+		} else {
+			removes = append(removes, "#"+path)
+		}
+	}
+
+	// Tags are a string set. DDB won't store an empty one, so REMOVE it instead
+	var adds, deletes []string
+	if newTags != nil {
+		names["#tags"] = "tags"
+		if len(*newTags) > 0 {
+			values[":tags"] = dynamodb.AttributeValue{SS: *newTags}
+			sets = append(sets, "#tags = :tags")
+		} else {
+			removes = append(removes, "#tags")
+		}
+	}
+	if len(tags.Add) > 0 {
+		names["#tags"] = "tags"
+		values[":add_tags"] = dynamodb.AttributeValue{SS: tags.Add}
+		adds = append(adds, "#tags :add_tags")
+	}
+	if len(tags.Remove) > 0 {
+		names["#tags"] = "tags"
+		values[":remove_tags"] = dynamodb.AttributeValue{SS: tags.Remove}
+		deletes = append(deletes, "#tags :remove_tags")
+	}
+
+	updateExpression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		updateExpression += " REMOVE " + strings.Join(removes, ", ")
+	}
+	if len(adds) > 0 {
+		updateExpression += " ADD " + strings.Join(adds, ", ")
+	}
+	if len(deletes) > 0 {
+		updateExpression += " DELETE " + strings.Join(deletes, ", ")
+	}
+
+	if expectedVersion != 0 { // Optimistic concurrency. Only update if nobody else did since the client read the blog
+		ddbCondition += " AND #version = :expected_version"
+		values[":expected_version"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expectedVersion, 10))}
+	}
+
+	// Craft DDB request input. Ask for the old values, they become a revision
+	input := &dynamodb.UpdateItemInput{
+		ConditionExpression:       aws.String(ddbCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Key:                       s.key(blog.GetId()),
+		ReturnValues:              dynamodb.ReturnValueAllOld,
+		TableName:                 aws.String(s.table),
+		UpdateExpression:          aws.String(updateExpression),
+	}
+
+	// Perform DDB Request
+	ddbReq := s.client.UpdateItemRequest(input)
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return nil, s.conditionFailure(ctx, blog.GetId())
+		}
+		return nil, err
+	}
+
+	previous := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Attributes, previous); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	log.Printf("Old values: %s", strings.ReplaceAll(ddbResp.String(), "\n", ""))
+
+	// The blog is already updated at this point. Losing a revision isn't worth failing the update over
+	if err := s.putRevision(ctx, previous); err != nil {
+		log.Printf("Could not store revision %v of blog %v: %v", previous.GetVersion(), previous.GetId(), err)
+	}
+
+	// Work out the new values the same way the update expression did
+	updated := cloneBlog(previous)
+	applyFieldMask(updated, blog, paths)
+	if newTags != nil {
+		updated.Tags = *newTags
+	} else {
+		updated.Tags = applyTagChanges(previous.GetTags(), tags)
+	}
+	updated.UpdateTime = blog.GetUpdateTime()
+	updated.Version++
+	return updated, nil
+}
+
+// putRevision stores a copy of blog, as it was before an update, in the revision table
+func (s *dynamoStore) putRevision(ctx context.Context, blog *blogpb.Blog) error {
+	av, err := marshalBlog(blog)
+	if err != nil {
+		return err
+	}
+	av["version"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(blog.GetVersion(), 10))} // Sort key. Blogs from before versioning are version 0
+
+	ddbReq := s.client.PutItemRequest(&dynamodb.PutItemInput{
+		TableName: aws.String(s.revisionTable),
+		Item:      av,
+	})
+	_, err = ddbReq.Send(ctx)
+	return err
+}
+
+func (s *dynamoStore) SetState(ctx context.Context, blog *blogpb.Blog, from []blogpb.Blog_State, expectedVersion int64) (*blogpb.Blog, error) {
+	updateTime, err := dynamodbattribute.Marshal(blog.GetUpdateTime())
+	if err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB marshal update time, %v", err)
+	}
+	names := map[string]string{
+		"#version":     "version",
+		"#update_time": "update_time",
+		"#state":       "state",
+	}
+	values := map[string]dynamodb.AttributeValue{
+		":zero":        {N: aws.String("0")},
+		":one":         {N: aws.String("1")},
+		":update_time": *updateTime,
+		":state":       {N: aws.String(strconv.Itoa(int(blog.GetState())))},
+	}
+	sets := []string{
+		"#version = if_not_exists(#version, :zero) + :one",
+		"#update_time = :update_time",
+		"#state = :state",
+	}
+	if blog.GetPublishTime() != nil {
+		publishTime, err := dynamodbattribute.Marshal(blog.GetPublishTime())
+		if err != nil {
+			return nil, fmt.Errorf("failed to DynamoDB marshal publish time, %v", err)
+		}
+		names["#publish_time"] = "publish_time"
+		values[":publish_time"] = *publishTime
+		sets = append(sets, "#publish_time = :publish_time")
+	}
+	// Keep publishIndex down to the drafts the publish worker still has to get to
+	names["#publish_at"] = publishAttribute
+	removes := " REMOVE #publish_at"
+	if isScheduled(blog) {
+		values[":publish_at"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(blog.GetPublishTime().GetSeconds(), 10))}
+		sets = append(sets, "#publish_at = :publish_at")
+		removes = ""
+	}
+
+	// Only if the blog exists, isn't deleted, and is in a state it can be moved from
+	ddbCondition := "attribute_exists(id) AND attribute_not_exists(delete_time) AND " + stateCondition(from, names, values)
+	if expectedVersion != 0 { // Optimistic concurrency. Only change the state if nobody updated the blog since the client read it
+		ddbCondition += " AND #version = :expected_version"
+		values[":expected_version"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expectedVersion, 10))}
+	}
+
+	ddbReq := s.client.UpdateItemRequest(&dynamodb.UpdateItemInput{
+		ConditionExpression:       aws.String(ddbCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Key:                       s.key(blog.GetId()),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+		TableName:                 aws.String(s.table),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ") + removes),
+	})
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		if !isConditionalCheckFailed(err) {
+			return nil, err
+		}
+		// Same as conditionFailure, with the state to check on top
+		stored, err := s.Read(ctx, blog.GetId())
+		if err != nil {
+			return nil, err
+		}
+		if isDeleted(stored) {
+			return nil, errBlogNotFound
+		}
+		if err := checkVersion(stored, expectedVersion); err != nil {
+			return nil, err
+		}
+		return nil, errInvalidStateChange
+	}
+
+	updated := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Attributes, updated); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	return updated, nil
+}
+
+func (s *dynamoStore) Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error {
+	ddbCondition := "attribute_exists(id) AND attribute_not_exists(delete_time)" // Can't delete what doesn't exist, or twice
+
+	deleteTime, err := dynamodbattribute.Marshal(blog.GetDeleteTime())
+	if err != nil {
+		return fmt.Errorf("failed to DynamoDB marshal delete time, %v", err)
+	}
+	names := map[string]string{
+		"#version":     "version",
+		"#delete_time": "delete_time",
+	}
+	values := map[string]dynamodb.AttributeValue{
+		":zero":        {N: aws.String("0")},
+		":one":         {N: aws.String("1")},
+		":delete_time": *deleteTime,
+	}
+	sets := []string{
+		"#version = if_not_exists(#version, :zero) + :one",
+		"#delete_time = :delete_time",
+	}
+
+	// DDB TTL needs a plain epoch seconds number, so the expire time is stored twice
+	if blog.GetExpireTime() != nil {
+		expireTime, err := dynamodbattribute.Marshal(blog.GetExpireTime())
+		if err != nil {
+			return fmt.Errorf("failed to DynamoDB marshal expire time, %v", err)
+		}
+		names["#expire_time"] = "expire_time"
+		names["#expire_at"] = ttlAttribute
+		values[":expire_time"] = *expireTime
+		values[":expire_at"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(blog.GetExpireTime().GetSeconds(), 10))}
+		sets = append(sets, "#expire_time = :expire_time", "#expire_at = :expire_at")
+	}
+
+	if expectedVersion != 0 { // Optimistic concurrency. Only delete if nobody updated the blog since the client read it
+		ddbCondition += " AND #version = :expected_version"
+		values[":expected_version"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(expectedVersion, 10))}
+	}
+
+	// Craft DDB request input
+	ddbInput := &dynamodb.UpdateItemInput{
+		ConditionExpression:       aws.String(ddbCondition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		Key:                       s.key(blog.GetId()),
+		ReturnValues:              dynamodb.ReturnValueAllNew,
+		TableName:                 aws.String(s.table),
+		UpdateExpression:          aws.String("SET " + strings.Join(sets, ", ")),
+	}
+
+	// Perform DDB Request
+	ddbReq := s.client.UpdateItemRequest(ddbInput)
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			return s.conditionFailure(ctx, blog.GetId())
+		}
+		return err
+	}
+	log.Printf("Deleted blog in DDB: %s", strings.ReplaceAll(ddbResp.String(), "\n", ""))
+	return nil
+}
+
+func (s *dynamoStore) Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	// Only undelete if the blog is deleted, and TTL just hasn't gotten around to purging it yet
+	ddbCondition := "attribute_exists(delete_time) AND (attribute_not_exists(#expire_at) OR #expire_at > :now)"
+
+	ddbInput := &dynamodb.UpdateItemInput{
+		ConditionExpression: aws.String(ddbCondition),
+		ExpressionAttributeNames: map[string]string{
+			"#version":     "version",
+			"#delete_time": "delete_time",
+			"#expire_time": "expire_time",
+			"#expire_at":   ttlAttribute,
+		},
+		ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+			":zero": {N: aws.String("0")},
+			":one":  {N: aws.String("1")},
+			":now":  {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+		Key:              s.key(blogID),
+		ReturnValues:     dynamodb.ReturnValueAllNew,
+		TableName:        aws.String(s.table),
+		UpdateExpression: aws.String("SET #version = if_not_exists(#version, :zero) + :one REMOVE #delete_time, #expire_time, #expire_at"),
+	}
+
+	ddbReq := s.client.UpdateItemRequest(ddbInput)
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		if isConditionalCheckFailed(err) {
+			// Either there's no such blog (or it expired), or it isn't deleted
+			blog, err := s.Read(ctx, blogID)
+			if err != nil {
+				return nil, err
+			}
+			if !isDeleted(blog) {
+				return nil, errBlogNotDeleted
+			}
+			return nil, errBlogNotFound // Expired between the UpdateItem and the GetItem
+		}
+		return nil, err
+	}
+
+	blog := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Attributes, blog); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	return blog, nil
+}
+
+func (s *dynamoStore) List(ctx context.Context, opts ListOptions, fn func(*blogpb.Blog) error) (string, error) {
+	filter := newListFilter(opts, time.Now())
+
+	// Filtering by author queries the author index. Everything else is a full table scan
+	fetch := func(ctx context.Context, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error) {
+		return s.scanPage(ctx, "", filter, startKey, limit)
+	}
+	if opts.AuthorID != "" {
+		fetch = func(ctx context.Context, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error) {
+			return s.queryAuthorPage(ctx, opts.AuthorID, filter, startKey, limit)
+		}
+	}
+
+	if opts.ordered() {
+		// DDB only hands items back in key order. Load every match and sort them here instead
+		var blogs []*blogpb.Blog
+		_, err := s.fetchPages(ctx, fetch, nil, 0, func(blog *blogpb.Blog) error {
+			blogs = append(blogs, blog)
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return listLoaded(ctx, blogs, opts, fn)
+	}
+
+	startKey, err := decodePageToken(opts.PageToken)
+	if err != nil {
+		return "", err
+	}
+	lastEvaluatedKey, err := s.fetchPages(ctx, fetch, toAttributeValues(startKey), opts.PageSize, fn)
+	if err != nil {
+		return "", err
+	}
+	return encodePageToken(fromAttributeValues(lastEvaluatedKey)), nil
+}
+
+func (s *dynamoStore) ListDue(ctx context.Context, now time.Time, fn func(*blogpb.Blog) error) error {
+	filter := &listFilter{
+		expression: "#publish_at <= :now AND attribute_not_exists(#delete_time)",
+		names: map[string]string{
+			"#publish_at":  publishAttribute,
+			"#delete_time": "delete_time",
+		},
+		values: map[string]dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	}
+
+	// Scanning the sparse index only reads the scheduled drafts, not the whole table
+	index := publishIndex
+	fetch := func(ctx context.Context, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error) {
+		p, err := s.scanPage(ctx, index, filter, startKey, limit)
+		if isIndexUnavailable(err) && startKey == nil {
+			// An older table still getting the index, see addMissingIndexes
+			log.Printf("Can't scan DynamoDB index %v, scanning the table instead: %v", publishIndex, err)
+			index = ""
+			return s.scanPage(ctx, index, filter, startKey, limit)
+		}
+		return p, err
+	}
+	_, err := s.fetchPages(ctx, fetch, nil, 0, func(blog *blogpb.Blog) error {
+		if !isDue(blog, now) { // publish_at is only down to the second
+			return nil
+		}
+		return fn(blog)
+	})
+	return err
+}
+
+func (s *dynamoStore) ListRevisions(ctx context.Context, blogID string) ([]*blogpb.Blog, error) {
+	// TTL purges expired blogs but not their revisions. Only list revisions of blogs that are still around
+	if _, err := s.Read(ctx, blogID); err != nil {
+		return nil, err
+	}
+
+	var revisions []*blogpb.Blog
+	var startKey map[string]dynamodb.AttributeValue
+	for {
+		ddbReq := s.client.QueryRequest(&dynamodb.QueryInput{
+			ExclusiveStartKey:        startKey,
+			ExpressionAttributeNames: map[string]string{"#id": "id"},
+			ExpressionAttributeValues: map[string]dynamodb.AttributeValue{
+				":id": {S: aws.String(blogID)},
+			},
+			KeyConditionExpression: aws.String("#id = :id"),
+			ScanIndexForward:       aws.Bool(true), // Oldest version first
+			TableName:              aws.String(s.revisionTable),
+		})
+		ddbResp, err := ddbReq.Send(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query DynamoDB table %v: %v", s.revisionTable, err)
+		}
+
+		for _, item := range ddbResp.Items {
+			revision := &blogpb.Blog{}
+			if err := dynamodbattribute.UnmarshalMap(item, revision); err != nil {
+				return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+			}
+			revisions = append(revisions, revision)
+		}
+
+		if len(ddbResp.LastEvaluatedKey) == 0 {
+			return revisions, nil
+		}
+		startKey = ddbResp.LastEvaluatedKey
+	}
+}
+
+func (s *dynamoStore) ReadRevision(ctx context.Context, blogID string, version int64) (*blogpb.Blog, error) {
+	// The revision table doesn't know about deletes, the blog table does
+	blog, err := s.Read(ctx, blogID)
+	if err != nil {
+		return nil, err
+	}
+	if isDeleted(blog) {
+		return nil, errBlogNotFound
+	}
+
+	ddbReq := s.client.GetItemRequest(&dynamodb.GetItemInput{
+		Key: map[string]dynamodb.AttributeValue{
+			"id":      {S: aws.String(blogID)},
+			"version": {N: aws.String(strconv.FormatInt(version, 10))},
+		},
+		TableName: aws.String(s.revisionTable),
+	})
+	ddbResp, err := ddbReq.Send(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &blogpb.Blog{}
+	if err := dynamodbattribute.UnmarshalMap(ddbResp.Item, revision); err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+	}
+	if revision.GetId() == "" { // GetItem returns an empty item if the key doesn't exist
+		return nil, errRevisionNotFound
+	}
+	return revision, nil
+}
+
+// listFilter is the FilterExpression List applies on top of a Scan or Query
+type listFilter struct {
+	expression string
+	names      map[string]string
+	values     map[string]dynamodb.AttributeValue
+}
+
+// newListFilter hides expired blogs, and deleted ones unless opts asks for them. Also filters on opts.Tag and opts.States
+func newListFilter(opts ListOptions, now time.Time) *listFilter {
+	f := &listFilter{
+		names:  map[string]string{},
+		values: map[string]dynamodb.AttributeValue{},
+	}
+	if opts.ShowDeleted {
+		f.expression = "(attribute_not_exists(#expire_at) OR #expire_at > :now)"
+		f.names["#expire_at"] = ttlAttribute
+		f.values[":now"] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(now.Unix(), 10))}
+	} else {
+		f.expression = "attribute_not_exists(#delete_time)" // Never expired either, only deleted blogs expire
+		f.names["#delete_time"] = "delete_time"
+	}
+	if opts.Tag != "" {
+		f.expression += " AND contains(#tags, :tag)"
+		f.names["#tags"] = "tags"
+		f.values[":tag"] = dynamodb.AttributeValue{S: aws.String(opts.Tag)}
+	}
+	f.expression += " AND " + stateCondition(opts.states(), f.names, f.values)
+	return f
+}
+
+// withAuthor returns a copy of the filter that also only lets through blogs by authorID
+func (f *listFilter) withAuthor(authorID string) *listFilter {
+	withAuthor := &listFilter{
+		expression: f.expression + " AND #author_id = :author_id",
+		names:      map[string]string{"#author_id": "author_id"},
+		values:     map[string]dynamodb.AttributeValue{":author_id": {S: aws.String(authorID)}},
+	}
+	for k, v := range f.names {
+		withAuthor.names[k] = v
+	}
+	for k, v := range f.values {
+		withAuthor.values[k] = v
+	}
+	return withAuthor
+}
+
+// stateCondition builds a condition (or filter) expression matching blogs in any of states, adding the names and values it uses.
+// PUBLISHED is the zero state, which the attribute marshaller leaves out (as do blogs from before states), so it also matches no state at all.
+func stateCondition(states []blogpb.Blog_State, names map[string]string, values map[string]dynamodb.AttributeValue) string {
+	names["#state"] = "state"
+	var terms []string
+	for _, state := range states {
+		value := fmt.Sprintf(":state_%d", state)
+		values[value] = dynamodb.AttributeValue{N: aws.String(strconv.Itoa(int(state)))}
+		terms = append(terms, "#state = "+value)
+		if state == blogpb.Blog_PUBLISHED {
+			terms = append(terms, "attribute_not_exists(#state)")
+		}
+	}
+	return "(" + strings.Join(terms, " OR ") + ")"
+}
+
+// fetchPages calls fn for up to pageSize items (0 for all of them) returned by fetch, starting after startKey.
+// Returns the LastEvaluatedKey to resume from, or nil at the end of the table.
+//
+// Pages through DDB by hand (instead of with dynamodb.NewScanPaginator) so we
+// can stop at pageSize and hand the LastEvaluatedKey back to the client.
+func (s *dynamoStore) fetchPages(ctx context.Context, fetch fetchFunc, startKey map[string]dynamodb.AttributeValue, pageSize int, fn func(*blogpb.Blog) error) (map[string]dynamodb.AttributeValue, error) {
+	remaining := pageSize
+	for {
+		var limit *int64
+		if pageSize > 0 {
+			limit = aws.Int64(int64(remaining))
+		}
+
+		p, err := fetch(ctx, startKey, limit)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range p.items {
+			blog := &blogpb.Blog{}
+			if err := dynamodbattribute.UnmarshalMap(item, blog); err != nil {
+				return nil, fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+			}
+			if err := fn(blog); err != nil {
+				return nil, err
+			}
+		}
+		remaining -= len(p.items)
+
+		if len(p.lastEvaluatedKey) == 0 { // End of the table
+			return nil, nil
+		}
+		if pageSize > 0 && remaining <= 0 { // Page is full. Let the client come back for more
+			return p.lastEvaluatedKey, nil
+		}
+		startKey = p.lastEvaluatedKey
+	}
+}
+
+// fetchFunc gets one page of up to limit items (nil for DDB's 1MB default) from a Scan or Query.
+// Filtered out items count towards the limit, so a page can come back short (even empty) with more to come.
+type fetchFunc func(ctx context.Context, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error)
+
+// page is one DDB Scan or Query response, boiled down to what List needs
+type page struct {
+	items            []map[string]dynamodb.AttributeValue
+	lastEvaluatedKey map[string]dynamodb.AttributeValue
+}
+
+// scanPage scans one page of the blog table, or of one of its blogIndexes if index isn't ""
+func (s *dynamoStore) scanPage(ctx context.Context, index string, filter *listFilter, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error) {
+	ddbInput := &dynamodb.ScanInput{
+		ExclusiveStartKey:         startKey,
+		ExpressionAttributeNames:  filter.names,
+		ExpressionAttributeValues: nonEmpty(filter.values),
+		FilterExpression:          aws.String(filter.expression),
+		Limit:                     limit,
+		TableName:                 aws.String(s.table),
+	}
+	if index != "" {
+		ddbInput.IndexName = aws.String(index)
+	}
+	ddbResp, err := s.client.ScanRequest(ddbInput).Send(ctx)
+	if isIndexUnavailable(err) {
+		return nil, err // Unwrapped, so the caller can fall back to scanning the table
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan DynamoDB: %v", err)
+	}
+	log.Printf("%v", ddbResp)
+
+	return &page{
+		items:            ddbResp.Items,
+		lastEvaluatedKey: ddbResp.LastEvaluatedKey,
+	}, nil
+}
+
+func (s *dynamoStore) queryAuthorPage(ctx context.Context, authorID string, filter *listFilter, startKey map[string]dynamodb.AttributeValue, limit *int64) (*page, error) {
+	names := map[string]string{
+		"#A": "author_id",
+	}
+	values := map[string]dynamodb.AttributeValue{
+		":a": {
+			S: aws.String(authorID),
+		},
+	}
+	for k, v := range filter.names {
+		names[k] = v
+	}
+	for k, v := range filter.values {
+		values[k] = v
+	}
+
+	ddbReq := s.client.QueryRequest(&dynamodb.QueryInput{
+		ExclusiveStartKey:         startKey,
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		FilterExpression:          aws.String(filter.expression),
+		IndexName:                 aws.String(authorIndex),
+		KeyConditionExpression:    aws.String("#A = :a"),
+		Limit:                     limit,
+		TableName:                 aws.String(s.table),
+	})
+	ddbResp, err := ddbReq.Send(ctx)
+	if isIndexUnavailable(err) {
+		// An older table still getting the index, see addMissingIndexes. Slow, but the results are right
+		log.Printf("Can't query DynamoDB index %v, scanning instead: %v", authorIndex, err)
+		return s.scanPage(ctx, "", filter.withAuthor(authorID), startKey, limit)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DynamoDB index %v: %v", authorIndex, err)
+	}
+	log.Printf("%v", ddbResp)
+
+	return &page{
+		items:            ddbResp.Items,
+		lastEvaluatedKey: ddbResp.LastEvaluatedKey,
+	}, nil
+}
+
+// conditionFailure works out why a conditional write on blogID failed.
+// DDB only says that the condition failed, not whether the blog is gone or was at another version.
+func (s *dynamoStore) conditionFailure(ctx context.Context, blogID string) error {
+	blog, err := s.Read(ctx, blogID)
+	if err != nil {
+		return err // errBlogNotFound, or whatever stopped us from finding out
+	}
+	if isDeleted(blog) {
+		return errBlogNotFound
+	}
+	return errVersionMismatch
+}
+
+// marshalBlog turns a blog into a DDB item. Tags are stored as a string set, which the
+// attribute marshaller won't do for a plain []string (and DDB won't take an empty one).
+// Scheduled drafts get publishAttribute, which puts them in publishIndex, see SetState
+func marshalBlog(blog *blogpb.Blog) (map[string]dynamodb.AttributeValue, error) {
+	av, err := dynamodbattribute.MarshalMap(blog) // From DDB docos. You can marshal arbitrary structs as long as the ID format matches!
+	if err != nil {
+		return nil, fmt.Errorf("failed to DynamoDB marshal Record, %v", err)
+	}
+	delete(av, "tags")
+	if len(blog.GetTags()) > 0 {
+		av["tags"] = dynamodb.AttributeValue{SS: blog.GetTags()}
+	}
+	if isScheduled(blog) {
+		av[publishAttribute] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(blog.GetPublishTime().GetSeconds(), 10))}
+	}
+	return av, nil
+}
+
+// nonEmpty returns nil for an empty map. DDB rejects empty ExpressionAttributeValues
+func nonEmpty(values map[string]dynamodb.AttributeValue) map[string]dynamodb.AttributeValue {
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// isConditionalCheckFailed reports whether a DDB write failed on its ConditionExpression
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// key builds the DDB primary key for a blog ID
+func (s *dynamoStore) key(blogID string) map[string]dynamodb.AttributeValue {
+	return map[string]dynamodb.AttributeValue{
+		"id": {
+			S: aws.String(blogID),
+		},
+	}
+}
+
+// toAttributeValues converts a decoded page token back into a DDB ExclusiveStartKey.
+// All of our key attributes are strings.
+func toAttributeValues(key map[string]string) map[string]dynamodb.AttributeValue {
+	if len(key) == 0 {
+		return nil
+	}
+	av := make(map[string]dynamodb.AttributeValue, len(key))
+	for k, v := range key {
+		av[k] = dynamodb.AttributeValue{S: aws.String(v)}
+	}
+	return av
+}
+
+// fromAttributeValues converts a DDB LastEvaluatedKey into something encodePageToken can handle
+func fromAttributeValues(av map[string]dynamodb.AttributeValue) map[string]string {
+	if len(av) == 0 {
+		return nil
+	}
+	key := make(map[string]string, len(av))
+	for k, v := range av {
+		key[k] = aws.StringValue(v.S)
+	}
+	return key
+}
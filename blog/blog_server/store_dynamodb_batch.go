@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/dynamodbattribute"
+)
+
+// DDB limits on how many items go in a single BatchWriteItem / BatchGetItem call
+var (
+	batchWriteLimit = 25
+	batchGetLimit   = 100
+)
+
+// UnprocessedItems (usually throttling) are retried this many times, backing off exponentially from batchBackoff
+var (
+	batchRetries = 5
+	batchBackoff = 50 * time.Millisecond
+)
+
+func (s *dynamoStore) BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	index := make(map[string]int, len(blogs)) // Blog ID to position in blogs
+	var requests []dynamodb.WriteRequest
+	for i, blog := range blogs {
+		av, err := marshalBlog(blog)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		index[blog.GetId()] = i
+		requests = append(requests, dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: av}})
+	}
+
+	for blogID, err := range batchWrite(ctx, s.client, s.table, requests) {
+		errs[index[blogID]] = err
+	}
+	return errs
+}
+
+func (s *dynamoStore) BatchRead(ctx context.Context, blogIDs []string) ([]*blogpb.Blog, []error) {
+	blogs := make([]*blogpb.Blog, len(blogIDs))
+	errs := make([]error, len(blogIDs))
+
+	items, failed := s.batchGet(ctx, blogIDs)
+	now := time.Now()
+	for i, blogID := range blogIDs {
+		if err, ok := failed[blogID]; ok {
+			errs[i] = err
+			continue
+		}
+		item, ok := items[blogID]
+		if !ok {
+			errs[i] = errBlogNotFound
+			continue
+		}
+		blog := &blogpb.Blog{}
+		if err := dynamodbattribute.UnmarshalMap(item, blog); err != nil {
+			errs[i] = fmt.Errorf("failed to DynamoDB unmarshal Record, %v", err)
+			continue
+		}
+		if isExpired(blog, now) { // TTL can take a while to purge expired items
+			errs[i] = errBlogNotFound
+			continue
+		}
+		blogs[i] = blog
+	}
+	return blogs, errs
+}
+
+// BatchDelete reads the blogs and writes them back deleted, since BatchWriteItem can only put whole items.
+// It can't have a condition either, so an update that lands in between is overwritten.
+// Callers that care use DeleteBlog with an expected version instead.
+func (s *dynamoStore) BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	blogIDs := make([]string, len(blogs))
+	for i, blog := range blogs {
+		blogIDs[i] = blog.GetId()
+	}
+	stored, readErrs := s.BatchRead(ctx, blogIDs)
+
+	index := make(map[string]int, len(blogs))
+	var requests []dynamodb.WriteRequest
+	for i, blog := range blogs {
+		if readErrs[i] != nil {
+			errs[i] = readErrs[i]
+			continue
+		}
+		if isDeleted(stored[i]) {
+			errs[i] = errBlogNotFound
+			continue
+		}
+
+		deleted := stored[i]
+		deleted.DeleteTime = blog.GetDeleteTime()
+		deleted.ExpireTime = blog.GetExpireTime()
+		deleted.Version++
+		av, err := marshalBlog(deleted)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if blog.GetExpireTime() != nil { // Same TTL attribute Delete sets
+			av[ttlAttribute] = dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(blog.GetExpireTime().GetSeconds(), 10))}
+		}
+		index[blog.GetId()] = i
+		requests = append(requests, dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: av}})
+	}
+
+	for blogID, err := range batchWrite(ctx, s.client, s.table, requests) {
+		errs[index[blogID]] = err
+	}
+	return errs
+}
+
+// batchWrite sends requests to a table, batchWriteLimit at a time, retrying whatever DDB leaves unprocessed.
+// Returns the errors of the requests that didn't make it, keyed on item "id" (see writeRequestID).
+func batchWrite(ctx context.Context, client *dynamodb.Client, table string, requests []dynamodb.WriteRequest) map[string]error {
+	failed := map[string]error{}
+	fail := func(requests []dynamodb.WriteRequest, err error) {
+		for _, request := range requests {
+			failed[writeRequestID(request)] = err
+		}
+	}
+
+	for start := 0; start < len(requests); start += batchWriteLimit {
+		end := start + batchWriteLimit
+		if end > len(requests) {
+			end = len(requests)
+		}
+
+		pending := requests[start:end]
+		err := retryBatch(ctx, func() (int, error) {
+			ddbReq := client.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]dynamodb.WriteRequest{table: pending},
+			})
+			ddbResp, err := ddbReq.Send(ctx)
+			if err != nil {
+				return len(pending), err
+			}
+			pending = ddbResp.UnprocessedItems[table]
+			return len(pending), nil
+		})
+		if err != nil {
+			fail(pending, err)
+		}
+	}
+	return failed
+}
+
+// batchGet gets blogs from the blog table, batchGetLimit at a time, retrying whatever DDB leaves unprocessed.
+// Returns the items found and the errors of the ones that couldn't be fetched, both keyed on blog ID.
+// Missing blogs are in neither.
+func (s *dynamoStore) batchGet(ctx context.Context, blogIDs []string) (map[string]map[string]dynamodb.AttributeValue, map[string]error) {
+	items := map[string]map[string]dynamodb.AttributeValue{}
+	failed := map[string]error{}
+	fail := func(keys []map[string]dynamodb.AttributeValue, err error) {
+		for _, key := range keys {
+			failed[aws.StringValue(key["id"].S)] = err
+		}
+	}
+
+	// DDB rejects a batch that asks for the same key twice
+	var keys []map[string]dynamodb.AttributeValue
+	seen := map[string]bool{}
+	for _, blogID := range blogIDs {
+		if !seen[blogID] {
+			seen[blogID] = true
+			keys = append(keys, s.key(blogID))
+		}
+	}
+
+	for start := 0; start < len(keys); start += batchGetLimit {
+		end := start + batchGetLimit
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pending := keys[start:end]
+		err := retryBatch(ctx, func() (int, error) {
+			ddbReq := s.client.BatchGetItemRequest(&dynamodb.BatchGetItemInput{
+				RequestItems: map[string]dynamodb.KeysAndAttributes{
+					s.table: {Keys: pending},
+				},
+			})
+			ddbResp, err := ddbReq.Send(ctx)
+			if err != nil {
+				return len(pending), err
+			}
+			for _, item := range ddbResp.Responses[s.table] {
+				items[aws.StringValue(item["id"].S)] = item
+			}
+			pending = ddbResp.UnprocessedKeys[s.table].Keys
+			return len(pending), nil
+		})
+		if err != nil {
+			fail(pending, err)
+		}
+	}
+	return items, failed
+}
+
+// retryBatch calls send until it has nothing left unprocessed, backing off between attempts, see batchSleep.
+// send sends whatever is still pending and returns how much of it DDB left unprocessed.
+// Gives up with errBatchIncomplete after batchRetries attempts, or with the error send or ctx ran into.
+// Either way, whatever send still had pending didn't make it
+func retryBatch(ctx context.Context, send func() (unprocessed int, err error)) error {
+	for attempt := 0; attempt < batchRetries; attempt++ {
+		if err := batchSleep(ctx, attempt); err != nil {
+			return err
+		}
+		unprocessed, err := send()
+		if err != nil {
+			return err
+		}
+		if unprocessed == 0 {
+			return nil
+		}
+	}
+	return errBatchIncomplete
+}
+
+// batchSleep backs off before a retry. Doesn't sleep before the first attempt
+func batchSleep(ctx context.Context, attempt int) error {
+	if attempt == 0 {
+		return nil
+	}
+	t := time.NewTimer(batchBackoff << uint(attempt-1))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// writeRequestID returns the ID of the blog (or comment) a BatchWriteItem request is for
+func writeRequestID(request dynamodb.WriteRequest) string {
+	if request.PutRequest != nil {
+		return aws.StringValue(request.PutRequest.Item["id"].S)
+	}
+	return aws.StringValue(request.DeleteRequest.Key["id"].S)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryBatch(t *testing.T) {
+	saved := batchBackoff
+	batchBackoff = time.Millisecond
+	defer func() { batchBackoff = saved }()
+
+	failure := errors.New("throttled for good")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		unprocessed []int // What each send leaves unprocessed. Runs out into "all of it"
+		sendErr     error // Returned by the last send in unprocessed
+		wantSends   int
+		wantErr     error
+	}{
+		{name: "all at once", ctx: context.Background(), unprocessed: []int{0}, wantSends: 1},
+		{name: "some left over", ctx: context.Background(), unprocessed: []int{10, 3, 0}, wantSends: 3},
+		{name: "never done", ctx: context.Background(), wantSends: batchRetries, wantErr: errBatchIncomplete},
+		{name: "send fails", ctx: context.Background(), unprocessed: []int{3, 3}, sendErr: failure, wantSends: 2, wantErr: failure},
+		{name: "cancelled while backing off", ctx: cancelled, unprocessed: []int{3}, wantSends: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		sends := 0
+		err := retryBatch(tt.ctx, func() (int, error) {
+			sends++
+			if sends > len(tt.unprocessed) {
+				return 5, nil
+			}
+			if sends == len(tt.unprocessed) && tt.sendErr != nil {
+				return tt.unprocessed[sends-1], tt.sendErr
+			}
+			return tt.unprocessed[sends-1], nil
+		})
+		if err != tt.wantErr || sends != tt.wantSends {
+			t.Errorf("%v: retryBatch = %v after %v sends, want %v after %v", tt.name, err, sends, tt.wantErr, tt.wantSends)
+		}
+	}
+}
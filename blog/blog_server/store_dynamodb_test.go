@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/ptypes/timestamp"
+)
+
+func TestMarshalBlogPublishAt(t *testing.T) {
+	publishTime := &timestamp.Timestamp{Seconds: 1563000000}
+	tests := []struct {
+		name string
+		blog *blogpb.Blog
+		want string // publishAttribute, "" if it shouldn't be there
+	}{
+		{name: "scheduled draft", blog: &blogpb.Blog{Id: "a", State: blogpb.Blog_DRAFT, PublishTime: publishTime}, want: "1563000000"},
+		{name: "unscheduled draft", blog: &blogpb.Blog{Id: "a", State: blogpb.Blog_DRAFT}},
+		{name: "published", blog: &blogpb.Blog{Id: "a", State: blogpb.Blog_PUBLISHED, PublishTime: publishTime}},
+		{name: "archived", blog: &blogpb.Blog{Id: "a", State: blogpb.Blog_ARCHIVED, PublishTime: publishTime}},
+	}
+	for _, tt := range tests {
+		av, err := marshalBlog(tt.blog)
+		if err != nil {
+			t.Errorf("%v: marshalBlog: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if value, ok := av[publishAttribute]; ok {
+			got = *value.N
+		}
+		if got != tt.want {
+			t.Errorf("%v: %v = %q, want %q", tt.name, publishAttribute, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/proto"
+)
+
+// memoryStore is a BlogStore that keeps blogs in a map. Nothing survives a restart.
+// Handy for running the server without Docker or DynamoDB.
+type memoryStore struct {
+	mu        sync.RWMutex
+	blogs     map[string]*blogpb.Blog
+	revisions map[string][]*blogpb.Blog // Blog ID to previous versions, oldest first
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		blogs:     make(map[string]*blogpb.Blog),
+		revisions: make(map[string][]*blogpb.Blog),
+	}
+}
+
+func (s *memoryStore) Create(ctx context.Context, blog *blogpb.Blog) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blogs[blog.GetId()] = cloneBlog(blog)
+	return nil
+}
+
+func (s *memoryStore) Read(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	blog, err := s.get(blogID)
+	if err != nil {
+		return nil, err
+	}
+	return cloneBlog(blog), nil
+}
+
+func (s *memoryStore) Update(ctx context.Context, blog *blogpb.Blog, paths []string, tags TagChanges, expectedVersion int64) (*blogpb.Blog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.get(blog.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if isDeleted(stored) {
+		return nil, errBlogNotFound
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return nil, err
+	}
+	s.revisions[stored.GetId()] = append(s.revisions[stored.GetId()], cloneBlog(stored))
+	applyFieldMask(stored, blog, paths)
+	stored.Tags = applyTagChanges(stored.GetTags(), tags)
+	stored.UpdateTime = blog.GetUpdateTime()
+	stored.Version++
+	return cloneBlog(stored), nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, blog *blogpb.Blog, expectedVersion int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.get(blog.GetId())
+	if err != nil {
+		return err
+	}
+	if isDeleted(stored) {
+		return errBlogNotFound
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return err
+	}
+	stored.DeleteTime = blog.GetDeleteTime()
+	stored.ExpireTime = blog.GetExpireTime()
+	stored.Version++
+	return nil
+}
+
+func (s *memoryStore) SetState(ctx context.Context, blog *blogpb.Blog, from []blogpb.Blog_State, expectedVersion int64) (*blogpb.Blog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.get(blog.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if isDeleted(stored) {
+		return nil, errBlogNotFound
+	}
+	if err := checkVersion(stored, expectedVersion); err != nil {
+		return nil, err
+	}
+	if !hasState(stored, from) {
+		return nil, errInvalidStateChange
+	}
+	applyState(stored, blog)
+	stored.UpdateTime = blog.GetUpdateTime()
+	stored.Version++
+	return cloneBlog(stored), nil
+}
+
+func (s *memoryStore) Undelete(ctx context.Context, blogID string) (*blogpb.Blog, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, err := s.get(blogID)
+	if err != nil {
+		return nil, err
+	}
+	if !isDeleted(stored) {
+		return nil, errBlogNotDeleted
+	}
+	stored.DeleteTime = nil
+	stored.ExpireTime = nil
+	stored.Version++
+	return cloneBlog(stored), nil
+}
+
+func (s *memoryStore) BatchCreate(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	for i, blog := range blogs {
+		errs[i] = s.Create(ctx, blog)
+	}
+	return errs
+}
+
+func (s *memoryStore) BatchRead(ctx context.Context, blogIDs []string) ([]*blogpb.Blog, []error) {
+	blogs := make([]*blogpb.Blog, len(blogIDs))
+	errs := make([]error, len(blogIDs))
+	for i, blogID := range blogIDs {
+		blogs[i], errs[i] = s.Read(ctx, blogID)
+	}
+	return blogs, errs
+}
+
+func (s *memoryStore) BatchDelete(ctx context.Context, blogs []*blogpb.Blog) []error {
+	errs := make([]error, len(blogs))
+	for i, blog := range blogs {
+		errs[i] = s.Delete(ctx, blog, 0)
+	}
+	return errs
+}
+
+func (s *memoryStore) List(ctx context.Context, opts ListOptions, fn func(*blogpb.Blog) error) (string, error) {
+	// Copy out under the lock so fn (usually a stream.Send) never runs while holding it.
+	// Purge expired blogs while we're at it, nothing else will.
+	now := time.Now()
+	s.mu.Lock()
+	blogs := make([]*blogpb.Blog, 0, len(s.blogs))
+	for id, blog := range s.blogs {
+		if isExpired(blog, now) {
+			delete(s.blogs, id)
+			delete(s.revisions, id)
+			continue
+		}
+		blogs = append(blogs, cloneBlog(blog))
+	}
+	s.mu.Unlock()
+
+	return listLoaded(ctx, blogs, opts, fn)
+}
+
+func (s *memoryStore) ListDue(ctx context.Context, now time.Time, fn func(*blogpb.Blog) error) error {
+	return listDueLoaded(ctx, s, now, fn)
+}
+
+func (s *memoryStore) ListRevisions(ctx context.Context, blogID string) ([]*blogpb.Blog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, err := s.get(blogID); err != nil {
+		return nil, err
+	}
+	revisions := make([]*blogpb.Blog, 0, len(s.revisions[blogID]))
+	for _, revision := range s.revisions[blogID] {
+		revisions = append(revisions, cloneBlog(revision))
+	}
+	return revisions, nil
+}
+
+func (s *memoryStore) ReadRevision(ctx context.Context, blogID string, version int64) (*blogpb.Blog, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if blog, err := s.get(blogID); err != nil || isDeleted(blog) {
+		return nil, errBlogNotFound
+	}
+	for _, revision := range s.revisions[blogID] {
+		if revision.GetVersion() == version {
+			return cloneBlog(revision), nil
+		}
+	}
+	return nil, errRevisionNotFound
+}
+
+// get returns the stored blog (not a copy), or errBlogNotFound if it's missing or expired.
+// s.mu must be held.
+func (s *memoryStore) get(blogID string) (*blogpb.Blog, error) {
+	blog, ok := s.blogs[blogID]
+	if !ok || isExpired(blog, time.Now()) {
+		return nil, errBlogNotFound
+	}
+	return blog, nil
+}
+
+// cloneBlog deep-copies a blog so callers can't mutate what's stored
+func cloneBlog(blog *blogpb.Blog) *blogpb.Blog {
+	return proto.Clone(blog).(*blogpb.Blog)
+}
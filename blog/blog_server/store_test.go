@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Kaurin/gRPC/blog/blogpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+)
+
+// testStores are the BlogStores the store tests run against, so they all keep the same contract
+var testStores = []struct {
+	name string
+	open func(t *testing.T) BlogStore // An empty store, gone after the test
+}{
+	{name: "memory", open: func(*testing.T) BlogStore { return newMemoryStore() }},
+	{name: "bolt", open: func(t *testing.T) BlogStore {
+		s, err := newBoltStore(filepath.Join(t.TempDir(), "blogs.db"))
+		if err != nil {
+			t.Fatalf("newBoltStore: %v", err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+// forEachStore runs test against an empty store of each of testStores
+func forEachStore(t *testing.T, test func(t *testing.T, s BlogStore)) {
+	for _, store := range testStores {
+		t.Run(store.name, func(t *testing.T) {
+			test(t, store.open(t))
+		})
+	}
+}
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	tests := []map[string]string{
+		nil,
+		{"after": "some-blog-id"},
+		{"id": "a", "create_time": "00000000001563000000.000000000/a"},
+	}
+	for _, key := range tests {
+		got, err := decodePageToken(encodePageToken(key))
+		if err != nil {
+			t.Errorf("decodePageToken(encodePageToken(%v)): %v", key, err)
+			continue
+		}
+		if len(key) == 0 && got != nil || len(key) > 0 && !reflect.DeepEqual(got, key) {
+			t.Errorf("decodePageToken(encodePageToken(%v)) = %v", key, got)
+		}
+	}
+}
+
+func TestDecodePageTokenRejectsGarbage(t *testing.T) {
+	for _, token := range []string{"not base64!", "bm90IGpzb24", "WzEsMl0"} { // The last two are "not json" and "[1,2]"
+		if _, err := decodePageToken(token); err != errInvalidPageToken {
+			t.Errorf("decodePageToken(%q) error = %v, want %v", token, err, errInvalidPageToken)
+		}
+	}
+}
+
+// listPages lists every page of s with opts, and returns the titles in the order they came
+func listPages(t *testing.T, s BlogStore, opts ListOptions) []string {
+	t.Helper()
+	var titles []string
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("List with %+v never ran out of pages", opts)
+		}
+		next, err := s.List(context.Background(), opts, func(blog *blogpb.Blog) error {
+			titles = append(titles, blog.GetTitle())
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("List with %+v: %v", opts, err)
+		}
+		if next == "" {
+			return titles
+		}
+		opts.PageToken = next
+	}
+}
+
+func TestListPaging(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		for i := 0; i < 7; i++ {
+			testBlog(t, s, fmt.Sprintf("blog %v", i)) // Created in order, so CREATE_TIME order is title order
+		}
+		drafts := []blogpb.Blog_State{blogpb.Blog_DRAFT}
+
+		tests := []struct {
+			orderBy    blogpb.ListBlogRequest_OrderBy
+			descending bool
+		}{
+			{blogpb.ListBlogRequest_ID, false},
+			{blogpb.ListBlogRequest_CREATE_TIME, false},
+			{blogpb.ListBlogRequest_CREATE_TIME, true},
+			{blogpb.ListBlogRequest_UPDATE_TIME, true},
+		}
+		for _, tt := range tests {
+			all := listPages(t, s, ListOptions{States: drafts, OrderBy: tt.orderBy, Descending: tt.descending})
+			if len(all) != 7 {
+				t.Fatalf("List %v (descending %v) without paging = %v, want all 7 blogs", tt.orderBy, tt.descending, all)
+			}
+			for _, pageSize := range []int{1, 2, 3, 7, 10} {
+				paged := listPages(t, s, ListOptions{States: drafts, OrderBy: tt.orderBy, Descending: tt.descending, PageSize: pageSize})
+				if !reflect.DeepEqual(paged, all) {
+					t.Errorf("List %v (descending %v) in pages of %v = %v, want %v", tt.orderBy, tt.descending, pageSize, paged, all)
+				}
+			}
+		}
+
+		ordered := listPages(t, s, ListOptions{States: drafts, OrderBy: blogpb.ListBlogRequest_CREATE_TIME, Descending: true})
+		if ordered[0] != "blog 6" || ordered[6] != "blog 0" {
+			t.Errorf("List by CREATE_TIME descending = %v, want the newest blog first", ordered)
+		}
+	})
+}
+
+func TestListBadPageToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		_, err := s.List(context.Background(), ListOptions{PageToken: "nope!"}, func(*blogpb.Blog) error { return nil })
+		if err != errInvalidPageToken {
+			t.Errorf("List with a bad page token error = %v, want %v", err, errInvalidPageToken)
+		}
+	})
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tests := []struct {
+		tags []string
+		want []string
+	}{
+		{tags: nil, want: nil},
+		{tags: []string{"", "  "}, want: nil},
+		{tags: []string{"Go", " gRPC ", "go"}, want: []string{"go", "grpc"}},
+		{tags: []string{"b", "a", "c"}, want: []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		if got := normalizeTags(tt.tags); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeTags(%q) = %q, want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestApplyTagChanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		changes TagChanges
+		want    []string
+	}{
+		{name: "no changes", tags: []string{"go"}, want: []string{"go"}},
+		{name: "add", tags: []string{"go"}, changes: TagChanges{Add: []string{"aws", "grpc"}}, want: []string{"aws", "go", "grpc"}},
+		{name: "add existing", tags: []string{"go"}, changes: TagChanges{Add: []string{"go"}}, want: []string{"go"}},
+		{name: "remove", tags: []string{"go", "grpc"}, changes: TagChanges{Remove: []string{"go"}}, want: []string{"grpc"}},
+		{name: "remove missing", tags: []string{"go"}, changes: TagChanges{Remove: []string{"aws"}}, want: []string{"go"}},
+		{name: "remove the last one", tags: []string{"go"}, changes: TagChanges{Remove: []string{"go"}}, want: nil},
+		{name: "add and remove the same", changes: TagChanges{Add: []string{"go"}, Remove: []string{"go"}}, want: nil}, // Removing wins
+	}
+	for _, tt := range tests {
+		if got := applyTagChanges(tt.tags, tt.changes); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: applyTagChanges(%q, %+v) = %q, want %q", tt.name, tt.tags, tt.changes, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateTagsOnly(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blog := newBlog(&blogpb.Blog{AuthorId: "Milos", Title: "tagged", Tags: []string{"go", "grpc"}}, "")
+		if err := s.Create(ctx, blog); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		testBlog(t, s, "untagged")
+
+		updated, err := s.Update(ctx, &blogpb.Blog{Id: blog.GetId(), Title: "ignored"}, nil, TagChanges{Add: []string{"aws"}, Remove: []string{"grpc"}}, 0)
+		if err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+		if updated.GetTitle() != "tagged" || !reflect.DeepEqual(updated.GetTags(), []string{"aws", "go"}) {
+			t.Errorf("Update = %q tagged %q, want %q tagged [aws go]", updated.GetTitle(), updated.GetTags(), "tagged")
+		}
+
+		drafts := []blogpb.Blog_State{blogpb.Blog_DRAFT}
+		for tag, want := range map[string][]string{"aws": {"tagged"}, "go": {"tagged"}, "grpc": nil} {
+			if got := listPages(t, s, ListOptions{States: drafts, Tag: tag}); !reflect.DeepEqual(got, want) {
+				t.Errorf("List tagged %q = %q, want %q", tag, got, want)
+			}
+		}
+	})
+}
+
+// testBlog stores a new blog in s, the way CreateBlog would
+func testBlog(t *testing.T, s BlogStore, title string) *blogpb.Blog {
+	t.Helper()
+	blog := newBlog(&blogpb.Blog{AuthorId: "Milos", Title: title, Content: title + " content"}, "")
+	if err := s.Create(context.Background(), blog); err != nil {
+		t.Fatalf("Create(%q): %v", title, err)
+	}
+	return blog
+}
+
+func TestStoreReadReturnsCopies(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		blog := testBlog(t, s, "first")
+
+		// Neither the blog passed to Create nor the one Read returns are what's stored
+		blog.Title = "changed by the caller"
+		read, err := s.Read(context.Background(), blog.GetId())
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		if read.GetTitle() != "first" {
+			t.Errorf("Read title = %q, want %q", read.GetTitle(), "first")
+		}
+		read.Title = "changed again"
+		if again, _ := s.Read(context.Background(), blog.GetId()); again.GetTitle() != "first" {
+			t.Errorf("Read title after changing a read copy = %q, want %q", again.GetTitle(), "first")
+		}
+	})
+}
+
+func TestStoreUpdate(t *testing.T) {
+	tests := []struct {
+		name            string
+		paths           []string
+		expectedVersion int64
+		deleted         bool
+		wantErr         error
+		wantTitle       string
+		wantContent     string
+	}{
+		{name: "title only", paths: []string{"title"}, wantTitle: "new title", wantContent: "old content"},
+		{name: "all fields", paths: updatableFields, wantTitle: "new title", wantContent: "new content"},
+		{name: "matching version", paths: []string{"title"}, expectedVersion: 1, wantTitle: "new title", wantContent: "old content"},
+		{name: "stale version", paths: []string{"title"}, expectedVersion: 2, wantErr: errVersionMismatch},
+		{name: "deleted blog", paths: []string{"title"}, deleted: true, wantErr: errBlogNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s BlogStore) {
+				ctx := context.Background()
+				blog := newBlog(&blogpb.Blog{AuthorId: "Milos", Title: "old title", Content: "old content"}, "")
+				if err := s.Create(ctx, blog); err != nil {
+					t.Fatalf("Create: %v", err)
+				}
+				if tt.deleted {
+					if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}, 0); err != nil {
+						t.Fatalf("Delete: %v", err)
+					}
+				}
+
+				change := &blogpb.Blog{Id: blog.GetId(), AuthorId: "Milos", Title: "new title", Content: "new content", UpdateTime: ptypes.TimestampNow()}
+				updated, err := s.Update(ctx, change, tt.paths, TagChanges{}, tt.expectedVersion)
+				if err != tt.wantErr {
+					t.Fatalf("Update error = %v, want %v", err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if updated.GetTitle() != tt.wantTitle || updated.GetContent() != tt.wantContent {
+					t.Errorf("Update = %q/%q, want %q/%q", updated.GetTitle(), updated.GetContent(), tt.wantTitle, tt.wantContent)
+				}
+				if updated.GetVersion() != 2 {
+					t.Errorf("Update version = %v, want 2", updated.GetVersion())
+				}
+				if !proto.Equal(updated.GetUpdateTime(), change.GetUpdateTime()) {
+					t.Errorf("Update update_time = %v, want %v", updated.GetUpdateTime(), change.GetUpdateTime())
+				}
+				revisions, err := s.ListRevisions(ctx, blog.GetId())
+				if err != nil || len(revisions) != 1 || revisions[0].GetTitle() != "old title" {
+					t.Errorf("ListRevisions = %v, %v, want the blog as it was before the update", revisions, err)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreDeleteAndUndelete(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blog := testBlog(t, s, "doomed")
+		deleted := &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}
+
+		if _, err := s.Undelete(ctx, blog.GetId()); err != errBlogNotDeleted {
+			t.Errorf("Undelete before Delete error = %v, want %v", err, errBlogNotDeleted)
+		}
+		if err := s.Delete(ctx, deleted, 0); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if err := s.Delete(ctx, deleted, 0); err != errBlogNotFound {
+			t.Errorf("second Delete error = %v, want %v", err, errBlogNotFound)
+		}
+
+		// Deleted blogs can still be read, but aren't listed
+		read, err := s.Read(ctx, blog.GetId())
+		if err != nil || !isDeleted(read) {
+			t.Errorf("Read deleted blog = %v, %v, want it with a delete_time", read, err)
+		}
+		listed := 0
+		if _, err := s.List(ctx, ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT}}, func(*blogpb.Blog) error {
+			listed++
+			return nil
+		}); err != nil || listed != 0 {
+			t.Errorf("List after Delete = %v blogs, %v, want none", listed, err)
+		}
+
+		undeleted, err := s.Undelete(ctx, blog.GetId())
+		if err != nil {
+			t.Fatalf("Undelete: %v", err)
+		}
+		if isDeleted(undeleted) || undeleted.GetVersion() != 3 {
+			t.Errorf("Undelete = %v, want it back at version 3", undeleted)
+		}
+	})
+}
+
+func TestStoreExpiredBlogsAreGone(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blog := testBlog(t, s, "expired")
+		past, _ := ptypes.TimestampProto(time.Now().Add(-time.Second))
+		if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: past, ExpireTime: past}, 0); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+
+		if _, err := s.Read(ctx, blog.GetId()); err != errBlogNotFound {
+			t.Errorf("Read expired blog error = %v, want %v", err, errBlogNotFound)
+		}
+		if _, err := s.Undelete(ctx, blog.GetId()); err != errBlogNotFound {
+			t.Errorf("Undelete expired blog error = %v, want %v", err, errBlogNotFound)
+		}
+	})
+}
+
+func TestStoreSetState(t *testing.T) {
+	// The from states PublishBlog and ArchiveBlog pass
+	publishable := []blogpb.Blog_State{blogpb.Blog_DRAFT, blogpb.Blog_ARCHIVED}
+	archivable := []blogpb.Blog_State{blogpb.Blog_PUBLISHED}
+
+	tests := []struct {
+		name    string
+		states  []blogpb.Blog_State // Moved through these first, starting out as a draft
+		to      blogpb.Blog_State
+		from    []blogpb.Blog_State
+		wantErr error
+	}{
+		{name: "publish a draft", to: blogpb.Blog_PUBLISHED, from: publishable},
+		{name: "archive a published blog", states: []blogpb.Blog_State{blogpb.Blog_PUBLISHED}, to: blogpb.Blog_ARCHIVED, from: archivable},
+		{name: "republish an archived blog", states: []blogpb.Blog_State{blogpb.Blog_PUBLISHED, blogpb.Blog_ARCHIVED}, to: blogpb.Blog_PUBLISHED, from: publishable},
+		{name: "archive a draft", to: blogpb.Blog_ARCHIVED, from: archivable, wantErr: errInvalidStateChange},
+		{name: "publish twice", states: []blogpb.Blog_State{blogpb.Blog_PUBLISHED}, to: blogpb.Blog_PUBLISHED, from: publishable, wantErr: errInvalidStateChange},
+		{name: "archive twice", states: []blogpb.Blog_State{blogpb.Blog_PUBLISHED, blogpb.Blog_ARCHIVED}, to: blogpb.Blog_ARCHIVED, from: archivable, wantErr: errInvalidStateChange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, s BlogStore) {
+				ctx := context.Background()
+				blog := testBlog(t, s, "stateful")
+				for _, state := range tt.states {
+					if _, err := s.SetState(ctx, &blogpb.Blog{Id: blog.GetId(), State: state}, []blogpb.Blog_State{blogpb.Blog_DRAFT, blogpb.Blog_PUBLISHED}, 0); err != nil {
+						t.Fatalf("SetState to %v: %v", state, err)
+					}
+				}
+
+				updated, err := s.SetState(ctx, &blogpb.Blog{Id: blog.GetId(), State: tt.to, UpdateTime: ptypes.TimestampNow()}, tt.from, 0)
+				if err != tt.wantErr {
+					t.Fatalf("SetState to %v error = %v, want %v", tt.to, err, tt.wantErr)
+				}
+				if err != nil {
+					return
+				}
+				if updated.GetState() != tt.to || updated.GetVersion() != int64(len(tt.states))+2 {
+					t.Errorf("SetState = %v at version %v, want %v at version %v", updated.GetState(), updated.GetVersion(), tt.to, len(tt.states)+2)
+				}
+			})
+		})
+	}
+}
+
+func TestStoreSetStateChecks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blog := testBlog(t, s, "checked")
+		drafts := []blogpb.Blog_State{blogpb.Blog_DRAFT}
+		published := &blogpb.Blog{Id: blog.GetId(), State: blogpb.Blog_PUBLISHED}
+
+		if _, err := s.SetState(ctx, published, drafts, 2); err != errVersionMismatch {
+			t.Errorf("SetState at a stale version error = %v, want %v", err, errVersionMismatch)
+		}
+		if _, err := s.SetState(ctx, &blogpb.Blog{Id: "missing"}, drafts, 0); err != errBlogNotFound {
+			t.Errorf("SetState of a missing blog error = %v, want %v", err, errBlogNotFound)
+		}
+		if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}, 0); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := s.SetState(ctx, published, drafts, 0); err != errBlogNotFound {
+			t.Errorf("SetState of a deleted blog error = %v, want %v", err, errBlogNotFound)
+		}
+	})
+}
+
+func TestStoreBatch(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blogs := []*blogpb.Blog{
+			newBlog(&blogpb.Blog{AuthorId: "Milos", Title: "kept"}, ""),
+			newBlog(&blogpb.Blog{AuthorId: "Milos", Title: "deleted"}, ""),
+		}
+		for i, err := range s.BatchCreate(ctx, blogs) {
+			if err != nil {
+				t.Fatalf("BatchCreate blog %v: %v", i, err)
+			}
+		}
+
+		missing := "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f"
+		read, errs := s.BatchRead(ctx, []string{blogs[1].GetId(), missing, blogs[0].GetId()})
+		if read[0].GetTitle() != "deleted" || errs[0] != nil || errs[1] != errBlogNotFound || read[2].GetTitle() != "kept" || errs[2] != nil {
+			t.Errorf("BatchRead = %v, %v, want the blogs in request order, and %v for the missing one", read, errs, errBlogNotFound)
+		}
+
+		deleted := func(blogID string) *blogpb.Blog { return &blogpb.Blog{Id: blogID, DeleteTime: ptypes.TimestampNow()} }
+		errs = s.BatchDelete(ctx, []*blogpb.Blog{deleted(blogs[1].GetId()), deleted(missing)})
+		if errs[0] != nil || errs[1] != errBlogNotFound {
+			t.Errorf("BatchDelete errors = %v, want nil, then %v", errs, errBlogNotFound)
+		}
+		if errs := s.BatchDelete(ctx, []*blogpb.Blog{deleted(blogs[1].GetId())}); errs[0] != errBlogNotFound {
+			t.Errorf("BatchDelete of a deleted blog error = %v, want %v", errs[0], errBlogNotFound)
+		}
+		if got := listPages(t, s, ListOptions{States: []blogpb.Blog_State{blogpb.Blog_DRAFT}}); !reflect.DeepEqual(got, []string{"kept"}) {
+			t.Errorf("List after BatchDelete = %q, want [kept]", got)
+		}
+	})
+}
+
+func TestStoreReadRevision(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s BlogStore) {
+		ctx := context.Background()
+		blog := testBlog(t, s, "first")
+		if _, err := s.Update(ctx, &blogpb.Blog{Id: blog.GetId(), Title: "second", UpdateTime: ptypes.TimestampNow()}, []string{"title"}, TagChanges{}, 0); err != nil {
+			t.Fatalf("Update: %v", err)
+		}
+
+		if revision, err := s.ReadRevision(ctx, blog.GetId(), 1); err != nil || revision.GetTitle() != "first" {
+			t.Errorf("ReadRevision(1) = %v, %v, want the blog as created", revision, err)
+		}
+		if _, err := s.ReadRevision(ctx, blog.GetId(), 2); err != errRevisionNotFound { // The current version isn't a revision yet
+			t.Errorf("ReadRevision(2) error = %v, want %v", err, errRevisionNotFound)
+		}
+		if _, err := s.ReadRevision(ctx, "6f1c2d0e-8a4b-4c3d-9e5f-0a1b2c3d4e5f", 1); err != errBlogNotFound {
+			t.Errorf("ReadRevision of a missing blog error = %v, want %v", err, errBlogNotFound)
+		}
+
+		if err := s.Delete(ctx, &blogpb.Blog{Id: blog.GetId(), DeleteTime: ptypes.TimestampNow()}, 0); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := s.ReadRevision(ctx, blog.GetId(), 1); err != errBlogNotFound {
+			t.Errorf("ReadRevision of a deleted blog error = %v, want %v", err, errBlogNotFound)
+		}
+		if _, err := s.Undelete(ctx, blog.GetId()); err != nil {
+			t.Fatalf("Undelete: %v", err)
+		}
+		if _, err := s.ReadRevision(ctx, blog.GetId(), 1); err != nil {
+			t.Errorf("ReadRevision after Undelete: %v", err)
+		}
+	})
+}
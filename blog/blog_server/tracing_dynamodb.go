@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ddbTracer = otel.Tracer("github.com/Kaurin/gRPC/blog/blog_server")
+
+// ddbSpanKey is where startDynamoDBSpan keeps the span in the request context. The context also holds
+// the handler's span, which isn't ours to end
+type ddbSpanKey struct{}
+
+// traceDynamoDB makes every client created from the returned config add a span for each call to the trace
+// in the call's context. Calls without one (the stream poller, health checks, startup) aren't traced,
+// they'd only be noise
+func traceDynamoDB(ddbCfg aws.Config) aws.Config {
+	ddbCfg = ddbCfg.Copy() // Don't add to the handler lists of whoever else holds ddbCfg
+	// Validate runs first and only once, Complete runs last, after the retries
+	ddbCfg.Handlers.Validate.PushFrontNamed(aws.NamedHandler{
+		Name: "blog.tracing.start",
+		Fn:   startDynamoDBSpan,
+	})
+	ddbCfg.Handlers.Complete.PushBackNamed(aws.NamedHandler{
+		Name: "blog.tracing.end",
+		Fn:   endDynamoDBSpan,
+	})
+	return ddbCfg
+}
+
+func startDynamoDBSpan(r *aws.Request) {
+	if !trace.SpanContextFromContext(r.Context()).IsValid() {
+		return
+	}
+	ctx, span := ddbTracer.Start(r.Context(), r.Metadata.ServiceName+"."+r.Operation.Name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "aws-api"),
+			attribute.String("rpc.service", r.Metadata.ServiceName),
+			attribute.String("rpc.method", r.Operation.Name),
+		),
+	)
+	r.SetContext(context.WithValue(ctx, ddbSpanKey{}, span))
+}
+
+func endDynamoDBSpan(r *aws.Request) {
+	span, ok := r.Context().Value(ddbSpanKey{}).(trace.Span)
+	if !ok {
+		return
+	}
+	span.SetAttributes(attribute.Int("aws.retry_count", r.RetryCount))
+	if r.RequestID != "" {
+		span.SetAttributes(attribute.String("aws.request_id", r.RequestID))
+	}
+	if r.Error != nil {
+		span.RecordError(r.Error)
+		description := r.Error.Error()
+		if aerr, ok := r.Error.(awserr.Error); ok {
+			description = aerr.Code()
+		}
+		span.SetStatus(codes.Error, description)
+	}
+	span.End()
+}
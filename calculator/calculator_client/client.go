@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"log"
+	"os"
 	"time"
 
 	"google.golang.org/grpc/codes"
@@ -11,26 +12,45 @@ import (
 	"google.golang.org/grpc/status"
 
 	"github.com/Kaurin/gRPC/calculator/calculatorpb"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
 	"google.golang.org/grpc"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	// setup the client
-	cc, err := grpc.Dial("localhost:50053", grpc.WithInsecure())
+	// setup the client. GRPCMTLS (any value) presents our client certificate, for a server that requires one
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if _, varSet := os.LookupEnv("GRPCMTLS"); varSet {
+		creds, err := mtls.ClientCredentials(mtls.ClientCertFile, mtls.ClientKeyFile, mtls.CAFile)
+		if err != nil {
+			log.Fatalf("Failed to load credentials: %v", err)
+		}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	}
+	stopTracing, err := tracing.Setup("calculator_client", os.Getenv("GRPCTRACING"))
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	ctx, endRun := tracing.StartRun("calculator client run")
+	defer endRun()
+	opts = append(opts, tracing.DialOptions()...)
+
+	cc, err := grpc.Dial("localhost:50053", opts...)
 	defer cc.Close()
 	if err != nil {
 		log.Println("Can't establish gRPC connection.")
 	}
 	c := calculatorpb.NewCalculatorServiceClient(cc)
-	doUnary(c)
-	doPrimeNumberDecomposition(c)
-	doComputeAverage(c)
-	doFindMaximum(c)
-	doErrorUnary(c)
+	doUnary(ctx, c)
+	doPrimeNumberDecomposition(ctx, c)
+	doComputeAverage(ctx, c)
+	doFindMaximum(ctx, c)
+	doErrorUnary(ctx, c)
 }
 
-func doUnary(c calculatorpb.CalculatorServiceClient) {
+func doUnary(ctx context.Context, c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Starting the Unary Client operation")
 	// setup the request
 	elems := &calculatorpb.AdditionElements{
@@ -40,20 +60,20 @@ func doUnary(c calculatorpb.CalculatorServiceClient) {
 		SumElements: elems,
 	}
 
-	res, err := c.Sum(context.Background(), req)
+	res, err := c.Sum(ctx, req)
 	if err != nil {
 		log.Fatalf("Unable to perform a gRPC call: %v", err)
 	}
 	log.Printf("Result: %v", res.GetResult())
 }
 
-func doPrimeNumberDecomposition(c calculatorpb.CalculatorServiceClient) {
+func doPrimeNumberDecomposition(ctx context.Context, c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Starting the Prime Number Decomposition operation")
 	req := &calculatorpb.PNDRequest{
 		Request: int64(9223372036854775806),
 		// Request: int64(120),
 	}
-	recStream, err := c.PrimeNumberDecomposition(context.Background(), req)
+	recStream, err := c.PrimeNumberDecomposition(ctx, req)
 
 	if err != nil {
 		log.Fatalf("Unable to perform a gRPC call: %v", err)
@@ -71,9 +91,9 @@ func doPrimeNumberDecomposition(c calculatorpb.CalculatorServiceClient) {
 	}
 }
 
-func doComputeAverage(c calculatorpb.CalculatorServiceClient) {
+func doComputeAverage(ctx context.Context, c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Starting the Compute Average operation")
-	stream, err := c.ComputeAverage(context.Background())
+	stream, err := c.ComputeAverage(ctx)
 	if err != nil {
 		log.Fatalf("Issue opening ComputeAverage gRPC: %v", err)
 	}
@@ -91,10 +111,10 @@ func doComputeAverage(c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Recieved average: %v", resp.GetAverage())
 }
 
-func doFindMaximum(c calculatorpb.CalculatorServiceClient) {
+func doFindMaximum(ctx context.Context, c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Starting the FindMaximum operation")
 	waitc := make(chan struct{})
-	stream, err := c.FindMaximum(context.Background())
+	stream, err := c.FindMaximum(ctx)
 	if err != nil {
 		log.Fatalf("Error starting BiDi gRPC: %v", err)
 	}
@@ -129,18 +149,18 @@ func doFindMaximum(c calculatorpb.CalculatorServiceClient) {
 	<-waitc
 }
 
-func doErrorUnary(c calculatorpb.CalculatorServiceClient) {
+func doErrorUnary(ctx context.Context, c calculatorpb.CalculatorServiceClient) {
 	log.Printf("Starting the doErrorUnary operation")
 
 	// legitimate req
-	doSquareRootCall(c, 10)
-	doSquareRootCall(c, -5)
+	doSquareRootCall(ctx, c, 10)
+	doSquareRootCall(ctx, c, -5)
 
 }
 
-func doSquareRootCall(c calculatorpb.CalculatorServiceClient, number int32) {
+func doSquareRootCall(ctx context.Context, c calculatorpb.CalculatorServiceClient, number int32) {
 	log.Printf("Trying for square root of %v", number)
-	res, err := c.SquareRoot(context.Background(), &calculatorpb.SquareRootRequest{
+	res, err := c.SquareRoot(ctx, &calculatorpb.SquareRootRequest{
 		Number: number,
 	})
 	if err != nil {
@@ -10,11 +10,11 @@ import (
 
 	"google.golang.org/grpc/codes"
 
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 
 	"github.com/Kaurin/gRPC/calculator/calculatorpb"
+	"github.com/Kaurin/gRPC/internal/bootstrap"
+	"github.com/Kaurin/gRPC/internal/tracing"
 )
 
 type server struct{}
@@ -22,17 +22,26 @@ type server struct{}
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("Hello World!")
-	lis, err := net.Listen("tcp", ":50053")
+	config, err := bootstrap.Load(bootstrap.Defaults(":50053", ":9053"))
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	stopTracing, err := tracing.Setup("calculator_server", config.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing() // Flushes the last spans
+	lis, err := net.Listen("tcp", config.Address)
 	if err != nil {
 		log.Printf("Error setting up listener %v", err)
 	}
-	s := grpc.NewServer()
-	calculatorpb.RegisterCalculatorServiceServer(s, &server{})
-
-	// Register the reflection service on our gRPC server
-	reflection.Register(s)
+	s, err := bootstrap.NewServer(config)
+	if err != nil {
+		log.Fatalf("Something went wrong while setting up the server: %v", err)
+	}
+	calculatorpb.RegisterCalculatorServiceServer(s.Server, &server{})
 
-	if err := s.Serve(lis); err != nil {
+	if err := s.Run(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 }
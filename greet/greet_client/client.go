@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"log"
+	"os"
 	"time"
 
 	"google.golang.org/grpc/credentials"
@@ -11,6 +12,8 @@ import (
 	"google.golang.org/grpc/codes"
 
 	"github.com/Kaurin/gRPC/greet/greetpb"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/status"
@@ -22,7 +25,14 @@ func main() {
 
 	tls := true
 	opts := []grpc.DialOption{grpc.WithInsecure()}
-	if tls {
+	// GRPCMTLS (any value) presents our client certificate, for servers that require one
+	if _, varSet := os.LookupEnv("GRPCMTLS"); varSet {
+		creds, sslErr := mtls.ClientCredentials(mtls.ClientCertFile, mtls.ClientKeyFile, mtls.CAFile)
+		if sslErr != nil {
+			log.Fatalf("Failed to load credentials: %v", sslErr)
+		}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	} else if tls {
 		creds, sslErr := credentials.NewClientTLSFromFile("ssl/server.crt", "")
 		if sslErr != nil {
 			log.Fatalf("Failed to load credentials: %v", sslErr)
@@ -30,21 +40,30 @@ func main() {
 		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
 	}
 
+	stopTracing, err := tracing.Setup("greet_client", os.Getenv("GRPCTRACING"))
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing()
+	ctx, endRun := tracing.StartRun("greet client run")
+	defer endRun()
+	opts = append(opts, tracing.DialOptions()...)
+
 	cc, err := grpc.Dial("localhost:50052", opts...)
 	defer cc.Close()
 	if err != nil {
 		log.Fatalf("Could not connect: %v", err)
 	}
 	c := greetpb.NewGreetServiceClient(cc)
-	doUnary(c)
-	doServerStreaming(c)
-	doClientStreaming(c)
-	doBiDiStreaming(c)
-	doUnaryWithDeadline(c, 5*time.Second) // Shoud complete
-	// doUnaryWithDeadline(c, 1*time.Second) // Should not complete
+	doUnary(ctx, c)
+	doServerStreaming(ctx, c)
+	doClientStreaming(ctx, c)
+	doBiDiStreaming(ctx, c)
+	doUnaryWithDeadline(ctx, c, 5*time.Second) // Shoud complete
+	// doUnaryWithDeadline(ctx, c, 1*time.Second) // Should not complete
 }
 
-func doUnary(c greetpb.GreetServiceClient) {
+func doUnary(ctx context.Context, c greetpb.GreetServiceClient) {
 	log.Println("Starting the 'doUnary' RPC...")
 	req := &greetpb.GreetRequest{
 		Greeting: &greetpb.Greeting{
@@ -53,7 +72,7 @@ func doUnary(c greetpb.GreetServiceClient) {
 		},
 	}
 
-	res, err := c.Greet(context.Background(), req)
+	res, err := c.Greet(ctx, req)
 	if err != nil {
 		log.Fatalf("Error while calling Greet RPC: %v", err)
 	}
@@ -61,7 +80,7 @@ func doUnary(c greetpb.GreetServiceClient) {
 	log.Printf("Response from Greet: %v", res.GetResult())
 }
 
-func doServerStreaming(c greetpb.GreetServiceClient) {
+func doServerStreaming(ctx context.Context, c greetpb.GreetServiceClient) {
 	log.Println("Starting to do a server streaming RPC...")
 
 	req := &greetpb.GreetManyTimesRequest{
@@ -71,7 +90,7 @@ func doServerStreaming(c greetpb.GreetServiceClient) {
 		},
 	}
 
-	resStream, err := c.GreetManyTimes(context.Background(), req)
+	resStream, err := c.GreetManyTimes(ctx, req)
 	if err != nil {
 		log.Fatalf("Error while calling GreetManyTimes RPC: %v", err)
 	}
@@ -88,9 +107,9 @@ func doServerStreaming(c greetpb.GreetServiceClient) {
 
 }
 
-func doClientStreaming(c greetpb.GreetServiceClient) {
+func doClientStreaming(ctx context.Context, c greetpb.GreetServiceClient) {
 	log.Println("Starting to do a client streaming RPC...")
-	stream, err := c.LongGreet(context.Background())
+	stream, err := c.LongGreet(ctx)
 	if err != nil {
 		log.Fatalf("Error while calling LongGreet: %v", err)
 	}
@@ -141,10 +160,10 @@ func doClientStreaming(c greetpb.GreetServiceClient) {
 	log.Printf("LongGreet Response: %v", res.GetResult())
 }
 
-func doBiDiStreaming(c greetpb.GreetServiceClient) {
+func doBiDiStreaming(ctx context.Context, c greetpb.GreetServiceClient) {
 	log.Println("Starting to do a BiDi streaming RPC...")
 
-	stream, err := c.GreetEveryone(context.Background())
+	stream, err := c.GreetEveryone(ctx)
 	if err != nil {
 		log.Fatalf("Error while creating stream: %v", err)
 	}
@@ -210,7 +229,7 @@ func doBiDiStreaming(c greetpb.GreetServiceClient) {
 	<-waitc
 }
 
-func doUnaryWithDeadline(c greetpb.GreetServiceClient, timeout time.Duration) {
+func doUnaryWithDeadline(ctx context.Context, c greetpb.GreetServiceClient, timeout time.Duration) {
 	log.Println("Starting the 'GreetWithDeadlineRequest' RPC...")
 	req := &greetpb.GreetWithDeadlineRequest{
 		Greeting: &greetpb.Greeting{
@@ -218,7 +237,7 @@ func doUnaryWithDeadline(c greetpb.GreetServiceClient, timeout time.Duration) {
 			LastName:  "Doe",
 		},
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	res, err := c.GreetWithDeadline(ctx, req)
@@ -9,10 +9,10 @@ import (
 	"time"
 
 	"github.com/Kaurin/gRPC/greet/greetpb"
-	"google.golang.org/grpc"
+	"github.com/Kaurin/gRPC/internal/bootstrap"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/reflection"
 	"google.golang.org/grpc/status"
 )
 
@@ -22,36 +22,40 @@ func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("Hello world")
 
-	lis, err := net.Listen("tcp", ":50052")
+	// Unlike the other two, greet serves TLS unless told otherwise
+	defaults := bootstrap.Defaults(":50052", ":9052")
+	defaults.TLS.Enabled = true
+	config, err := bootstrap.Load(defaults)
 	if err != nil {
-		log.Fatalf("Failed to listen %v", err)
+		log.Fatalf("Failed to load config: %v", err)
 	}
+	stopTracing, err := tracing.Setup("greet_server", config.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer stopTracing() // Flushes the last spans
 
-	cert := "ssl/server.crt"
-	key := "ssl/server.pem"
-
-	opts := []grpc.ServerOption{}
-	tls := true
-
-	if tls {
-		creds, sslErr := credentials.NewServerTLSFromFile(cert, key)
-		if sslErr != nil {
-			log.Fatalf("Something went wrong while getting certs: %v", err)
-		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
+	lis, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		log.Fatalf("Failed to listen %v", err)
 	}
 
-	s := grpc.NewServer(opts...)
-	greetpb.RegisterGreetServiceServer(s, &server{})
-	reflection.Register(s)
+	s, err := bootstrap.NewServer(config)
+	if err != nil {
+		log.Fatalf("Something went wrong while setting up the server: %v", err)
+	}
+	greetpb.RegisterGreetServiceServer(s.Server, &server{})
 
-	if err := s.Serve(lis); err != nil {
+	if err := s.Run(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
 }
 
 func (*server) Greet(ctx context.Context, req *greetpb.GreetRequest) (*greetpb.GreetResponse, error) {
 	log.Printf("Now running the server 'Greet' function with: %v", req)
+	if subject, ok := mtls.PeerSubject(ctx); ok {
+		log.Printf("Greeting a client with a certificate for: %v", subject)
+	}
 	firstname := req.GetGreeting().GetFirstName()
 	lastname := req.GetGreeting().GetLastName()
 	result := "Hello " + firstname + " " + lastname + "."
@@ -70,7 +74,12 @@ func (*server) GreetManyTimes(req *greetpb.GreetManyTimesRequest, stream greetpb
 			Result: result,
 		}
 		stream.Send(res)
-		time.Sleep(1 * time.Second)
+		select {
+		case <-stream.Context().Done(): // Client went away, or the server is shutting down
+			log.Printf("Stopped 'GreetManyTimes' after %v greetings: %v", i+1, stream.Context().Err())
+			return status.Error(codes.Unavailable, "Stopped greeting early")
+		case <-time.After(1 * time.Second):
+		}
 	}
 	return nil
 }
@@ -0,0 +1,63 @@
+// healthcheck asks a server's grpc.health.v1 service whether it's SERVING, and exits 1 if it isn't.
+// docker-compose uses it as the healthcheck of all three servers.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:50051", "server to check")
+	service := flag.String("service", "", "service to check, e.g. blog.BlogService. Empty for the whole server")
+	useTLS := flag.Bool("tls", false, "connect with TLS, trusting ssl/ca.crt")
+	useMTLS := flag.Bool("mtls", false, "connect with TLS and present ssl/client.crt")
+	timeout := flag.Duration("timeout", 3*time.Second, "give up after this long")
+	flag.Parse()
+
+	opts := []grpc.DialOption{grpc.WithInsecure()}
+	if *useMTLS {
+		creds, err := mtls.ClientCredentials(mtls.ClientCertFile, mtls.ClientKeyFile, mtls.CAFile)
+		if err != nil {
+			fail("Failed to load credentials: %v", err)
+		}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	} else if *useTLS {
+		creds, err := credentials.NewClientTLSFromFile(mtls.CAFile, "")
+		if err != nil {
+			fail("Failed to load credentials: %v", err)
+		}
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, *addr, append(opts, grpc.WithBlock())...)
+	if err != nil {
+		fail("Could not connect to %v: %v", *addr, err)
+	}
+	defer cc.Close()
+
+	resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{Service: *service})
+	if err != nil {
+		fail("Health check failed: %v", err)
+	}
+	if resp.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		fail("%v", resp.GetStatus())
+	}
+	fmt.Println(resp.GetStatus())
+}
+
+// fail prints why the server isn't healthy and exits 1, which is what docker wants to hear
+func fail(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
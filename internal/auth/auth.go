@@ -0,0 +1,224 @@
+// Package auth authenticates gRPC callers with bearer JWTs.
+//
+// Servers verify tokens with a Verifier, through the interceptors, and handlers get the caller's subject with Subject
+// (and the roles the token grants with Roles).
+// Clients send a token with TokenCredentials. Tokens are HS256 (a shared secret) or RS256 (an RSA key pair),
+// depending on the key file.
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// errNoSubject is returned by Verifier.Verify for a valid token that doesn't say who it's for
+var errNoSubject = errors.New("token has no subject")
+
+// tokenClaims are the JWT claims we use: the standard ones, plus the caller's roles
+type tokenClaims struct {
+	jwt.StandardClaims
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Identity is who a verified token says the caller is
+type Identity struct {
+	Subject string
+	Roles   []string
+}
+
+// Verifier checks JWTs against a single key
+type Verifier struct {
+	method jwt.SigningMethod
+	key    interface{}
+}
+
+// NewVerifier reads the key to check tokens with from a file. A PEM public key (or certificate) verifies RS256 tokens.
+// Anything else is taken as the HS256 shared secret, surrounding whitespace aside.
+func NewVerifier(keyFile string) (*Verifier, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWT key file: %v", err)
+	}
+	if isPEM(b) {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JWT public key %v: %v", keyFile, err)
+		}
+		return &Verifier{method: jwt.SigningMethodRS256, key: key}, nil
+	}
+	secret, err := hmacSecret(b, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{method: jwt.SigningMethodHS256, key: secret}, nil
+}
+
+// Verify checks a token's signature and expiry, and returns who it is for
+func (v *Verifier) Verify(token string) (*Identity, error) {
+	claims := &tokenClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		// Only the algorithm the key is for. Otherwise an RS256 public key could pass as an HS256 secret
+		if t.Method.Alg() != v.method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Method.Alg())
+		}
+		return v.key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errNoSubject
+	}
+	return &Identity{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// NewToken signs a token for subject, granting roles, that expires after ttl (0 for never), with the key in keyFile.
+// A PEM RSA private key signs RS256 tokens, anything else is taken as the HS256 shared secret, see NewVerifier.
+func NewToken(keyFile, subject string, ttl time.Duration, roles ...string) (string, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read JWT key file: %v", err)
+	}
+
+	claims := tokenClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:  subject,
+			IssuedAt: time.Now().Unix(),
+		},
+		Roles: roles,
+	}
+	if ttl > 0 {
+		claims.ExpiresAt = time.Now().Add(ttl).Unix()
+	}
+
+	var method jwt.SigningMethod
+	var key interface{}
+	if isPEM(b) {
+		var rsaKey *rsa.PrivateKey
+		if rsaKey, err = jwt.ParseRSAPrivateKeyFromPEM(b); err != nil {
+			return "", fmt.Errorf("failed to parse JWT private key %v: %v", keyFile, err)
+		}
+		method, key = jwt.SigningMethodRS256, rsaKey
+	} else {
+		if key, err = hmacSecret(b, keyFile); err != nil {
+			return "", err
+		}
+		method = jwt.SigningMethodHS256
+	}
+	return jwt.NewWithClaims(method, claims).SignedString(key)
+}
+
+// isPEM reports whether a key file holds a PEM block
+func isPEM(b []byte) bool {
+	return strings.HasPrefix(strings.TrimSpace(string(b)), "-----BEGIN ")
+}
+
+// hmacSecret turns the contents of a key file into an HS256 secret
+func hmacSecret(b []byte, keyFile string) ([]byte, error) {
+	secret := []byte(strings.TrimSpace(string(b)))
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("JWT key file is empty: %v", keyFile)
+	}
+	return secret, nil
+}
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying the caller's identity
+func NewContext(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Subject returns the subject of the token the caller sent, if it sent one
+func Subject(ctx context.Context) (string, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	if !ok || identity.Subject == "" {
+		return "", false
+	}
+	return identity.Subject, true
+}
+
+// Roles returns the roles the caller's token grants. None for callers without a token
+func Roles(ctx context.Context) []string {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	if !ok {
+		return nil
+	}
+	return identity.Roles
+}
+
+// authenticate verifies the bearer token in the incoming metadata, if there is one, and puts its subject in the context.
+// Calls without a token go through anonymously. It's up to the handlers to turn those away where it matters.
+func authenticate(ctx context.Context, v *Verifier) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return ctx, nil
+	}
+
+	token := strings.TrimSpace(values[0])
+	if len(token) < len("Bearer ") || !strings.EqualFold(token[:len("Bearer ")], "Bearer ") {
+		return nil, status.Errorf(codes.Unauthenticated, "Authorization metadata is not a bearer token")
+	}
+	identity, err := v.Verify(strings.TrimSpace(token[len("Bearer "):]))
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, fmt.Sprintf("Invalid bearer token: %v", err))
+	}
+	return NewContext(ctx, identity), nil
+}
+
+// UnaryServerInterceptor authenticates unary calls, see authenticate
+func UnaryServerInterceptor(v *Verifier) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, v)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor authenticates streaming calls, see authenticate
+func StreamServerInterceptor(v *Verifier) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), v)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream is a grpc.ServerStream with its context replaced
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// TokenCredentials sends a bearer token with every call. Use it with grpc.WithPerRPCCredentials
+type TokenCredentials string
+
+func (t TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity is false so the token also goes over the plaintext connections the blog uses.
+// Anyone listening in can reuse it until it expires
+func (t TokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testKeys are key files for both kinds of token, in a temporary directory
+type testKeys struct {
+	secret, otherSecret string // HS256
+	private, public     string // RS256
+	publicPEM           []byte // What an attacker would sign HS256 tokens with, see TestVerify
+}
+
+func writeKeys(t *testing.T) *testKeys {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := &testKeys{publicPEM: pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})}
+	keys.secret = write("secret", []byte("not so secret\n"))
+	keys.otherSecret = write("other-secret", []byte("another secret"))
+	keys.private = write("jwt.pem", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+	keys.public = write("jwt.pub", keys.publicPEM)
+	return keys
+}
+
+// newToken signs a token for "Ana" that NewToken couldn't: any method, key and validity
+func newToken(t *testing.T, method jwt.SigningMethod, key interface{}, expiresAt, notBefore time.Time) string {
+	t.Helper()
+	claims := tokenClaims{StandardClaims: jwt.StandardClaims{Subject: "Ana", ExpiresAt: expiresAt.Unix(), NotBefore: notBefore.Unix()}}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestVerify(t *testing.T) {
+	keys := writeKeys(t)
+	sign := func(keyFile string, ttl time.Duration) string {
+		token, err := NewToken(keyFile, "Ana", ttl, "author", "admin")
+		if err != nil {
+			t.Fatalf("NewToken with %v: %v", keyFile, err)
+		}
+		return token
+	}
+	rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(mustRead(t, keys.private))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hour := time.Now().Add(time.Hour)
+	hourAgo := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		keyFile string // Verified with
+		token   string
+		wantErr bool
+	}{
+		{name: "HS256", keyFile: keys.secret, token: sign(keys.secret, time.Hour)},
+		{name: "HS256 without expiry", keyFile: keys.secret, token: sign(keys.secret, 0)},
+		{name: "RS256", keyFile: keys.public, token: sign(keys.private, time.Hour)},
+
+		{name: "RS256 token, HS256 key", keyFile: keys.secret, token: sign(keys.private, time.Hour), wantErr: true},
+		{name: "HS256 token, RS256 key", keyFile: keys.public, token: sign(keys.secret, time.Hour), wantErr: true},
+		// The classic: sign HS256 with the public key, hoping it gets used as the secret
+		{name: "HS256 signed with the public key", keyFile: keys.public, token: newToken(t, jwt.SigningMethodHS256, keys.publicPEM, hour, hourAgo), wantErr: true},
+		{name: "none for HS256", keyFile: keys.secret, token: newToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, hour, hourAgo), wantErr: true},
+		{name: "none for RS256", keyFile: keys.public, token: newToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, hour, hourAgo), wantErr: true},
+
+		{name: "expired", keyFile: keys.public, token: newToken(t, jwt.SigningMethodRS256, rsaKey, hourAgo, hourAgo), wantErr: true},
+		{name: "not valid yet", keyFile: keys.public, token: newToken(t, jwt.SigningMethodRS256, rsaKey, hour.Add(time.Hour), hour), wantErr: true},
+		{name: "other secret", keyFile: keys.otherSecret, token: sign(keys.secret, time.Hour), wantErr: true},
+		{name: "tampered with", keyFile: keys.secret, token: sign(keys.secret, time.Hour) + "x", wantErr: true},
+		{name: "garbage", keyFile: keys.secret, token: "not.a.token", wantErr: true},
+	}
+	for _, tt := range tests {
+		v, err := NewVerifier(tt.keyFile)
+		if err != nil {
+			t.Fatalf("NewVerifier(%v): %v", tt.keyFile, err)
+		}
+		identity, err := v.Verify(tt.token)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%v: Verify = %+v, want an error", tt.name, identity)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: Verify: %v", tt.name, err)
+			continue
+		}
+		if want := (&Identity{Subject: "Ana", Roles: []string{"author", "admin"}}); !reflect.DeepEqual(identity, want) {
+			t.Errorf("%v: Verify = %+v, want %+v", tt.name, identity, want)
+		}
+	}
+}
+
+func TestVerifyWantsASubject(t *testing.T) {
+	keys := writeKeys(t)
+	token, err := NewToken(keys.secret, "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVerifier(keys.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify(token); err != errNoSubject {
+		t.Errorf("Verify without a subject error = %v, want %v", err, errNoSubject)
+	}
+}
+
+func TestNewVerifierRejectsBadKeys(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"empty":      " \n",
+		"broken PEM": "-----BEGIN PUBLIC KEY-----\nnope\n-----END PUBLIC KEY-----\n",
+	}
+	for name, contents := range tests {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewVerifier(path); err == nil {
+			t.Errorf("NewVerifier with an %v key file succeeded, want an error", name)
+		}
+	}
+	if _, err := NewVerifier(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("NewVerifier with a missing key file succeeded, want an error")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := writeKeys(t)
+	v, err := NewVerifier(keys.secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := NewToken(keys.secret, "Ana", time.Hour, "author")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization []string
+		wantCode      codes.Code
+		wantSubject   string
+		wantRoles     []string
+	}{
+		{name: "no token"},
+		{name: "token", authorization: []string{"Bearer " + token}, wantSubject: "Ana", wantRoles: []string{"author"}},
+		{name: "lower case scheme", authorization: []string{"bearer " + token}, wantSubject: "Ana", wantRoles: []string{"author"}},
+		{name: "not a bearer token", authorization: []string{"Basic QW5hOnNlY3JldA=="}, wantCode: codes.Unauthenticated},
+		{name: "invalid token", authorization: []string{"Bearer " + token + "x"}, wantCode: codes.Unauthenticated},
+	}
+	for _, tt := range tests {
+		ctx := context.Background()
+		if tt.authorization != nil {
+			ctx = metadata.NewIncomingContext(ctx, metadata.MD{"authorization": tt.authorization})
+		}
+		ctx, err := authenticate(ctx, v)
+		if status.Code(err) != tt.wantCode {
+			t.Errorf("%v: authenticate error = %v, want %v", tt.name, err, tt.wantCode)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		subject, ok := Subject(ctx)
+		if subject != tt.wantSubject || ok != (tt.wantSubject != "") {
+			t.Errorf("%v: Subject = %q, %v, want %q", tt.name, subject, ok, tt.wantSubject)
+		}
+		if roles := Roles(ctx); !reflect.DeepEqual(roles, tt.wantRoles) {
+			t.Errorf("%v: Roles = %q, want %q", tt.name, roles, tt.wantRoles)
+		}
+	}
+}
+
+func mustRead(t *testing.T, path string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,168 @@
+// Package authz authorizes gRPC calls against a role policy kept in a YAML file.
+//
+// The policy maps roles to the full gRPC method names they may call:
+//
+//	roles:
+//	  everyone:
+//	    - /greet.GreetService/*
+//	  author:
+//	    - /blog.BlogService/DeleteBlog
+//
+// A "*" matches any part of a method name except a "/", so "/blog.BlogService/*" is every BlogService method.
+// A "*" on its own is every method there is. Callers have the roles their token grants (see the auth package),
+// plus "authenticated" if they sent a token at all, plus "client-cert" if they presented a verified client certificate
+// (see the mtls package), plus "everyone". Methods no role of theirs lists are denied.
+package authz
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/Kaurin/gRPC/internal/filewatch"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// RoleEveryone is a role every caller has, with or without a token
+	RoleEveryone = "everyone"
+	// RoleAuthenticated is a role every caller with a valid token has
+	RoleAuthenticated = "authenticated"
+	// RoleClientCert is a role every caller with a verified client certificate has, i.e. every caller of an mTLS server
+	RoleClientCert = "client-cert"
+)
+
+// policyFile is what the YAML policy file looks like
+type policyFile struct {
+	Roles map[string][]string `yaml:"roles"`
+}
+
+// Policy is a role policy loaded from a file. It's safe to use while Watch reloads it
+type Policy struct {
+	path string
+
+	mu      sync.RWMutex
+	roles   map[string][]string // Method patterns per role
+	modTime time.Time           // Of the file the roles were loaded from
+}
+
+// LoadPolicy reads a policy file, see the package docs for what goes in it
+func LoadPolicy(path string) (*Policy, error) {
+	p := &Policy{path: path}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// load (re)reads the policy file. The policy stays as it was if the file is broken
+func (p *Policy) load() error {
+	modTime, err := filewatch.ModTime(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %v", err)
+	}
+	b, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("failed to read policy file: %v", err)
+	}
+
+	file := policyFile{}
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return fmt.Errorf("failed to parse policy file %v: %v", p.path, err)
+	}
+	for role, patterns := range file.Roles {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad method pattern %q for role %v in %v: %v", pattern, role, p.path, err)
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roles = file.Roles
+	p.modTime = modTime
+	return nil
+}
+
+// Watch reloads the policy whenever the file changes, until ctx is done.
+// A policy file that fails to load is logged and the previous policy stays in force
+func (p *Policy) Watch(ctx context.Context) error {
+	p.mu.RLock()
+	loaded := p.modTime
+	p.mu.RUnlock()
+
+	return filewatch.Watch(ctx, "policy", loaded, func() error {
+		if err := p.load(); err != nil {
+			return err
+		}
+		log.Printf("Reloaded policy from: %v", p.path)
+		return nil
+	}, p.path)
+}
+
+// Allowed reports whether any of the roles may call method, a full gRPC method name
+func (p *Policy) Allowed(method string, roles []string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, role := range roles {
+		for _, pattern := range p.roles[role] {
+			if pattern == "*" {
+				return true
+			}
+			if ok, _ := path.Match(pattern, method); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// callerRoles returns the roles a caller has, see the package docs
+func callerRoles(ctx context.Context) []string {
+	roles := []string{RoleEveryone}
+	if _, ok := auth.Subject(ctx); ok {
+		roles = append(roles, RoleAuthenticated)
+	}
+	if _, ok := mtls.PeerSubject(ctx); ok {
+		roles = append(roles, RoleClientCert)
+	}
+	return append(roles, auth.Roles(ctx)...)
+}
+
+// authorize returns a PermissionDenied gRPC error if the policy doesn't let the caller call method
+func authorize(ctx context.Context, p *Policy, method string) error {
+	if !p.Allowed(method, callerRoles(ctx)) {
+		return status.Errorf(codes.PermissionDenied, fmt.Sprintf("Not allowed to call %v", method))
+	}
+	return nil
+}
+
+// UnaryServerInterceptor enforces the policy on unary calls. It goes after the auth interceptor, which finds out the roles
+func UnaryServerInterceptor(p *Policy) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := authorize(ctx, p, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor enforces the policy on streaming calls, see UnaryServerInterceptor
+func StreamServerInterceptor(p *Policy) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), p, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
@@ -0,0 +1,136 @@
+package authz
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Kaurin/gRPC/internal/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// writePolicy writes a policy file to a temporary directory and returns its path
+func writePolicy(t *testing.T, policy string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "authz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(path, []byte(policy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testPolicy = `
+roles:
+  everyone:
+    - /greet.GreetService/*
+    - /blog.BlogService/ReadBlog
+  authenticated:
+    - /blog.CommentService/*
+  client-cert:
+    - /calculator.CalculatorService/*
+  author:
+    - /blog.BlogService/*
+  admin:
+    - "*"
+`
+
+func TestAllowed(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+
+	tests := []struct {
+		method string
+		roles  []string
+		want   bool
+	}{
+		{"/greet.GreetService/Greet", []string{RoleEveryone}, true},
+		{"/blog.BlogService/ReadBlog", []string{RoleEveryone}, true},
+		{"/blog.BlogService/ReadBlogs", []string{RoleEveryone}, false}, // Exact names match exactly
+		{"/blog.BlogService/DeleteBlog", []string{RoleEveryone}, false},
+		{"/blog.BlogService/DeleteBlog", []string{RoleEveryone, "author"}, true},
+		{"/blog.CommentService/CreateComment", []string{RoleEveryone, RoleAuthenticated}, true},
+		{"/blog.CommentService/CreateComment", []string{"author"}, false},
+		{"/greet.GreetServiceV2/Greet", []string{RoleEveryone}, false}, // "*" stops at the "/"
+		{"/greet.GreetService/Nested/Greet", []string{RoleEveryone}, false},
+		{"/anything.AtAll/Really", []string{"admin"}, true},
+		{"/blog.BlogService/ReadBlog", []string{"unknown"}, false},
+		{"/blog.BlogService/ReadBlog", nil, false},
+	}
+	for _, tt := range tests {
+		if got := p.Allowed(tt.method, tt.roles); got != tt.want {
+			t.Errorf("Allowed(%q, %q) = %v, want %v", tt.method, tt.roles, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPolicyRejectsBrokenFiles(t *testing.T) {
+	tests := map[string]string{
+		"bad pattern":   "roles:\n  everyone:\n    - /greet.GreetService/[\n",
+		"unknown field": "rolez:\n  everyone:\n    - /greet.GreetService/*\n",
+		"not yaml":      "roles: [\n",
+	}
+	for name, policy := range tests {
+		if _, err := LoadPolicy(writePolicy(t, policy)); err == nil {
+			t.Errorf("LoadPolicy with a %v succeeded, want an error", name)
+		}
+	}
+	if _, err := LoadPolicy(filepath.Join(os.TempDir(), "no-such-policy.yaml")); err == nil {
+		t.Errorf("LoadPolicy of a missing file succeeded, want an error")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	p, err := LoadPolicy(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatalf("LoadPolicy: %v", err)
+	}
+
+	anonymous := context.Background()
+	token := auth.NewContext(anonymous, &auth.Identity{Subject: "Milos"})
+	author := auth.NewContext(anonymous, &auth.Identity{Subject: "Milos", Roles: []string{"author"}})
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+	unverified := peer.NewContext(anonymous, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+	}}})
+	verified := peer.NewContext(anonymous, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}}})
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		method   string
+		wantCode codes.Code
+	}{
+		{"anonymous read", anonymous, "/blog.BlogService/ReadBlog", codes.OK},
+		{"anonymous comment", anonymous, "/blog.CommentService/CreateComment", codes.PermissionDenied},
+		{"token comment", token, "/blog.CommentService/CreateComment", codes.OK},
+		{"token write", token, "/blog.BlogService/CreateBlog", codes.PermissionDenied},
+		{"author write", author, "/blog.BlogService/CreateBlog", codes.OK},
+		{"author comment", author, "/blog.CommentService/DeleteComment", codes.OK}, // Authors have a token, so they're authenticated too
+		{"anonymous calculation", anonymous, "/calculator.CalculatorService/Sum", codes.PermissionDenied},
+		{"unverified certificate", unverified, "/calculator.CalculatorService/Sum", codes.PermissionDenied},
+		{"client certificate", verified, "/calculator.CalculatorService/Sum", codes.OK},
+	}
+	for _, tt := range tests {
+		if err := authorize(tt.ctx, p, tt.method); status.Code(err) != tt.wantCode {
+			t.Errorf("%v: authorize(%q) = %v, want %v", tt.name, tt.method, err, tt.wantCode)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// Package bootstrap starts all three servers the same way. Each one loads its Config with Load, builds its
+// grpc.Server with NewServer, which takes care of TLS, keepalive, message sizes, interceptors, health, reflection and
+// Prometheus metrics, and serves with Server.Run, which shuts down gracefully on SIGINT or SIGTERM.
+//
+// Settings come from the service's defaults, then the YAML file -config (or GRPCCONFIG) points to, then environment
+// variables, then flags, each overriding the one before. Run a server with -h for the list.
+package bootstrap
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Kaurin/gRPC/internal/mtls"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is how a server is set up. The yaml tags are what goes in the config file
+type Config struct {
+	Address        string          `yaml:"address"` // Where to listen, e.g. ":50051"
+	TLS            TLSConfig       `yaml:"tls"`
+	JWTKeyFile     string          `yaml:"jwt_key"`           // Verify bearer JWTs with this key, see auth.NewVerifier. Off when empty
+	PolicyFile     string          `yaml:"policy"`            // Authorize calls with this role policy, see authz.LoadPolicy. Off when empty
+	Keepalive      KeepaliveConfig `yaml:"keepalive"`         // Zero values leave gRPC's defaults
+	MaxRecvMsgSize int             `yaml:"max_recv_msg_size"` // In bytes. 0 for gRPC's default (4MB)
+	MaxSendMsgSize int             `yaml:"max_send_msg_size"` // In bytes. 0 for gRPC's default (no limit)
+	DrainTimeout   time.Duration   `yaml:"drain_timeout"`     // How long shutting down waits for calls to finish before cutting them off
+	MetricsAddress string          `yaml:"metrics_address"`   // Serve Prometheus metrics on http://<this>/metrics. Off when empty
+	Tracing        string          `yaml:"tracing"`           // Where to export traces: "otlp", "stdout", or off when empty, see tracing.Setup
+}
+
+// TLSConfig is the server certificate and whether clients need one too
+type TLSConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	CertFile     string `yaml:"cert"`
+	KeyFile      string `yaml:"key"`
+	MTLS         bool   `yaml:"mtls"`      // Require client certificates signed by ClientCAFile. Implies Enabled
+	ClientCAFile string `yaml:"client_ca"` // Only used with MTLS
+}
+
+// KeepaliveConfig is passed on to keepalive.ServerParameters and keepalive.EnforcementPolicy
+type KeepaliveConfig struct {
+	Time                time.Duration `yaml:"time"`                  // Ping idle clients this often
+	Timeout             time.Duration `yaml:"timeout"`               // Close the connection if a ping isn't answered in time
+	MaxConnectionIdle   time.Duration `yaml:"max_connection_idle"`   // Close connections without calls for this long
+	MaxConnectionAge    time.Duration `yaml:"max_connection_age"`    // Close connections this old, so clients rebalance
+	MinTime             time.Duration `yaml:"min_time"`              // Clients pinging more often than this get disconnected
+	PermitWithoutStream bool          `yaml:"permit_without_stream"` // Let clients ping without calls in flight
+}
+
+// Defaults returns a Config for a server listening on address, plaintext, with metrics on metricsAddress and
+// the files ssl/genssl.sh makes set up in case TLS gets turned on
+func Defaults(address, metricsAddress string) Config {
+	return Config{
+		Address:        address,
+		DrainTimeout:   10 * time.Second,
+		MetricsAddress: metricsAddress,
+		TLS: TLSConfig{
+			CertFile:     mtls.ServerCertFile,
+			KeyFile:      mtls.ServerKeyFile,
+			ClientCAFile: mtls.CAFile,
+		},
+	}
+}
+
+// setting is a Config field that can be set with a flag or environment variables
+type setting struct {
+	flag  string
+	env   []string // The first one set wins
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"address", []string{"GRPCADDRESS"}, "address to listen on", func(c *Config, v string) error {
+		c.Address = v
+		return nil
+	}},
+	{"tls", []string{"GRPCTLS"}, "serve TLS (true/false)", func(c *Config, v string) error {
+		return setBool(&c.TLS.Enabled, v)
+	}},
+	{"tls-cert", []string{"GRPCTLSCERT"}, "server certificate file", func(c *Config, v string) error {
+		c.TLS.CertFile = v
+		return nil
+	}},
+	{"tls-key", []string{"GRPCTLSKEY"}, "server key file", func(c *Config, v string) error {
+		c.TLS.KeyFile = v
+		return nil
+	}},
+	{"mtls", []string{"GRPCMTLS"}, "require client certificates (true/false), implies -tls", func(c *Config, v string) error {
+		return setBool(&c.TLS.MTLS, v)
+	}},
+	{"client-ca", []string{"GRPCCLIENTCA"}, "CA certificate file client certificates have to be signed by", func(c *Config, v string) error {
+		c.TLS.ClientCAFile = v
+		return nil
+	}},
+	// BLOGJWTKEY is from when only the blog took JWTs
+	{"jwt-key", []string{"GRPCJWTKEY", "BLOGJWTKEY"}, "key file to verify bearer JWTs with (PEM public key for RS256, otherwise the HS256 secret)", func(c *Config, v string) error {
+		c.JWTKeyFile = v
+		return nil
+	}},
+	{"policy", []string{"GRPCPOLICY"}, "YAML role policy file, reloaded when it changes", func(c *Config, v string) error {
+		c.PolicyFile = v
+		return nil
+	}},
+	{"keepalive-time", []string{"GRPCKEEPALIVETIME"}, "ping idle clients this often, e.g. 2h", func(c *Config, v string) error {
+		return setDuration(&c.Keepalive.Time, v)
+	}},
+	{"keepalive-timeout", []string{"GRPCKEEPALIVETIMEOUT"}, "close connections whose ping isn't answered within this, e.g. 20s", func(c *Config, v string) error {
+		return setDuration(&c.Keepalive.Timeout, v)
+	}},
+	{"max-connection-idle", []string{"GRPCMAXCONNECTIONIDLE"}, "close connections without calls for this long", func(c *Config, v string) error {
+		return setDuration(&c.Keepalive.MaxConnectionIdle, v)
+	}},
+	{"max-connection-age", []string{"GRPCMAXCONNECTIONAGE"}, "close connections this old", func(c *Config, v string) error {
+		return setDuration(&c.Keepalive.MaxConnectionAge, v)
+	}},
+	{"keepalive-min-time", []string{"GRPCKEEPALIVEMINTIME"}, "disconnect clients pinging more often than this", func(c *Config, v string) error {
+		return setDuration(&c.Keepalive.MinTime, v)
+	}},
+	{"keepalive-permit-without-stream", []string{"GRPCKEEPALIVEPERMITWITHOUTSTREAM"}, "let clients ping without calls in flight (true/false)", func(c *Config, v string) error {
+		return setBool(&c.Keepalive.PermitWithoutStream, v)
+	}},
+	{"drain-timeout", []string{"GRPCDRAINTIMEOUT"}, "how long shutting down waits for calls to finish, e.g. 10s", func(c *Config, v string) error {
+		return setDuration(&c.DrainTimeout, v)
+	}},
+	{"metrics-address", []string{"GRPCMETRICSADDRESS"}, "address to serve Prometheus metrics on at /metrics, empty to turn them off", func(c *Config, v string) error {
+		c.MetricsAddress = v
+		return nil
+	}},
+	{"tracing", []string{"GRPCTRACING"}, "export traces to \"otlp\" (OTEL_EXPORTER_OTLP_ENDPOINT, default localhost:4317) or \"stdout\", empty for neither", func(c *Config, v string) error {
+		c.Tracing = v
+		return nil
+	}},
+	{"max-recv-msg-size", []string{"GRPCMAXRECVMSGSIZE"}, "largest message to accept, in bytes", func(c *Config, v string) error {
+		return setInt(&c.MaxRecvMsgSize, v)
+	}},
+	{"max-send-msg-size", []string{"GRPCMAXSENDMSGSIZE"}, "largest message to send, in bytes", func(c *Config, v string) error {
+		return setInt(&c.MaxSendMsgSize, v)
+	}},
+}
+
+// Load builds a server's Config from its defaults, the config file, environment variables and flags,
+// in that order. It parses the command line flags, so call it first thing in main
+func Load(defaults Config) (*Config, error) {
+	configFile := flag.String("config", os.Getenv("GRPCCONFIG"), "YAML config file (env GRPCCONFIG)")
+	values := map[string]*string{}
+	for _, s := range settings {
+		values[s.flag] = flag.String(s.flag, "", fmt.Sprintf("%v (env %v)", s.usage, s.env[0]))
+	}
+	flag.Parse()
+
+	c := defaults
+	if *configFile != "" {
+		b, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %v", err)
+		}
+		if err := yaml.UnmarshalStrict(b, &c); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %v: %v", *configFile, err)
+		}
+	}
+
+	for _, s := range settings {
+		for _, env := range s.env {
+			value, varSet := os.LookupEnv(env)
+			if !varSet {
+				continue
+			}
+			if err := s.set(&c, value); err != nil {
+				return nil, fmt.Errorf("invalid %v %q: %v", env, value, err)
+			}
+			break
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				if setErr := s.set(&c, *values[s.flag]); setErr != nil {
+					err = fmt.Errorf("invalid -%v %q: %v", s.flag, *values[s.flag], setErr)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.TLS.MTLS {
+		c.TLS.Enabled = true
+	}
+	return &c, nil
+}
+
+func setBool(dst *bool, value string) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*dst = b
+	return nil
+}
+
+func setInt(dst *int, value string) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*dst = i
+	return nil
+}
+
+func setDuration(dst *time.Duration, value string) error {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*dst = d
+	return nil
+}
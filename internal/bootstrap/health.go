@@ -0,0 +1,74 @@
+package bootstrap
+
+import (
+	"context"
+	"log"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var healthInterval = 10 * time.Second // How often the dependency checks run
+
+var healthCheckTimeout = 5 * time.Second // How long a single dependency check gets
+
+// Check reports whether something a service depends on (e.g. a DynamoDB table) works. nil means it does
+type Check func(ctx context.Context) error
+
+// check is a Check for one service, see Server.AddCheck
+type check struct {
+	service string
+	name    string
+	fn      Check
+}
+
+// AddCheck makes service (its full name, e.g. "blog.BlogService") report NOT_SERVING on the health service
+// while fn fails. name says what's being checked, for the logs. Add checks before Run
+func (s *Server) AddCheck(service, name string, fn Check) {
+	s.checks = append(s.checks, check{service: service, name: name, fn: fn})
+}
+
+// checkHealth runs every check and sets the serving status of every service accordingly.
+// The server as a whole ("") is SERVING only if all of its services are
+func (s *Server) checkHealth(ctx context.Context) {
+	failing := map[string]bool{}
+	for _, c := range s.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := c.fn(checkCtx)
+		cancel()
+		if err != nil {
+			failing[c.service] = true
+			if !s.failing[c.service+"/"+c.name] {
+				log.Printf("Health check %v for %v failed: %v", c.name, c.service, err)
+			}
+		} else if s.failing[c.service+"/"+c.name] {
+			log.Printf("Health check %v for %v passes again", c.name, c.service)
+		}
+		s.failing[c.service+"/"+c.name] = err != nil
+	}
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for service := range s.GetServiceInfo() {
+		status := healthpb.HealthCheckResponse_SERVING
+		if failing[service] {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		s.Health.SetServingStatus(service, status)
+	}
+	s.Health.SetServingStatus("", overall)
+}
+
+// watchHealth runs the checks every healthInterval until ctx is done, i.e. the server shuts down
+func (s *Server) watchHealth(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkHealth(ctx)
+		}
+	}
+}
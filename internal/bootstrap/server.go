@@ -0,0 +1,239 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Kaurin/gRPC/internal/auth"
+	"github.com/Kaurin/gRPC/internal/authz"
+	"github.com/Kaurin/gRPC/internal/mtls"
+	"github.com/Kaurin/gRPC/internal/tracing"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+)
+
+// Server is a grpc.Server with the health service, that knows how to shut itself down gracefully
+type Server struct {
+	*grpc.Server
+	Health *health.Server
+
+	drainTimeout   time.Duration
+	shutdown       context.Context // Cancelled when shutting down, along with open streams and background workers
+	startShutdown  context.CancelFunc
+	workers        sync.WaitGroup // Background workers, see Go
+	metricsAddress string
+
+	checks  []check         // Dependency checks, see AddCheck
+	failing map[string]bool // Which checks failed last time, so only changes get logged
+}
+
+// NewServer builds a Server set up the way c says, with the health and reflection services registered.
+// Certificates and the policy file are reloaded in the background when they change
+func NewServer(c *Config) (*Server, error) {
+	srv := &Server{
+		Health:         health.NewServer(),
+		drainTimeout:   c.DrainTimeout,
+		metricsAddress: c.MetricsAddress,
+		failing:        map[string]bool{},
+	}
+	srv.shutdown, srv.startShutdown = context.WithCancel(context.Background())
+
+	opts := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:              c.Keepalive.Time,
+			Timeout:           c.Keepalive.Timeout,
+			MaxConnectionIdle: c.Keepalive.MaxConnectionIdle,
+			MaxConnectionAge:  c.Keepalive.MaxConnectionAge,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.Keepalive.MinTime,
+			PermitWithoutStream: c.Keepalive.PermitWithoutStream,
+		}),
+	}
+	if c.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+
+	// Rotated certificates are picked up without a restart, so open streams don't get cut off
+	if c.TLS.Enabled {
+		certs, err := mtls.NewCertProvider(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.Go(func(ctx context.Context) { certs.Watch(ctx) })
+
+		if c.TLS.MTLS {
+			creds, err := mtls.ServerCredentials(certs, c.TLS.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, grpc.Creds(creds))
+			log.Printf("Serving TLS with %v, requiring client certificates signed by %v (mTLS)", c.TLS.CertFile, c.TLS.ClientCAFile)
+		} else {
+			opts = append(opts, grpc.Creds(mtls.ServerTLSCredentials(certs)))
+			log.Printf("Serving TLS with %v", c.TLS.CertFile)
+		}
+	} else {
+		log.Printf("Serving plaintext")
+	}
+
+	// Interceptors, in the order they run. Tracing and metrics go first so they see the calls the others turn away,
+	// then shutting down cancels streams, see Run
+	unary := []grpc.UnaryServerInterceptor{tracing.UnaryServerInterceptor(), grpc_prometheus.UnaryServerInterceptor}
+	stream := []grpc.StreamServerInterceptor{tracing.StreamServerInterceptor(), grpc_prometheus.StreamServerInterceptor, srv.cancelOnShutdown}
+
+	if c.JWTKeyFile != "" {
+		verifier, err := auth.NewVerifier(c.JWTKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the JWT key: %v", err)
+		}
+		unary = append(unary, auth.UnaryServerInterceptor(verifier))
+		stream = append(stream, auth.StreamServerInterceptor(verifier))
+		log.Printf("Authenticating callers with JWTs verified by: %v", c.JWTKeyFile)
+	}
+
+	// Goes after authentication, which finds out the caller's roles
+	if c.PolicyFile != "" {
+		policy, err := authz.LoadPolicy(c.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the policy: %v", err)
+		}
+		srv.Go(func(ctx context.Context) { policy.Watch(ctx) })
+		unary = append(unary, authz.UnaryServerInterceptor(policy))
+		stream = append(stream, authz.StreamServerInterceptor(policy))
+		log.Printf("Authorizing calls with the policy in: %v", c.PolicyFile)
+	} else {
+		log.Printf("No policy set. All calls are allowed")
+	}
+
+	opts = append(opts,
+		grpc_middleware.WithUnaryServerChain(unary...),
+		grpc_middleware.WithStreamServerChain(stream...),
+	)
+
+	srv.Server = grpc.NewServer(opts...)
+	healthpb.RegisterHealthServer(srv.Server, srv.Health)
+	reflection.Register(srv.Server)
+
+	// Counts calls, codes and stream messages per method. Register makes every method show up at 0 before its first call
+	grpc_prometheus.EnableHandlingTimeHistogram()
+	grpc_prometheus.Register(srv.Server)
+	return srv, nil
+}
+
+// Run serves on lis until SIGINT or SIGTERM. Health reflects the dependency checks (see AddCheck) all along,
+// and Prometheus metrics are on http://<metrics address>/metrics. Then it shuts down gracefully:
+//  1. Health turns NOT_SERVING, so load balancers and health checks stop sending calls our way
+//  2. Open streams and background workers (see Go) get their context cancelled. Long streams (e.g. ListBlog,
+//     GreetManyTimes) would hold up the drain
+//  3. GracefulStop lets calls in flight finish, and workers wind down, for up to the drain timeout
+//  4. Whatever is still running after that gets cut off
+func (s *Server) Run(lis net.Listener) error {
+	// Services without checks are SERVING from the start
+	s.checkHealth(context.Background())
+	s.Go(s.watchHealth)
+
+	errs := make(chan error, 2) // Serve and the metrics server
+	if s.metricsAddress != "" {
+		metricsLis, err := net.Listen("tcp", s.metricsAddress)
+		if err != nil {
+			return fmt.Errorf("failed to listen for metrics: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metrics := &http.Server{Handler: mux}
+		// Still scrapable while draining
+		defer metrics.Close()
+		go func() {
+			if err := metrics.Serve(metricsLis); err != http.ErrServerClosed {
+				errs <- fmt.Errorf("metrics server failed: %v", err)
+			}
+		}()
+		log.Printf("Serving metrics on http://%v/metrics", metricsLis.Addr())
+	}
+
+	go func() {
+		errs <- s.Serve(lis)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		s.startShutdown()
+		return err
+	case sig := <-signals:
+		log.Printf("Got %v, shutting down. Waiting up to %v for calls to finish", sig, s.drainTimeout)
+	}
+
+	s.Health.Shutdown()
+	s.startShutdown()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Printf("All calls and workers finished. Stopped")
+	case <-time.After(s.drainTimeout):
+		log.Printf("Calls or workers still running after %v. Cutting them off", s.drainTimeout)
+		s.Stop()
+	}
+	return nil
+}
+
+// Go runs fn in the background while the server runs, e.g. a worker polling for something to do.
+// fn's context is cancelled once the server starts shutting down, and Run waits for fn to return, see Run
+func (s *Server) Go(fn func(ctx context.Context)) {
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		fn(s.shutdown)
+	}()
+}
+
+// cancelOnShutdown is a stream interceptor that cancels the stream's context once the server starts shutting down
+func (s *Server) cancelOnShutdown(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.shutdown.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// serverStream is a grpc.ServerStream with its context replaced
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
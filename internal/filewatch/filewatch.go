@@ -0,0 +1,57 @@
+// Package filewatch polls files for changes by their modification time, so servers can pick up a changed
+// role policy (see the authz package) or a rotated certificate (see the mtls package) without a restart.
+package filewatch
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+var pollInterval = 5 * time.Second // How often Watch checks the files for changes
+
+// ModTime returns when any of the files last changed, whichever is latest
+func ModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Watch calls reload whenever any of the files changes, until ctx is done. loaded is the ModTime of the files
+// as they were last loaded. Errors are logged, saying what the files are (e.g. "policy"), and the watch goes on.
+// Each change is only reloaded once, so broken files are only complained about once
+func Watch(ctx context.Context, what string, loaded time.Time, reload func() error, files ...string) error {
+	seen := loaded // Of the files last loaded, or that failed to
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		modTime, err := ModTime(files...)
+		if err != nil {
+			log.Printf("Could not check %v for changes: %v", what, err)
+			continue
+		}
+		if modTime.Equal(seen) {
+			continue
+		}
+		seen = modTime
+
+		if err := reload(); err != nil {
+			log.Printf("Could not reload %v, keeping the previous one: %v", what, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package filewatch
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	older, newer := filepath.Join(dir, "older"), filepath.Join(dir, "newer")
+	base := time.Now().Truncate(time.Second)
+	for file, modTime := range map[string]time.Time{older: base, newer: base.Add(time.Hour)} {
+		if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, files := range [][]string{{newer, older}, {older, newer}} {
+		if got, err := ModTime(files...); err != nil || !got.Equal(base.Add(time.Hour)) {
+			t.Errorf("ModTime(%q) = %v, %v, want the newer file's %v", files, got, err, base.Add(time.Hour))
+		}
+	}
+	if _, err := ModTime(older, filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("ModTime with a missing file succeeded, want an error")
+	}
+}
+
+func TestWatchReloadsEachChangeOnce(t *testing.T) {
+	saved := pollInterval
+	pollInterval = time.Millisecond
+	defer func() { pollInterval = saved }()
+
+	dir, err := ioutil.TempDir("", "filewatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "watched")
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ModTime(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, "test file", loaded, func() error {
+			reloads <- struct{}{}
+			return errors.New("broken") // Failing doesn't make Watch try the same change again
+		}, file)
+	}()
+
+	// Nothing changed yet
+	time.Sleep(20 * time.Millisecond)
+	if len(reloads) != 0 {
+		t.Fatalf("Watch reloaded %v times before the file changed", len(reloads))
+	}
+
+	changed := loaded.Add(time.Minute)
+	if err := os.Chtimes(file, changed, changed); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+	case <-time.After(time.Second):
+		t.Fatal("Watch didn't reload the changed file")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(reloads) != 0 {
+		t.Errorf("Watch reloaded one change %v more times", len(reloads))
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Watch returned %v, want %v", err, context.Canceled)
+	}
+}
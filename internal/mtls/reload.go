@@ -0,0 +1,90 @@
+package mtls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Kaurin/gRPC/internal/filewatch"
+)
+
+// CertProvider serves a certificate from files through tls.Config.GetCertificate, and swaps it when the files
+// change. Rotating certificates doesn't need a restart, so open connections and streams carry on
+type CertProvider struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // Of the newer of the two files the certificate was loaded from
+}
+
+// NewCertProvider loads a certificate and its key, PEM encoded
+func NewCertProvider(certFile, keyFile string) (*CertProvider, error) {
+	p := &CertProvider{certFile: certFile, keyFile: keyFile}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetCertificate hands out the current certificate. Use it as tls.Config.GetCertificate
+func (p *CertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cert, nil
+}
+
+// load (re)reads the certificate files. A key that doesn't go with the certificate, or a certificate that
+// isn't valid right now, is refused and the current certificate stays
+func (p *CertProvider) load() error {
+	modTime, err := filewatch.ModTime(p.certFile, p.keyFile) // The newer of the two
+	if err != nil {
+		return fmt.Errorf("failed to read certificate file: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(p.certFile, p.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate %v: %v", p.certFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate %v: %v", p.certFile, err)
+	}
+	if now := time.Now(); now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate %v is only valid from %v to %v", p.certFile, leaf.NotBefore, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = &cert
+	p.modTime = modTime
+	return nil
+}
+
+// Watch reloads the certificate whenever its files change, until ctx is done.
+// Certificates that fail to load are logged and the previous one stays in use. Rotations are logged too
+func (p *CertProvider) Watch(ctx context.Context) error {
+	p.mu.RLock()
+	loaded := p.modTime
+	p.mu.RUnlock()
+
+	return filewatch.Watch(ctx, "certificate", loaded, func() error {
+		if err := p.load(); err != nil {
+			return err
+		}
+		leaf := p.leaf()
+		log.Printf("Rotated certificate %v: %v, serial %v, valid until %v", p.certFile, leaf.Subject, leaf.SerialNumber, leaf.NotAfter)
+		return nil
+	}, p.certFile, p.keyFile)
+}
+
+// leaf returns the parsed current certificate
+func (p *CertProvider) leaf() *x509.Certificate {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.cert.Leaf
+}
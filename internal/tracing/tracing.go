@@ -0,0 +1,99 @@
+// Package tracing sets up OpenTelemetry tracing for the servers and clients. Calls carry their trace over gRPC
+// metadata (W3C traceparent), so a trace started in a client continues in the server it calls.
+//
+// Spans go to an OTLP collector (localhost:4317, or OTEL_EXPORTER_OTLP_ENDPOINT), or get printed to stdout.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc"
+)
+
+// Exporters Setup knows
+const (
+	ExporterOff    = ""
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+var flushTimeout = 5 * time.Second // How long stopping waits for the last spans to get exported
+
+// Setup makes the global tracer provider send the spans of service to exporter (one of the Exporter constants).
+// Call the returned func before exiting, it flushes spans that haven't been sent yet.
+// Traces are passed along even when exporter is ExporterOff, they just aren't recorded here
+func Setup(service, exporter string) (stop func(), err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var spanExporter sdktrace.SpanExporter
+	switch exporter {
+	case ExporterOff:
+		return func() {}, nil
+	case ExporterOTLP:
+		var opts []otlptracegrpc.Option
+		// A local collector doesn't do TLS. The env vars decide for anything else
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		spanExporter, err = otlptracegrpc.New(context.Background(), opts...)
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, want %q or %q", exporter, ExporterOTLP, ExporterStdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %v trace exporter: %v", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("Exporting traces of %v to %v", service, exporter)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("Failed to flush traces: %v", err)
+		}
+	}, nil
+}
+
+// StartRun starts the root span of a client run, named name. Pass ctx to every call the run makes, so they all end
+// up in one trace rather than a trace each. Call end once the run is done, before the func Setup returned
+func StartRun(name string) (ctx context.Context, end func()) {
+	ctx, span := otel.Tracer("github.com/Kaurin/gRPC/internal/tracing").Start(context.Background(), name)
+	return ctx, func() { span.End() }
+}
+
+// DialOptions make a client start a span for every call, and send its trace along to the server
+func DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor()),
+	}
+}
+
+// UnaryServerInterceptor continues the caller's trace with a span for the call
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return otelgrpc.UnaryServerInterceptor()
+}
+
+// StreamServerInterceptor continues the caller's trace with a span for the stream
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return otelgrpc.StreamServerInterceptor()
+}
@@ -11,13 +11,17 @@ set -x
 # server.csr: Server certificate signing request (this should be shared with the CA owner)
 # server.crt: Server certificate signed by the CA (this would be sent back by the CA owner) - keep on server
 # server.pem: Conversion of server.key into a format gRPC likes (this shouldn't be shared)
+# client.key, client.csr, client.crt, client.pem: Same as the server ones, for clients presenting a certificate (mTLS)
+# jwt.pem: Private key blog clients sign their JWTs with (this shouldn't be shared in real-life)
+# jwt.pub: Public key the blog server verifies JWTs with
 
 # Summary 
-# Private files: ca.key, server.key, server.pem, server.crt
-# "Share" files: ca.crt (needed by the client), server.csr (needed by the CA)
+# Private files: ca.key, server.key, server.pem, server.crt, client.key, client.pem, client.crt, jwt.pem
+# "Share" files: ca.crt (needed by the client and the server), server.csr and client.csr (needed by the CA)
 
 # Changes these CN's to match your hosts in your environment if needed.
 SERVER_CN=localhost
+CLIENT_CN=client
 
 # Step 1: Generate Certificate Authority + Trust Certificate (ca.crt)
 openssl genrsa -passout pass:1111 -des3 -out ca.key 4096
@@ -30,7 +34,22 @@ openssl genrsa -passout pass:1111 -des3 -out server.key 4096
 openssl req -passin pass:1111 -new -key server.key -out server.csr -subj "/CN=${SERVER_CN}"
 
 # Step 4: Sign the certificate with the CA we created (it's called self signing) - server.crt
-openssl x509 -req -passin pass:1111 -days 3650 -in server.csr -CA ca.crt -CAkey ca.key -set_serial 01 -out server.crt 
+# Newer clients only check the host name against the subjectAltName, so the server cert gets one
+echo "subjectAltName=DNS:${SERVER_CN}" > server.ext
+openssl x509 -req -passin pass:1111 -days 3650 -in server.csr -CA ca.crt -CAkey ca.key -set_serial 01 -extfile server.ext -out server.crt
+rm server.ext
 
 # Step 5: Convert the server certificate to .pem format (server.pem) - usable by gRPC
 openssl pkcs8 -topk8 -nocrypt -passin pass:1111 -in server.key -out server.pem
+
+# Step 6: Same for a client certificate (client.crt + client.pem), for clients of servers that require one (mTLS)
+openssl genrsa -passout pass:1111 -des3 -out client.key 4096
+openssl req -passin pass:1111 -new -key client.key -out client.csr -subj "/CN=${CLIENT_CN}"
+echo "extendedKeyUsage=clientAuth" > client.ext
+openssl x509 -req -passin pass:1111 -days 3650 -in client.csr -CA ca.crt -CAkey ca.key -set_serial 02 -extfile client.ext -out client.crt
+rm client.ext
+openssl pkcs8 -topk8 -nocrypt -passin pass:1111 -in client.key -out client.pem
+
+# Step 7: Generate the JWT signing key pair (jwt.pem + jwt.pub) - RS256 tokens for the blog
+openssl genrsa -out jwt.pem 2048
+openssl rsa -in jwt.pem -pubout -out jwt.pub